@@ -0,0 +1,83 @@
+// Command jwtkeys manages the keys access tokens are signed with when
+// JWT_ALGORITHM is RS256 or EdDSA. A rotation is:
+//
+//	jwtkeys generate         # new key; servers publish it after a restart
+//	jwtkeys promote <kid>    # once every server and JWKS cache has it
+//	jwtkeys retire <kid>     # once every server signs with the new key
+//	jwtkeys remove <kid>     # once tokens signed by the old key have expired
+//
+// Servers only read the key directory at startup, so restart them after
+// each step. The first key is generated and promoted straight away.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/jwtkeys"
+)
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	dir := flag.String("dir", cfg.JWTKeysDir, "directory of signing keys")
+	alg := flag.String("alg", cfg.JWTAlgorithm, "algorithm of generated keys (RS256 or EdDSA)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: jwtkeys [-dir dir] [-alg alg] generate | promote <kid> | retire <kid> | remove <kid> | list")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	switch flag.Arg(0) {
+	case "generate":
+		kid, err := jwtkeys.Generate(*alg, *dir)
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		fmt.Println(kid)
+	case "promote":
+		if err := jwtkeys.Promote(*dir, requireKeyID()); err != nil {
+			log.Fatalf("Failed to promote key: %v", err)
+		}
+	case "retire":
+		if err := jwtkeys.Retire(*dir, requireKeyID()); err != nil {
+			log.Fatalf("Failed to retire key: %v", err)
+		}
+	case "remove":
+		if err := jwtkeys.Remove(*dir, requireKeyID()); err != nil {
+			log.Fatalf("Failed to remove key: %v", err)
+		}
+	case "list":
+		keys, err := jwtkeys.Load(*alg, *dir, cfg.JWTSigningKeyID)
+		if err != nil {
+			log.Fatalf("Failed to load keys: %v", err)
+		}
+		for _, key := range keys.JWKS().Keys {
+			marker := ""
+			switch {
+			case key.KeyID == keys.SigningKeyID():
+				marker = " (signing)"
+			case keys.Pending(key.KeyID):
+				marker = " (pending)"
+			}
+			fmt.Printf("%s %s%s\n", key.KeyID, key.Algorithm, marker)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func requireKeyID() string {
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	return flag.Arg(1)
+}
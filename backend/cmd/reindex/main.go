@@ -0,0 +1,67 @@
+// Command reindex rebuilds the local search index from the messages
+// collection. Run it while the server is stopped, or point -path at a fresh
+// directory and swap it in afterwards.
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/search"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	path := flag.String("path", cfg.SearchIndexPath, "directory of the local search index")
+	flag.Parse()
+
+	ctx := context.Background()
+	db, err := database.Connect(ctx, cfg.MongoDBURI, cfg.MongoDBDatabase)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Disconnect(ctx)
+
+	index, err := search.OpenLocalIndex(*path)
+	if err != nil {
+		log.Fatalf("Failed to open search index: %v", err)
+	}
+	defer index.Close()
+
+	// Messages deleted for everyone are never searchable
+	cursor, err := db.DB.Collection("messages").Find(ctx, bson.M{"deleted": bson.M{"$ne": true}})
+	if err != nil {
+		log.Fatalf("Failed to read messages: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	count, err := index.Rebuild(ctx, func() (*search.Document, error) {
+		for cursor.Next(ctx) {
+			var msg models.Message
+			if err := cursor.Decode(&msg); err != nil {
+				log.Printf("Skipping undecodable message: %v", err)
+				continue
+			}
+			return search.DocumentFromMessage(&msg), nil
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	})
+	if err != nil {
+		log.Fatalf("Reindex failed after %d messages: %v", count, err)
+	}
+
+	log.Printf("Reindexed %d messages into %s", count, *path)
+}
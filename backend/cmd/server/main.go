@@ -5,18 +5,30 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/account"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/auth"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/device"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/linkpreview"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/media"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/message"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/middleware"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/presence"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/search"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/user"
 	internalWebsocket "github.com/ganeshkantimahanthi/messaging-platform/internal/websocket"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/cache"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/eventbus"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/jwtkeys"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/mailer"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/storage"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -31,6 +43,12 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	// Load token signing keys
+	jwtKeys, err := loadJWTKeys(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+
 	// Initialize database
 	ctx := context.Background()
 	db, err := database.Connect(ctx, cfg.MongoDBURI, cfg.MongoDBDatabase)
@@ -44,21 +62,84 @@ func main() {
 		log.Printf("Warning: Failed to initialize indexes: %v", err)
 	}
 
-	// Initialize cache
-	appCache := cache.New(cfg.CacheTTL, cfg.CacheCleanupInterval)
+	// Initialize the cache the services below share
+	appCache, err := cache.New[string, any](cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize cache: %v", err)
+	}
+
+	// Initialize mailer
+	mail, err := mailer.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
 
 	// Initialize services
-	authService := auth.NewService(db, cfg)
+	usernames, err := validation.NewUsernameRules(cfg.UsernameMinLength, cfg.UsernameMaxLength, cfg.UsernameCharset, cfg.ReservedUsernames)
+	if err != nil {
+		log.Fatalf("Invalid username rules: %v", err)
+	}
+
+	authService := auth.NewService(db, cfg, jwtKeys, mail, usernames)
 	userService := user.NewService(db)
-	presenceService := presence.NewService(db, appCache)
-	messageService := message.NewService(db)
+	presenceService := presence.NewService(db, cache.NewNamespace[*presence.PresenceInfo](appCache, "presence"), cfg.PresenceAwayAfter)
+	deviceService := device.NewService(db)
+	searchIndexer, err := search.New(cfg, db)
+	if err != nil {
+		log.Fatalf("Failed to open search index: %v", err)
+	}
+	defer searchIndexer.Close()
+	blobStore, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize blob storage: %v", err)
+	}
+	mediaService := media.NewService(db, blobStore, cfg)
+	linkPreviewService := linkpreview.NewService(
+		db,
+		linkpreview.NewHTTPFetcher(cfg.LinkPreviewTimeout, cfg.LinkPreviewMaxBytes),
+		cache.NewNamespace[*models.LinkPreview](appCache, "link_preview"),
+	)
+	messageService := message.NewService(db, searchIndexer, mediaService, linkPreviewService)
+	accountService := account.NewService(db, blobStore, searchIndexer, cfg)
 
-	// Initialize WebSocket manager
-	wsManager := internalWebsocket.NewManager(db, appCache, messageService, presenceService, cfg)
+	// Initialize WebSocket manager, reaching other instances over the event bus
+	eventBus, err := eventbus.New(cfg, db)
+	if err != nil {
+		log.Fatalf("Failed to initialize event bus: %v", err)
+	}
+	wsManager := internalWebsocket.NewManager(db, messageService, presenceService, deviceService, eventBus, jwtKeys,
+		cache.NewNamespace[bool](appCache, "session"),
+		cache.NewNamespace[[]string](appCache, "remote_instances"),
+		cfg,
+	)
+	wsManager.Reconcile()
+	if err := eventBus.Subscribe(wsManager.HandleEvent); err != nil {
+		log.Fatalf("Failed to subscribe to the event bus: %v", err)
+	}
 	go wsManager.Run()
 
+	// Start media processing workers
+	mediaProcessor := media.NewProcessor(mediaService, wsManager, cfg.MediaWorkers)
+	mediaProcessor.Start()
+
+	// Start link preview workers
+	linkPreviewProcessor := linkpreview.NewProcessor(linkPreviewService, wsManager, cfg.LinkPreviewWorkers, cfg.LinkPreviewTimeout)
+	linkPreviewProcessor.Start()
+
+	// Start clearing expired custom statuses
+	statusProcessor := user.NewStatusProcessor(userService, wsManager, cfg.StatusJobInterval)
+	statusProcessor.Start()
+
+	// Start data export and account deletion jobs
+	accountProcessor := account.NewProcessor(accountService, wsManager, cfg.AccountJobInterval)
+	accountProcessor.Start()
+
 	// Initialize Fiber app
 	app := fiber.New(fiber.Config{
+		// Bodies over the default limit are streamed rather than held in
+		// memory; middleware.BodyLimit decides which routes accept them
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -73,33 +154,70 @@ func main() {
 	// Middleware
 	app.Use(recover.New())
 	app.Use(logger.New())
+	app.Use(middleware.BodyLimit(fiber.DefaultBodyLimit, isUpload))
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     cfg.CORSOrigins,
 		AllowCredentials: true,
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, Upload-Offset, Range",
+		ExposeHeaders:    "Location, Upload-Offset, Content-Range, Accept-Ranges",
 	}))
 
 	// Health check
 	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "ok"})
+		return c.JSON(fiber.Map{"status": "ok", "cache": appCache.Stats()})
 	})
 
 	// API routes
 	api := app.Group("/api")
 
 	// Auth routes
+	authHandler := auth.NewHandler(authService, wsManager)
 	authRoutes := api.Group("/auth")
-	authRoutes.Post("/register", auth.NewHandler(authService).Register)
-	authRoutes.Post("/login", auth.NewHandler(authService).Login)
+	authRoutes.Post("/register", authHandler.Register)
+	authRoutes.Post("/login", authHandler.Login)
+	authRoutes.Post("/login/2fa", authHandler.LoginTwoFactor)
+	authRoutes.Get("/oidc/providers", authHandler.OIDCProviders)
+	authRoutes.Post("/oidc/exchange", authHandler.OIDCExchange)
+	authRoutes.Get("/oidc/:provider", authHandler.StartOIDC)
+	authRoutes.Get("/oidc/:provider/callback", authHandler.OIDCCallback)
+	authRoutes.Post("/refresh", authHandler.Refresh)
+	authRoutes.Post("/verify-email", authHandler.VerifyEmail)
+	authRoutes.Post("/confirm-email", authHandler.ConfirmEmailChange)
+	authRoutes.Post("/forgot-password", authHandler.ForgotPassword)
+	authRoutes.Post("/reset-password", authHandler.ResetPassword)
+
+	// Public keys for verifying access tokens
+	app.Get("/.well-known/jwks.json", authHandler.JWKS)
 
 	// Protected routes
-	protected := api.Group("", middleware.AuthMiddleware(cfg.JWTSecret))
+	protected := api.Group("", middleware.AuthMiddleware(jwtKeys, wsManager))
+
+	// Session routes
+	protected.Post("/auth/logout", authHandler.Logout)
+	protected.Get("/auth/sessions", authHandler.GetSessions)
+	protected.Delete("/auth/sessions/:id", authHandler.RevokeSession)
+	protected.Post("/auth/verify-email/resend", authHandler.ResendVerification)
+	protected.Put("/auth/password", authHandler.ChangePassword)
+	protected.Put("/auth/email", authHandler.ChangeEmail)
+	protected.Put("/auth/username", authHandler.ChangeUsername)
+	protected.Get("/auth/username/history", authHandler.GetUsernameHistory)
+	protected.Get("/auth/2fa", authHandler.GetTwoFactor)
+	protected.Post("/auth/2fa/setup", authHandler.SetupTwoFactor)
+	protected.Post("/auth/2fa/enable", authHandler.EnableTwoFactor)
+	protected.Post("/auth/2fa/disable", authHandler.DisableTwoFactor)
+
+	// Admin routes
+	adminRoutes := protected.Group("/admin", authHandler.RequireAdmin)
+	adminRoutes.Post("/login-unlock", authHandler.UnlockLogin)
+	adminRoutes.Get("/auth-failures", authHandler.GetAuthFailures)
 
 	// User routes
-	userHandler := user.NewHandler(userService)
+	userHandler := user.NewHandler(userService, wsManager)
 	userRoutes := protected.Group("/users")
 	userRoutes.Get("/me", userHandler.GetMe)
 	userRoutes.Put("/me", userHandler.UpdateMe)
+	userRoutes.Put("/me/status", userHandler.SetStatus)
+	userRoutes.Delete("/me/status", userHandler.ClearStatus)
 	userRoutes.Get("/search", userHandler.Search)
 	userRoutes.Get("/:id", userHandler.GetByID)
 
@@ -113,12 +231,50 @@ func main() {
 	messageHandler := message.NewHandler(messageService, wsManager)
 	messageRoutes := protected.Group("/messages")
 	messageRoutes.Post("/", messageHandler.Send)
+	messageRoutes.Get("/search", messageHandler.Search)
 	messageRoutes.Get("/conversations", messageHandler.GetConversations)
 	messageRoutes.Get("/conversations/:id", messageHandler.GetMessages)
+	messageRoutes.Put("/:id", messageHandler.Edit)
+	messageRoutes.Delete("/:id", messageHandler.Delete)
 	messageRoutes.Put("/:id/status", messageHandler.UpdateStatus)
 
+	// Media routes
+	mediaHandler := media.NewHandler(mediaService)
+	mediaRoutes := protected.Group("/media")
+	// Leave room for multipart framing around the largest allowed upload
+	uploadLimit := middleware.BodyLimit(int(cfg.MediaMaxSize)+1024*1024, nil)
+	mediaRoutes.Post("/", uploadLimit, mediaHandler.Upload)
+	mediaRoutes.Post("/uploads", mediaHandler.CreateUpload)
+	mediaRoutes.Get("/uploads/:id", mediaHandler.GetUpload)
+	mediaRoutes.Patch("/uploads/:id", uploadLimit, mediaHandler.AppendChunk)
+	mediaRoutes.Get("/:id", mediaHandler.Get)
+	mediaRoutes.Get("/:id/content", mediaHandler.Download)
+	mediaRoutes.Get("/:id/thumbnail", mediaHandler.Thumbnail)
+	mediaRoutes.Get("/:id/signed-url", mediaHandler.SignURL)
+
+	// Presence routes
+	presenceHandler := presence.NewHandler(presenceService, cfg.PresenceMaxSubs)
+	protected.Get("/presence", presenceHandler.Get)
+
+	// Device routes
+	deviceHandler := device.NewHandler(deviceService, wsManager)
+	protected.Get("/devices", deviceHandler.List)
+	protected.Delete("/devices/:id", deviceHandler.SignOut)
+
+	// Account routes
+	accountHandler := account.NewHandler(accountService)
+	accountRoutes := protected.Group("/account")
+	accountRoutes.Post("/export", accountHandler.RequestExport)
+	accountRoutes.Get("/exports", accountHandler.ListExports)
+	accountRoutes.Get("/exports/:id/download", accountHandler.DownloadExport)
+	accountRoutes.Post("/deletion", accountHandler.ScheduleDeletion)
+	accountRoutes.Delete("/deletion", accountHandler.CancelDeletion)
+
+	// Signed media URLs carry their own authorization
+	app.Get("/media/:id/:variant", mediaHandler.Signed)
+
 	// WebSocket route
-	app.Get("/ws", middleware.WSAuthMiddleware(cfg.JWTSecret), websocket.New(internalWebsocket.NewHandler(wsManager).HandleWebSocket))
+	app.Get("/ws", middleware.WSAuthMiddleware(jwtKeys), websocket.New(internalWebsocket.NewHandler(wsManager).HandleWebSocket))
 
 	// Start server
 	go func() {
@@ -138,9 +294,43 @@ func main() {
 	defer cancel()
 
 	wsManager.Shutdown()
+	eventBus.Close()
+	mediaProcessor.Stop()
+	linkPreviewProcessor.Stop()
+	accountProcessor.Stop()
+	statusProcessor.Stop()
+	appCache.Stop()
 	if err := app.ShutdownWithContext(ctx); err != nil {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
 	log.Println("Server exited")
 }
+
+// loadJWTKeys returns the shared-secret key set for HS256, or the key
+// directory's keys for RS256 and EdDSA
+func loadJWTKeys(cfg *config.Config) (*jwtkeys.KeySet, error) {
+	if cfg.JWTAlgorithm == jwtkeys.HS256 {
+		return jwtkeys.NewHMAC(cfg.JWTSecret), nil
+	}
+
+	keys, err := jwtkeys.Load(cfg.JWTAlgorithm, cfg.JWTKeysDir, cfg.JWTSigningKeyID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Signing tokens with %s key %s", keys.Algorithm(), keys.SigningKeyID())
+	return keys, nil
+}
+
+// isUpload reports whether a request goes to a media upload route, the
+// only ones that accept bodies over the default limit
+func isUpload(c *fiber.Ctx) bool {
+	path := strings.TrimSuffix(c.Path(), "/")
+	switch c.Method() {
+	case fiber.MethodPost:
+		return path == "/api/media"
+	case fiber.MethodPatch:
+		return strings.HasPrefix(path, "/api/media/uploads/")
+	}
+	return false
+}
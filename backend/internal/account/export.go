@@ -0,0 +1,320 @@
+package account
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportContact is a contact as it appears in an export, with the name the
+// user would recognize
+type exportContact struct {
+	UserID      primitive.ObjectID `json:"user_id"`
+	Username    string             `json:"username,omitempty"`
+	DisplayName string             `json:"display_name,omitempty"`
+	Blocked     bool               `json:"blocked"`
+	AddedAt     time.Time          `json:"added_at"`
+}
+
+// processExport builds the archive for an export and stores it. Failures
+// are recorded on the export so the user sees them.
+func (s *Service) processExport(ctx context.Context, id primitive.ObjectID) {
+	exports := s.db.DB.Collection("data_exports")
+
+	// Claim the export so another instance doesn't build it too
+	var export models.DataExport
+	err := exports.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": id, "status": "pending"},
+		bson.M{"$set": bson.M{"status": "processing", "started_at": time.Now()}},
+	).Decode(&export)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to claim export %s: %v", id.Hex(), err)
+		}
+		return
+	}
+
+	key, size, err := s.buildExport(ctx, &export)
+	if err != nil {
+		log.Printf("Failed to build export %s: %v", id.Hex(), err)
+		_, _ = exports.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+			"status": "failed",
+			"error":  "the export could not be created; please try again",
+		}})
+		return
+	}
+
+	now := time.Now()
+	_, err = exports.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"status":       "ready",
+		"storage_key":  key,
+		"size":         size,
+		"completed_at": now,
+		"expires_at":   now.Add(s.exportTTL),
+	}})
+	if err != nil {
+		log.Printf("Failed to finish export %s: %v", id.Hex(), err)
+	}
+}
+
+// buildExport writes the user's profile, contacts, devices, conversations,
+// the messages they sent and the media they uploaded to a zip archive
+func (s *Service) buildExport(ctx context.Context, export *models.DataExport) (string, int64, error) {
+	var user models.User
+	if err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": export.UserID}).Decode(&user); err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	archive := zip.NewWriter(tmp)
+	steps := []func(context.Context, *zip.Writer, *models.User) error{
+		s.exportProfile,
+		s.exportContacts,
+		s.exportDevices,
+		s.exportConversations,
+		s.exportMessages,
+		s.exportMedia,
+	}
+	for _, step := range steps {
+		if err := step(ctx, archive, &user); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return "", 0, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+
+	key := fmt.Sprintf("exports/%s/%s.zip", user.ID.Hex(), export.ID.Hex())
+	if err := s.store.Put(ctx, key, tmp, size, "application/zip"); err != nil {
+		return "", 0, err
+	}
+	return key, size, nil
+}
+
+func (s *Service) exportProfile(ctx context.Context, archive *zip.Writer, user *models.User) error {
+	var history []*models.UsernameHistory
+	cursor, err := s.db.DB.Collection("username_history").Find(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &history); err != nil {
+		return err
+	}
+
+	return writeJSON(archive, "profile.json", map[string]interface{}{
+		"user":             user,
+		"username_history": history,
+	})
+}
+
+func (s *Service) exportContacts(ctx context.Context, archive *zip.Writer, user *models.User) error {
+	var contacts []models.Contact
+	cursor, err := s.db.DB.Collection("contacts").Find(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return err
+	}
+
+	ids := make([]primitive.ObjectID, len(contacts))
+	for i, contact := range contacts {
+		ids[i] = contact.ContactID
+	}
+	var users []models.User
+	cursor, err = s.db.DB.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+	byID := make(map[primitive.ObjectID]*models.User, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+
+	entries := make([]exportContact, len(contacts))
+	for i, contact := range contacts {
+		entries[i] = exportContact{
+			UserID:      contact.ContactID,
+			DisplayName: contact.DisplayName,
+			Blocked:     contact.Blocked,
+			AddedAt:     contact.AddedAt,
+		}
+		if u := byID[contact.ContactID]; u != nil {
+			entries[i].Username = u.Username
+			if entries[i].DisplayName == "" {
+				entries[i].DisplayName = u.DisplayName
+			}
+		}
+	}
+	return writeJSON(archive, "contacts.json", entries)
+}
+
+func (s *Service) exportDevices(ctx context.Context, archive *zip.Writer, user *models.User) error {
+	var devices []models.Device
+	cursor, err := s.db.DB.Collection("devices").Find(ctx, bson.M{"user_id": user.ID},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &devices); err != nil {
+		return err
+	}
+	return writeJSON(archive, "devices.json", devices)
+}
+
+func (s *Service) exportConversations(ctx context.Context, archive *zip.Writer, user *models.User) error {
+	var conversations []models.Conversation
+	cursor, err := s.db.DB.Collection("conversations").Find(ctx, bson.M{"participants": user.ID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &conversations); err != nil {
+		return err
+	}
+	return writeJSON(archive, "conversations.json", conversations)
+}
+
+// exportMessages streams the user's own messages, since there may be too
+// many to hold in memory
+func (s *Service) exportMessages(ctx context.Context, archive *zip.Writer, user *models.User) error {
+	cursor, err := s.db.DB.Collection("messages").Find(ctx, bson.M{"sender_id": user.ID, "deleted": bson.M{"$ne": true}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	w, err := archive.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+
+	first := true
+	for cursor.Next(ctx) {
+		var msg models.Message
+		if err := cursor.Decode(&msg); err != nil {
+			return err
+		}
+		data, err := json.Marshal(&msg)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ",\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+// exportMedia copies every finished upload into media/
+func (s *Service) exportMedia(ctx context.Context, archive *zip.Writer, user *models.User) error {
+	cursor, err := s.db.DB.Collection("media").Find(ctx, bson.M{"owner_id": user.ID, "status": bson.M{"$ne": "uploading"}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var files []*models.MediaFile
+	for cursor.Next(ctx) {
+		var file models.MediaFile
+		if err := cursor.Decode(&file); err != nil {
+			return err
+		}
+		files = append(files, &file)
+
+		name := file.ID.Hex()
+		if file.FileName != "" {
+			name += "-" + safeFileName(file.FileName)
+		}
+		if err := s.copyBlob(ctx, archive, file.StorageKey, "media/"+name); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	return writeJSON(archive, "media.json", files)
+}
+
+func (s *Service) copyBlob(ctx context.Context, archive *zip.Writer, key, name string) error {
+	reader, err := s.store.Get(ctx, key, 0, -1)
+	if err != nil {
+		// A missing blob shouldn't make the rest of the data unavailable
+		log.Printf("Skipping %s in export: %v", key, err)
+		return nil
+	}
+	defer reader.Close()
+
+	// Media is mostly compressed already
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+func writeJSON(archive *zip.Writer, name string, v interface{}) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// safeFileName keeps an uploaded name from escaping its directory in the
+// archive
+func safeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return "file"
+	}
+	return name
+}
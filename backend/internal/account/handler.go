@@ -0,0 +1,114 @@
+package account
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{service: service}
+}
+
+type DeletionRequest struct {
+	Password string `json:"password"`
+}
+
+// RequestExport starts building an archive of the caller's data
+func (h *Handler) RequestExport(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	export, err := h.service.RequestExport(c.Context(), userID)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(export)
+}
+
+func (h *Handler) ListExports(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	exports, err := h.service.ListExports(c.Context(), userID)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(exports)
+}
+
+// DownloadExport streams a finished archive
+func (h *Handler) DownloadExport(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	export, reader, err := h.service.OpenExport(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="export-%s.zip"`, export.CreatedAt.Format("2006-01-02")))
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	return c.SendStream(reader, int(export.Size))
+}
+
+// ScheduleDeletion deletes the caller's account once the grace period ends
+func (h *Handler) ScheduleDeletion(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req DeletionRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	deleteAfter, err := h.service.ScheduleDeletion(c.Context(), userID, req.Password)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"delete_after": deleteAfter,
+	})
+}
+
+func (h *Handler) CancelDeletion(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := h.service.CancelDeletion(c.Context(), userID); err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "account deletion cancelled",
+	})
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrExportNotFound), errors.Is(err, ErrUserNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, ErrExportNotReady), errors.Is(err, ErrDeletionScheduled), errors.Is(err, ErrNoDeletionPending):
+		return fiber.StatusConflict
+	case errors.Is(err, ErrWrongPassword):
+		return fiber.StatusBadRequest
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
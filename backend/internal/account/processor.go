@@ -0,0 +1,157 @@
+package account
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// An export still "processing" this long after it was claimed was
+// abandoned by an instance that stopped part way
+const exportStaleAfter = time.Hour
+
+// SessionCloser disconnects the live connections of a deleted account's
+// sessions
+type SessionCloser interface {
+	CloseSession(sessionID string)
+}
+
+// Processor builds queued exports in the background and, every interval,
+// deletes accounts whose grace period has passed and expired archives
+type Processor struct {
+	service  *Service
+	sessions SessionCloser
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewProcessor(service *Service, sessions SessionCloser, interval time.Duration) *Processor {
+	return &Processor{
+		service:  service,
+		sessions: sessions,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (p *Processor) Start() {
+	p.wg.Add(2)
+	go p.work()
+	go p.sweep()
+}
+
+func (p *Processor) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *Processor) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case id := <-p.service.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+			p.service.processExport(ctx, id)
+			cancel()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Processor) sweep() {
+	defer p.wg.Done()
+
+	p.runJobs()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.runJobs()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Processor) runJobs() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	p.requeuePending(ctx)
+	p.purgeDueAccounts(ctx)
+	if err := p.service.DeleteExpiredExports(ctx); err != nil {
+		log.Printf("Failed to delete expired exports: %v", err)
+	}
+}
+
+// requeuePending picks up exports left behind by a restart or a full queue
+func (p *Processor) requeuePending(ctx context.Context) {
+	exports := p.service.db.DB.Collection("data_exports")
+
+	// Exports claimed before started_at was recorded go by created_at
+	staleBefore := time.Now().Add(-exportStaleAfter)
+	_, err := exports.UpdateMany(
+		ctx,
+		bson.M{"status": "processing", "$or": []bson.M{
+			{"started_at": bson.M{"$lt": staleBefore}},
+			{"started_at": nil, "created_at": bson.M{"$lt": staleBefore}},
+		}},
+		bson.M{"$set": bson.M{"status": "failed", "error": "the export could not be created; please try again"}},
+	)
+	if err != nil {
+		log.Printf("Failed to expire abandoned exports: %v", err)
+	}
+
+	cursor, err := exports.Find(ctx, bson.M{"status": "pending"})
+	if err != nil {
+		log.Printf("Failed to load pending exports: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var export models.DataExport
+		if err := cursor.Decode(&export); err != nil {
+			continue
+		}
+		select {
+		case p.service.queue <- export.ID:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Processor) purgeDueAccounts(ctx context.Context) {
+	due, err := p.service.DueDeletions(ctx)
+	if err != nil {
+		log.Printf("Failed to load accounts due for deletion: %v", err)
+		return
+	}
+
+	for _, uid := range due {
+		sessionIDs, err := p.service.PurgeUser(ctx, uid)
+		if err != nil {
+			// Cancelled in the meantime
+			if err != mongo.ErrNoDocuments {
+				log.Printf("Failed to delete account %s: %v", uid.Hex(), err)
+			}
+			continue
+		}
+		for _, sid := range sessionIDs {
+			p.sessions.CloseSession(sid)
+		}
+		log.Printf("Deleted account %s", uid.Hex())
+	}
+}
@@ -0,0 +1,314 @@
+package account
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/search"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DueDeletions returns the accounts whose grace period has run out
+func (s *Service) DueDeletions(ctx context.Context) ([]primitive.ObjectID, error) {
+	ids, err := s.db.DB.Collection("users").Distinct(ctx, "_id", bson.M{"delete_after": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+
+	due := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			due = append(due, oid)
+		}
+	}
+	return due, nil
+}
+
+// PurgeUser deletes an account whose grace period has run out and returns
+// its sessions so their live connections can be closed. Messages the user
+// sent to groups stay for the other members but lose their sender; direct
+// messages go with the account. Each step is safe to repeat, so a purge
+// interrupted part way is finished on the next run.
+func (s *Service) PurgeUser(ctx context.Context, uid primitive.ObjectID) ([]string, error) {
+	var user models.User
+	err := s.db.DB.Collection("users").FindOne(ctx, bson.M{
+		"_id":          uid,
+		"delete_after": bson.M{"$lte": time.Now()},
+	}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionIDs, err := s.deleteSessions(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.purgeMessages(ctx, uid); err != nil {
+		return nil, err
+	}
+	if err := s.purgeConversations(ctx, uid); err != nil {
+		return nil, err
+	}
+
+	// Rows that only ever belong to the user
+	owned := []struct {
+		collection string
+		filter     bson.M
+	}{
+		{"contacts", bson.M{"$or": []bson.M{{"user_id": uid}, {"contact_id": uid}}}},
+		{"message_queue", bson.M{"user_id": uid}},
+		{"active_connections", bson.M{"user_id": uid}},
+		{"devices", bson.M{"user_id": uid}},
+		{"account_tokens", bson.M{"user_id": uid}},
+		{"identities", bson.M{"user_id": uid}},
+		{"username_history", bson.M{"user_id": uid}},
+		{"username_reservations", bson.M{"user_id": uid}},
+		{"login_throttles", bson.M{"_id": "account:" + strings.ToLower(user.Username)}},
+	}
+	for _, o := range owned {
+		if _, err := s.db.DB.Collection(o.collection).DeleteMany(ctx, o.filter); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.purgeMedia(ctx, uid); err != nil {
+		return nil, err
+	}
+	if err := s.purgeExports(ctx, bson.M{"user_id": uid}); err != nil {
+		return nil, err
+	}
+
+	// Keep the name from being claimed straight away by someone posing as
+	// the deleted user
+	now := time.Now()
+	_, err = s.db.DB.Collection("username_reservations").ReplaceOne(
+		ctx,
+		bson.M{"_id": strings.ToLower(user.Username)},
+		&models.UsernameReservation{
+			Username:   strings.ToLower(user.Username),
+			UserID:     models.DeletedUserID,
+			ReleasedAt: now,
+			ExpiresAt:  now.Add(s.reservation),
+		},
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.db.DB.Collection("users").DeleteOne(ctx, bson.M{"_id": uid}); err != nil {
+		return nil, err
+	}
+	return sessionIDs, nil
+}
+
+func (s *Service) deleteSessions(ctx context.Context, uid primitive.ObjectID) ([]string, error) {
+	sessions := s.db.DB.Collection("sessions")
+	ids, err := sessions.Distinct(ctx, "_id", bson.M{"user_id": uid})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sessions.DeleteMany(ctx, bson.M{"user_id": uid}); err != nil {
+		return nil, err
+	}
+
+	sessionIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			sessionIDs = append(sessionIDs, oid.Hex())
+		}
+	}
+	return sessionIDs, nil
+}
+
+// purgeMessages anonymizes the user's group messages, deletes the rest and
+// drops the user from other people's receipts
+func (s *Service) purgeMessages(ctx context.Context, uid primitive.ObjectID) error {
+	messages := s.db.DB.Collection("messages")
+	conversationIDs, err := messages.Distinct(ctx, "conversation_id", bson.M{"sender_id": uid})
+	if err != nil {
+		return err
+	}
+	groups, err := s.db.DB.Collection("conversations").Distinct(ctx, "_id", bson.M{
+		"_id":  bson.M{"$in": conversationIDs},
+		"type": "group",
+	})
+	if err != nil {
+		return err
+	}
+
+	cursor, err := messages.Find(ctx, bson.M{"sender_id": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var removed []primitive.ObjectID
+	for cursor.Next(ctx) {
+		var msg models.Message
+		if err := cursor.Decode(&msg); err != nil {
+			return err
+		}
+
+		if containsID(groups, msg.ConversationID) {
+			msg.SenderID = models.DeletedUserID
+			if _, err := messages.UpdateOne(ctx, bson.M{"_id": msg.ID}, bson.M{"$set": bson.M{"sender_id": msg.SenderID}}); err != nil {
+				return err
+			}
+			if !msg.Deleted {
+				if err := s.indexer.Index(ctx, search.DocumentFromMessage(&msg)); err != nil {
+					log.Printf("Failed to reindex message %s: %v", msg.ID.Hex(), err)
+				}
+			}
+			continue
+		}
+
+		if _, err := messages.DeleteOne(ctx, bson.M{"_id": msg.ID}); err != nil {
+			return err
+		}
+		if err := s.indexer.Delete(ctx, msg.ID.Hex()); err != nil {
+			log.Printf("Failed to remove message %s from search index: %v", msg.ID.Hex(), err)
+		}
+		removed = append(removed, msg.ID)
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	if len(removed) > 0 {
+		if _, err := s.db.DB.Collection("message_queue").DeleteMany(ctx, bson.M{"message_id": bson.M{"$in": removed}}); err != nil {
+			return err
+		}
+	}
+
+	_, err = messages.UpdateMany(
+		ctx,
+		bson.M{"$or": []bson.M{{"delivery_status.user_id": uid}, {"deleted_for": uid}}},
+		bson.M{"$pull": bson.M{
+			"delivery_status": bson.M{"user_id": uid},
+			"deleted_for":     uid,
+		}},
+	)
+	return err
+}
+
+// purgeConversations takes the user out of every conversation. Direct
+// conversations are left with only the other participant, whose history
+// no longer holds anything the user sent.
+func (s *Service) purgeConversations(ctx context.Context, uid primitive.ObjectID) error {
+	conversations := s.db.DB.Collection("conversations")
+
+	// Outside groups the user's messages are gone, so their content mustn't
+	// linger in the conversation list either
+	_, err := conversations.UpdateMany(
+		ctx,
+		bson.M{"last_message.sender_id": uid, "type": bson.M{"$ne": "group"}},
+		bson.M{"$unset": bson.M{"last_message": ""}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = conversations.UpdateMany(
+		ctx,
+		bson.M{"last_message.sender_id": uid},
+		bson.M{"$set": bson.M{"last_message.sender_id": models.DeletedUserID}},
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = conversations.UpdateMany(
+		ctx,
+		bson.M{"participants": uid},
+		bson.M{
+			"$pull": bson.M{"participants": uid, "admins": uid},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+	)
+	return err
+}
+
+// purgeMedia deletes the user's uploads unless a remaining message, such as
+// an anonymized group message or a forward, still points at them
+func (s *Service) purgeMedia(ctx context.Context, uid primitive.ObjectID) error {
+	media := s.db.DB.Collection("media")
+	cursor, err := media.Find(ctx, bson.M{"owner_id": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var file models.MediaFile
+		if err := cursor.Decode(&file); err != nil {
+			return err
+		}
+
+		count, err := s.db.DB.Collection("messages").CountDocuments(ctx, bson.M{"media.id": file.ID.Hex()})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		for _, key := range []string{file.StorageKey, file.ThumbnailKey} {
+			if key == "" {
+				continue
+			}
+			if err := s.store.Delete(ctx, key); err != nil {
+				log.Printf("Failed to delete blob %s: %v", key, err)
+			}
+		}
+		if _, err := media.DeleteOne(ctx, bson.M{"_id": file.ID}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// purgeExports deletes matching exports along with their archives
+func (s *Service) purgeExports(ctx context.Context, filter bson.M) error {
+	exports := s.db.DB.Collection("data_exports")
+	cursor, err := exports.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var export models.DataExport
+		if err := cursor.Decode(&export); err != nil {
+			return err
+		}
+		if export.StorageKey != "" {
+			if err := s.store.Delete(ctx, export.StorageKey); err != nil {
+				log.Printf("Failed to delete export archive %s: %v", export.StorageKey, err)
+			}
+		}
+		if _, err := exports.DeleteOne(ctx, bson.M{"_id": export.ID}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// DeleteExpiredExports removes archives past their download window
+func (s *Service) DeleteExpiredExports(ctx context.Context) error {
+	return s.purgeExports(ctx, bson.M{"expires_at": bson.M{"$lte": time.Now()}})
+}
+
+func containsID(ids []interface{}, id primitive.ObjectID) bool {
+	for _, v := range ids {
+		if oid, ok := v.(primitive.ObjectID); ok && oid == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package account
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/search"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrExportNotFound    = errors.New("export not found")
+	ErrExportNotReady    = errors.New("export is not ready yet")
+	ErrDeletionScheduled = errors.New("account deletion is already scheduled")
+	ErrNoDeletionPending = errors.New("account deletion is not scheduled")
+	ErrWrongPassword     = errors.New("password is incorrect")
+	ErrUserNotFound      = errors.New("user not found")
+)
+
+type Service struct {
+	db          *database.Database
+	store       storage.BlobStore
+	indexer     search.Indexer
+	gracePeriod time.Duration
+	exportTTL   time.Duration
+	reservation time.Duration
+	queue       chan primitive.ObjectID
+}
+
+func NewService(db *database.Database, store storage.BlobStore, indexer search.Indexer, cfg *config.Config) *Service {
+	return &Service{
+		db:          db,
+		store:       store,
+		indexer:     indexer,
+		gracePeriod: cfg.DeletionGracePeriod,
+		exportTTL:   cfg.DataExportTTL,
+		reservation: cfg.UsernameReservation,
+		queue:       make(chan primitive.ObjectID, 16),
+	}
+}
+
+// RequestExport queues an archive of the user's data. While one export is
+// still being built, asking again returns it instead of starting another.
+func (s *Service) RequestExport(ctx context.Context, userID string) (*models.DataExport, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	exports := s.db.DB.Collection("data_exports")
+	var active models.DataExport
+	err = exports.FindOne(ctx, bson.M{
+		"user_id": user.ID,
+		"status":  bson.M{"$in": []string{"pending", "processing"}},
+	}).Decode(&active)
+	if err == nil {
+		return &active, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	export := &models.DataExport{
+		UserID:    user.ID,
+		Status:    "pending",
+		CreatedAt: time.Now(),
+	}
+	result, err := exports.InsertOne(ctx, export)
+	if err != nil {
+		return nil, err
+	}
+	export.ID = result.InsertedID.(primitive.ObjectID)
+
+	s.enqueue(export.ID)
+	return export, nil
+}
+
+// enqueue hands an export to the processor. A full queue is fine: the
+// processor picks up pending exports when it next scans for them.
+func (s *Service) enqueue(id primitive.ObjectID) {
+	select {
+	case s.queue <- id:
+	default:
+		log.Printf("Export queue full, export %s will be picked up later", id.Hex())
+	}
+}
+
+// ListExports returns the user's exports, newest first
+func (s *Service) ListExports(ctx context.Context, userID string) ([]*models.DataExport, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	cursor, err := s.db.DB.Collection("data_exports").Find(
+		ctx,
+		bson.M{"user_id": uid},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	exports := []*models.DataExport{}
+	if err := cursor.All(ctx, &exports); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+// OpenExport opens a finished archive for download by its owner
+func (s *Service) OpenExport(ctx context.Context, userID, exportID string) (*models.DataExport, io.ReadCloser, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, nil, ErrExportNotFound
+	}
+	id, err := primitive.ObjectIDFromHex(exportID)
+	if err != nil {
+		return nil, nil, ErrExportNotFound
+	}
+
+	var export models.DataExport
+	err = s.db.DB.Collection("data_exports").FindOne(ctx, bson.M{"_id": id, "user_id": uid}).Decode(&export)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if export.Status != "ready" {
+		return nil, nil, ErrExportNotReady
+	}
+
+	reader, err := s.store.Get(ctx, export.StorageKey, 0, -1)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil, ErrExportNotFound
+		}
+		return nil, nil, err
+	}
+	return &export, reader, nil
+}
+
+// ScheduleDeletion marks the account for deletion once the grace period
+// has passed. Users with a password must confirm it.
+func (s *Service) ScheduleDeletion(ctx context.Context, userID, password string) (time.Time, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if user.DeleteAfter != nil {
+		return time.Time{}, ErrDeletionScheduled
+	}
+	if user.PasswordHash != "" {
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+			return time.Time{}, ErrWrongPassword
+		}
+	}
+
+	deleteAfter := time.Now().Add(s.gracePeriod)
+	result, err := s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": user.ID, "delete_after": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"delete_after": deleteAfter, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if result.MatchedCount == 0 {
+		return time.Time{}, ErrDeletionScheduled
+	}
+
+	return deleteAfter, nil
+}
+
+// CancelDeletion keeps an account whose deletion is still pending
+func (s *Service) CancelDeletion(ctx context.Context, userID string) error {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	result, err := s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": uid, "delete_after": bson.M{"$gt": time.Now()}},
+		bson.M{
+			"$unset": bson.M{"delete_after": ""},
+			"$set":   bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNoDeletionPending
+	}
+	return nil
+}
+
+func (s *Service) findUser(ctx context.Context, userID string) (*models.User, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	var user models.User
+	err = s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": uid}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
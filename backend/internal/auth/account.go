@@ -0,0 +1,423 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/mailer"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrInvalidAccountToken  = errors.New("invalid or expired token")
+	ErrEmailAlreadyVerified = errors.New("email is already verified")
+	ErrNoEmail              = errors.New("account has no email address")
+	ErrWrongPassword        = errors.New("current password is incorrect")
+)
+
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+	purposeChangeEmail   = "change_email"
+)
+
+// SendVerificationEmail emails the user a link that confirms they own their
+// address. Earlier links stop working.
+func (s *Service) SendVerificationEmail(ctx context.Context, userID string) error {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == "" {
+		return ErrNoEmail
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+
+	return s.sendVerification(ctx, user)
+}
+
+func (s *Service) sendVerification(ctx context.Context, user *models.User) error {
+	token, err := s.issueAccountToken(ctx, user, purposeVerifyEmail, s.cfg.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(&mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nConfirm your email address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s. If you didn't create an account, ignore this email.\n",
+			user.Username, s.link("/verify-email", token), s.cfg.EmailVerificationTTL),
+	})
+	return nil
+}
+
+// VerifyEmail marks the address a verification token was sent to as
+// verified, provided it is still the user's address
+func (s *Service) VerifyEmail(ctx context.Context, token string) error {
+	accountToken, err := s.consumeAccountToken(ctx, token, purposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": accountToken.UserID, "email": accountToken.Email},
+		bson.M{"$set": bson.M{"email_verified": true, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrInvalidAccountToken
+	}
+
+	return nil
+}
+
+// ChangeEmail starts moving an account to a new address. Nothing changes
+// until the link sent to the new address is opened, and the old address is
+// told about the request.
+func (s *Service) ChangeEmail(ctx context.Context, userID, password, email string) error {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return ErrWrongPassword
+	}
+
+	email = validation.NormalizeEmail(email)
+	if err := validation.Email(email); err != nil {
+		return validation.Errors{"email": err.Error()}
+	}
+	if email == user.Email {
+		return validation.Errors{"email": "this is already your email address"}
+	}
+	taken, err := s.db.DB.Collection("users").CountDocuments(ctx, bson.M{"email": email})
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return validation.Errors{"email": "email address is already in use"}
+	}
+
+	// The token carries the new address until it is confirmed
+	pending := *user
+	pending.Email = email
+	token, err := s.issueAccountToken(ctx, &pending, purposeChangeEmail, s.cfg.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	s.sendMail(&mailer.Message{
+		To:      email,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Hi %s,\n\nTo use this address for your account, open this link:\n\n%s\n\n"+
+			"The link expires in %s. If you didn't ask for this, ignore this email.\n",
+			user.Username, s.link("/confirm-email", token), s.cfg.EmailVerificationTTL),
+	})
+	if user.Email != "" {
+		s.sendMail(&mailer.Message{
+			To:      user.Email,
+			Subject: "Your email address is being changed",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to change the email address of your account to %s. "+
+				"It changes once the link sent there is opened. If it wasn't you, change your password.\n",
+				user.Username, email),
+		})
+	}
+	return nil
+}
+
+// ConfirmEmailChange moves the account to the address the token was sent
+// to. Opening the link proves the user controls it, so it is verified.
+func (s *Service) ConfirmEmailChange(ctx context.Context, token string) error {
+	accountToken, err := s.consumeAccountToken(ctx, token, purposeChangeEmail)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": accountToken.UserID},
+		bson.M{"$set": bson.M{
+			"email":          accountToken.Email,
+			"email_verified": true,
+			"updated_at":     time.Now(),
+		}},
+	)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return validation.Errors{"email": "email address is already in use"}
+		}
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrInvalidAccountToken
+	}
+
+	// Links sent to the old address no longer match the account, but
+	// don't leave them lying around
+	_, _ = s.db.DB.Collection("account_tokens").DeleteMany(ctx, bson.M{
+		"user_id": accountToken.UserID,
+		"purpose": bson.M{"$in": []string{purposeVerifyEmail, purposeResetPassword}},
+	})
+	return nil
+}
+
+// RequestPasswordReset emails a reset link if an account uses the address.
+// It reports success either way so callers can't probe for accounts.
+func (s *Service) RequestPasswordReset(ctx context.Context, email string) error {
+	email = validation.NormalizeEmail(email)
+	if email == "" {
+		return errors.New("email is required")
+	}
+
+	var user models.User
+	err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to look up account for password reset: %v", err)
+		return nil
+	}
+
+	token, err := s.issueAccountToken(ctx, &user, purposeResetPassword, s.cfg.PasswordResetTTL)
+	if err != nil {
+		log.Printf("Failed to issue password reset token: %v", err)
+		return nil
+	}
+
+	s.sendMail(&mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. "+
+			"To choose a new password, open this link:\n\n%s\n\n"+
+			"The link expires in %s. If it wasn't you, ignore this email; your password hasn't changed.\n",
+			user.Username, s.link("/reset-password", token), s.cfg.PasswordResetTTL),
+	})
+	return nil
+}
+
+// ResetPassword sets a new password with a reset token and signs the user
+// out everywhere. It returns the revoked sessions so their connections can
+// be closed.
+func (s *Service) ResetPassword(ctx context.Context, token, password string) ([]string, error) {
+	// Check the password before using up the token, so the user can pick
+	// another one with the same link
+	pending, err := s.findAccountToken(ctx, token, purposeResetPassword)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	err = s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": pending.UserID, "email": pending.Email}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidAccountToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.passwords.Check(password, user.Username, user.Email); err != nil {
+		return nil, validation.Errors{"password": err.Error()}
+	}
+
+	accountToken, err := s.consumeAccountToken(ctx, token, purposeResetPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	// Following the link proves the user controls the address too
+	result, err := s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": accountToken.UserID, "email": accountToken.Email},
+		bson.M{"$set": bson.M{
+			"password_hash":  string(hash),
+			"email_verified": true,
+			"updated_at":     time.Now(),
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrInvalidAccountToken
+	}
+
+	return s.revokeOtherSessions(ctx, accountToken.UserID, "", "password_reset")
+}
+
+// ChangePassword replaces the password of a signed-in user. Every session
+// except the one making the change is revoked and returned.
+func (s *Service) ChangePassword(ctx context.Context, userID, sessionID, current, password string) ([]string, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(current)); err != nil {
+		return nil, ErrWrongPassword
+	}
+	if err := s.passwords.Check(password, user.Username, user.Email); err != nil {
+		return nil, validation.Errors{"new_password": err.Error()}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"password_hash": string(hash), "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// An outstanding reset link would let someone undo the change
+	_, _ = s.db.DB.Collection("account_tokens").DeleteMany(ctx, bson.M{"user_id": user.ID, "purpose": purposeResetPassword})
+
+	return s.revokeOtherSessions(ctx, user.ID, sessionID, "password_change")
+}
+
+// revokeOtherSessions revokes every active session of a user except keep
+// and returns the IDs of those it revoked
+func (s *Service) revokeOtherSessions(ctx context.Context, userID primitive.ObjectID, keep, reason string) ([]string, error) {
+	filter := bson.M{"user_id": userID, "revoked_at": nil}
+	if keepID, err := primitive.ObjectIDFromHex(keep); err == nil {
+		filter["_id"] = bson.M{"$ne": keepID}
+	}
+
+	sessions := s.db.DB.Collection("sessions")
+	ids, err := sessions.Distinct(ctx, "_id", filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	_, err = sessions.UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoked_reason": reason}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			revoked = append(revoked, oid.Hex())
+		}
+	}
+	return revoked, nil
+}
+
+// issueAccountToken replaces any outstanding token of the same purpose, so
+// only the most recent email works
+func (s *Service) issueAccountToken(ctx context.Context, user *models.User, purpose string, ttl time.Duration) (string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	tokens := s.db.DB.Collection("account_tokens")
+	if _, err := tokens.DeleteMany(ctx, bson.M{"user_id": user.ID, "purpose": purpose}); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = tokens.InsertOne(ctx, &models.AccountToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: hash,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeAccountToken deletes a token as it is used, so it works only once
+func (s *Service) consumeAccountToken(ctx context.Context, token, purpose string) (*models.AccountToken, error) {
+	if token == "" {
+		return nil, ErrInvalidAccountToken
+	}
+
+	var accountToken models.AccountToken
+	err := s.db.DB.Collection("account_tokens").FindOneAndDelete(ctx, accountTokenFilter(token, purpose)).Decode(&accountToken)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidAccountToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &accountToken, nil
+}
+
+// findAccountToken returns a valid token without using it up
+func (s *Service) findAccountToken(ctx context.Context, token, purpose string) (*models.AccountToken, error) {
+	if token == "" {
+		return nil, ErrInvalidAccountToken
+	}
+
+	var accountToken models.AccountToken
+	err := s.db.DB.Collection("account_tokens").FindOne(ctx, accountTokenFilter(token, purpose)).Decode(&accountToken)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrInvalidAccountToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &accountToken, nil
+}
+
+func accountTokenFilter(token, purpose string) bson.M {
+	return bson.M{
+		"token_hash": hashToken(token),
+		"purpose":    purpose,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+}
+
+// sendMail delivers in the background. Besides not holding up the request,
+// this keeps a slow mail server from revealing that an account exists.
+func (s *Service) sendMail(msg *mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := s.mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send %q email: %v", msg.Subject, err)
+		}
+	}()
+}
+
+func (s *Service) link(path, token string) string {
+	return s.cfg.AppURL + path + "?token=" + url.QueryEscape(token)
+}
@@ -1,15 +1,30 @@
 package auth
 
 import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
 	"github.com/gofiber/fiber/v2"
 )
 
 type Handler struct {
-	service *Service
+	service  *Service
+	sessions SessionCloser
+}
+
+// SessionCloser disconnects the live connections of a revoked session
+type SessionCloser interface {
+	CloseSession(sessionID string)
 }
 
-func NewHandler(service *Service) *Handler {
-	return &Handler{service: service}
+func NewHandler(service *Service, sessions SessionCloser) *Handler {
+	return &Handler{service: service, sessions: sessions}
 }
 
 func (h *Handler) Register(c *fiber.Ctx) error {
@@ -20,11 +35,13 @@ func (h *Handler) Register(c *fiber.Ctx) error {
 		})
 	}
 
-	resp, err := h.service.Register(c.Context(), &req)
+	resp, err := h.service.Register(c.Context(), &req, deviceFrom(c))
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		status := fiber.StatusInternalServerError
+		if fields := fieldErrors(err); fields != nil {
+			status = fiber.StatusBadRequest
+		}
+		return c.Status(status).JSON(errorBody(err))
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(resp)
@@ -38,7 +55,394 @@ func (h *Handler) Login(c *fiber.Ctx) error {
 		})
 	}
 
-	resp, err := h.service.Login(c.Context(), &req)
+	defer h.uniformTiming(time.Now())
+
+	resp, challenge, err := h.service.Login(c.Context(), &req, deviceFrom(c))
+	if err != nil {
+		var throttled *ThrottleError
+		if errors.As(err, &throttled) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(throttled.RetryAfter.Seconds())))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if challenge != nil {
+		return c.JSON(challenge)
+	}
+
+	return c.JSON(resp)
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh rotates a refresh token and issues a new access token
+func (h *Handler) Refresh(c *fiber.Ctx) error {
+	var req RefreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	resp, err := h.service.Refresh(c.Context(), req.RefreshToken, deviceFrom(c))
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(resp)
+}
+
+func (h *Handler) Logout(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	if err := h.service.Logout(c.Context(), userID, sessionID); err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	h.sessions.CloseSession(sessionID)
+
+	return c.JSON(fiber.Map{"message": "logged out successfully"})
+}
+
+func (h *Handler) GetSessions(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	sessions, err := h.service.ListSessions(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	for _, session := range sessions {
+		session.Current = session.ID.Hex() == sessionID
+	}
+
+	return c.JSON(sessions)
+}
+
+func (h *Handler) RevokeSession(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	sessionID := c.Params("id")
+	if err := h.service.RevokeSession(c.Context(), userID, sessionID); err != nil {
+		status := fiber.StatusInternalServerError
+		if errors.Is(err, ErrSessionNotFound) {
+			status = fiber.StatusNotFound
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	h.sessions.CloseSession(sessionID)
+
+	return c.JSON(fiber.Map{"message": "session revoked successfully"})
+}
+
+func deviceFrom(c *fiber.Ctx) Device {
+	return Device{
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		IP:        c.IP(),
+	}
+}
+
+// JWKS publishes the public keys access tokens are verified with. Retired
+// keys stay listed until they are removed, so cached copies keep working
+// across a rotation.
+func (h *Handler) JWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(h.service.keys.JWKS())
+}
+
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type ChangeEmailRequest struct {
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// uniformTiming holds a response until AuthMinResponseTime has passed
+// since start, so an unknown email answers as slowly as a known one. Use
+// it as `defer h.uniformTiming(time.Now())`.
+func (h *Handler) uniformTiming(start time.Time) {
+	if wait := h.service.cfg.AuthMinResponseTime - time.Since(start); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (h *Handler) VerifyEmail(c *fiber.Ctx) error {
+	defer h.uniformTiming(time.Now())
+
+	var req TokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.service.VerifyEmail(c.Context(), req.Token); err != nil {
+		return c.Status(accountErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{"message": "email verified successfully"})
+}
+
+func (h *Handler) ResendVerification(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := h.service.SendVerificationEmail(c.Context(), userID); err != nil {
+		return c.Status(accountErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"message": "verification email sent"})
+}
+
+func (h *Handler) ForgotPassword(c *fiber.Ctx) error {
+	defer h.uniformTiming(time.Now())
+
+	var req ForgotPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.service.RequestPasswordReset(c.Context(), req.Email); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "if an account uses this email, a reset link has been sent to it",
+	})
+}
+
+func (h *Handler) ResetPassword(c *fiber.Ctx) error {
+	defer h.uniformTiming(time.Now())
+
+	var req ResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	revoked, err := h.service.ResetPassword(c.Context(), req.Token, req.Password)
+	if err != nil {
+		return c.Status(accountErrorStatus(err)).JSON(errorBody(err))
+	}
+	h.closeSessions(revoked)
+
+	return c.JSON(fiber.Map{"message": "password reset successfully; sign in with the new password"})
+}
+
+func (h *Handler) ChangePassword(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	var req ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	revoked, err := h.service.ChangePassword(c.Context(), userID, sessionID, req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		return c.Status(accountErrorStatus(err)).JSON(errorBody(err))
+	}
+	h.closeSessions(revoked)
+
+	return c.JSON(fiber.Map{
+		"message":          "password changed successfully",
+		"revoked_sessions": len(revoked),
+	})
+}
+
+// ChangeEmail sends a confirmation link to the new address
+func (h *Handler) ChangeEmail(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req ChangeEmailRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.service.ChangeEmail(c.Context(), userID, req.Password, req.Email); err != nil {
+		return c.Status(accountErrorStatus(err)).JSON(errorBody(err))
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "confirmation email sent to the new address",
+	})
+}
+
+func (h *Handler) ConfirmEmailChange(c *fiber.Ctx) error {
+	defer h.uniformTiming(time.Now())
+
+	var req TokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.service.ConfirmEmailChange(c.Context(), req.Token); err != nil {
+		return c.Status(accountErrorStatus(err)).JSON(errorBody(err))
+	}
+
+	return c.JSON(fiber.Map{"message": "email address changed successfully"})
+}
+
+type ChangeUsernameRequest struct {
+	Username string `json:"username"`
+}
+
+// ChangeUsername renames the caller and returns a new access token for
+// their session
+func (h *Handler) ChangeUsername(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	var req ChangeUsernameRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	resp, err := h.service.ChangeUsername(c.Context(), userID, sessionID, req.Username)
+	if err != nil {
+		var cooldown *UsernameCooldownError
+		if errors.As(err, &cooldown) {
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(time.Until(cooldown.NextChangeAt).Seconds())+1))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":          err.Error(),
+				"next_change_at": cooldown.NextChangeAt,
+			})
+		}
+		status := fiber.StatusInternalServerError
+		if fieldErrors(err) != nil {
+			status = fiber.StatusBadRequest
+		}
+		return c.Status(status).JSON(errorBody(err))
+	}
+
+	return c.JSON(resp)
+}
+
+func (h *Handler) GetUsernameHistory(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	history, err := h.service.UsernameHistory(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(history)
+}
+
+func (h *Handler) closeSessions(sessionIDs []string) {
+	for _, sessionID := range sessionIDs {
+		h.sessions.CloseSession(sessionID)
+	}
+}
+
+// errorBody adds per-field messages to the usual error response when err
+// carries them
+func errorBody(err error) fiber.Map {
+	body := fiber.Map{"error": err.Error()}
+	if fields := fieldErrors(err); fields != nil {
+		body["fields"] = fields
+	}
+	return body
+}
+
+func fieldErrors(err error) validation.Errors {
+	var fields validation.Errors
+	if errors.As(err, &fields) {
+		return fields
+	}
+	return nil
+}
+
+func accountErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidAccountToken), errors.Is(err, ErrWrongPassword), errors.Is(err, ErrNoEmail),
+		fieldErrors(err) != nil:
+		// Not 401: a wrong current password doesn't mean the access token is bad
+		return fiber.StatusBadRequest
+	case errors.Is(err, ErrEmailAlreadyVerified):
+		return fiber.StatusConflict
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	DeviceName     string `json:"device_name"`
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// LoginTwoFactor completes a login that returned a 2FA challenge
+func (h *Handler) LoginTwoFactor(c *fiber.Ctx) error {
+	var req TwoFactorLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	device := deviceFrom(c)
+	device.Name = req.DeviceName
+	resp, err := h.service.CompleteLogin(c.Context(), req.ChallengeToken, req.Code, device)
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": err.Error(),
@@ -47,3 +451,239 @@ func (h *Handler) Login(c *fiber.Ctx) error {
 
 	return c.JSON(resp)
 }
+
+func (h *Handler) GetTwoFactor(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	status, err := h.service.TwoFactorStatus(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(status)
+}
+
+func (h *Handler) SetupTwoFactor(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	setup, err := h.service.SetupTwoFactor(c.Context(), userID)
+	if err != nil {
+		return c.Status(twoFactorErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(setup)
+}
+
+func (h *Handler) EnableTwoFactor(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req TwoFactorCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	codes, err := h.service.EnableTwoFactor(c.Context(), userID, req.Code)
+	if err != nil {
+		return c.Status(twoFactorErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":        "two-factor authentication enabled",
+		"recovery_codes": codes,
+	})
+}
+
+func (h *Handler) DisableTwoFactor(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req DisableTwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.service.DisableTwoFactor(c.Context(), userID, req.Password, req.Code); err != nil {
+		return c.Status(twoFactorErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{"message": "two-factor authentication disabled"})
+}
+
+func twoFactorErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidCode), errors.Is(err, ErrWrongPassword), errors.Is(err, ErrTwoFactorNotSetUp):
+		return fiber.StatusBadRequest
+	case errors.Is(err, ErrTwoFactorEnabled), errors.Is(err, ErrTwoFactorNotEnabled):
+		return fiber.StatusConflict
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+const oidcStateCookie = "oidc_state"
+
+type OIDCExchangeRequest struct {
+	Code       string `json:"code"`
+	DeviceName string `json:"device_name"`
+}
+
+func (h *Handler) OIDCProviders(c *fiber.Ctx) error {
+	return c.JSON(h.service.OIDCProviders())
+}
+
+// StartOIDC redirects the browser to the provider's login page
+func (h *Handler) StartOIDC(c *fiber.Ctx) error {
+	authURL, state, err := h.service.StartOIDC(c.Context(), c.Params("provider"))
+	if err != nil {
+		status := fiber.StatusBadGateway
+		if errors.Is(err, ErrUnknownProvider) {
+			status = fiber.StatusNotFound
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// The callback must come back to the browser that started the login
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oidc",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		Secure:   strings.HasPrefix(h.service.cfg.PublicURL, "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// OIDCCallback receives the provider's redirect and sends the browser on to
+// the frontend with a one-time code, or with an error
+func (h *Handler) OIDCCallback(c *fiber.Ctx) error {
+	state := c.Query("state")
+	cookie := c.Cookies(oidcStateCookie)
+	c.ClearCookie(oidcStateCookie)
+
+	fail := func(message string) error {
+		return c.Redirect(h.service.cfg.AppURL+"/login?error="+url.QueryEscape(message), fiber.StatusFound)
+	}
+
+	if providerError := c.Query("error"); providerError != "" {
+		return fail("login was cancelled or denied")
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(cookie)) != 1 {
+		return fail(ErrInvalidOIDCState.Error())
+	}
+
+	code, err := h.service.FinishOIDC(c.Context(), c.Params("provider"), state, c.Query("code"))
+	if err != nil {
+		if errors.Is(err, ErrUnverifiedEmailUse) || errors.Is(err, ErrInvalidOIDCState) {
+			return fail(err.Error())
+		}
+		log.Printf("OIDC login failed: %v", err)
+		return fail("login failed")
+	}
+
+	return c.Redirect(h.service.cfg.AppURL+"/auth/callback?code="+url.QueryEscape(code), fiber.StatusFound)
+}
+
+// OIDCExchange trades the callback's one-time code for tokens
+func (h *Handler) OIDCExchange(c *fiber.Ctx) error {
+	var req OIDCExchangeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	device := deviceFrom(c)
+	device.Name = req.DeviceName
+	resp, challenge, err := h.service.ExchangeOIDC(c.Context(), req.Code, device)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if challenge != nil {
+		return c.JSON(challenge)
+	}
+
+	return c.JSON(resp)
+}
+
+// RequireAdmin only lets users with the admin role through. It runs after
+// AuthMiddleware.
+func (h *Handler) RequireAdmin(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	isAdmin, err := h.service.IsAdmin(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !isAdmin {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "admin access required",
+		})
+	}
+
+	return c.Next()
+}
+
+type UnlockLoginRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+// UnlockLogin clears the failed-login counters of a username and/or IP
+func (h *Handler) UnlockLogin(c *fiber.Ctx) error {
+	var req UnlockLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	cleared, err := h.service.UnlockLogin(c.Context(), req.Username, req.IP)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	log.Printf("Admin %s unlocked login for username=%q ip=%q", c.Locals("username"), req.Username, req.IP)
+
+	return c.JSON(fiber.Map{
+		"cleared": cleared,
+	})
+}
+
+// GetAuthFailures lists recent failed sign-ins, filtered by ?username= or ?ip=
+func (h *Handler) GetAuthFailures(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 100)
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+
+	failures, err := h.service.ListAuthFailures(c.Context(), c.Query("username"), c.Query("ip"), int64(limit))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(failures)
+}
@@ -0,0 +1,535 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/jwtkeys"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrUnknownProvider    = errors.New("unknown login provider")
+	ErrInvalidOIDCState   = errors.New("login request expired or was not started here")
+	ErrInvalidIDToken     = errors.New("provider returned an invalid ID token")
+	ErrUnverifiedEmailUse = errors.New("an account already uses this email; sign in with your password and verify your email to link it")
+)
+
+const (
+	purposeOIDCExchange = "oidc_exchange"
+
+	oidcLoginTTL    = 10 * time.Minute
+	oidcExchangeTTL = time.Minute
+
+	// Unknown key IDs trigger a JWKS refetch, at most this often
+	jwksRefreshInterval = time.Minute
+	maxOIDCResponse     = 1 << 20
+)
+
+// OIDCProviderInfo is what clients need to offer a provider's login button
+type OIDCProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider caches an issuer's discovery document and signing keys
+type oidcProvider struct {
+	cfg    config.OIDCProvider
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+type idTokenClaims struct {
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"` // a bool, or "true" from some providers
+	PreferredUsername string      `json:"preferred_username"`
+	AuthorizedParty   string      `json:"azp"`
+	jwt.RegisteredClaims
+}
+
+func newOIDCProviders(providers []config.OIDCProvider) map[string]*oidcProvider {
+	client := &http.Client{Timeout: 10 * time.Second}
+	byName := make(map[string]*oidcProvider, len(providers))
+	for _, provider := range providers {
+		byName[provider.Name] = &oidcProvider{cfg: provider, client: client}
+	}
+	return byName
+}
+
+// OIDCProviders lists the configured login providers
+func (s *Service) OIDCProviders() []OIDCProviderInfo {
+	providers := []OIDCProviderInfo{}
+	for _, provider := range s.cfg.OIDCProviders {
+		providers = append(providers, OIDCProviderInfo{Name: provider.Name, DisplayName: provider.DisplayName})
+	}
+	return providers
+}
+
+// StartOIDC begins an authorization code flow with PKCE. It returns the
+// provider URL to send the browser to and the state, which the caller must
+// bind to the browser so the callback can't be replayed into another one.
+func (s *Service) StartOIDC(ctx context.Context, name string) (string, string, error) {
+	provider, ok := s.oidc[name]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+	discovery, err := provider.discover(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	state, stateHash, err := newToken()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, _, err := newToken()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, _, err := newToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	_, err = s.db.DB.Collection("oidc_logins").InsertOne(ctx, &models.OIDCLogin{
+		StateHash:    stateHash,
+		Provider:     name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcLoginTTL),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", provider.cfg.ClientID)
+	query.Set("redirect_uri", s.oidcRedirectURI(name))
+	query.Set("scope", strings.Join(provider.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + query.Encode(), state, nil
+}
+
+// FinishOIDC handles the provider's callback: it redeems the code, checks
+// the ID token and finds or creates the user. Rather than putting tokens
+// in a redirect URL, it returns a short-lived code the frontend trades for
+// them with ExchangeOIDC.
+func (s *Service) FinishOIDC(ctx context.Context, name, state, code string) (string, error) {
+	provider, ok := s.oidc[name]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
+
+	var login models.OIDCLogin
+	err := s.db.DB.Collection("oidc_logins").FindOneAndDelete(ctx, bson.M{
+		"state_hash": hashToken(state),
+		"provider":   name,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Decode(&login)
+	if err == mongo.ErrNoDocuments {
+		return "", ErrInvalidOIDCState
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rawIDToken, err := provider.redeem(ctx, code, login.CodeVerifier, s.oidcRedirectURI(name))
+	if err != nil {
+		return "", err
+	}
+	claims, err := provider.verify(ctx, rawIDToken, login.Nonce)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := s.userForIdentity(ctx, name, claims)
+	if err != nil {
+		return "", err
+	}
+
+	return s.issueAccountToken(ctx, user, purposeOIDCExchange, oidcExchangeTTL)
+}
+
+// ExchangeOIDC trades the code from FinishOIDC for tokens, or for a 2FA
+// challenge when the user has it enabled
+func (s *Service) ExchangeOIDC(ctx context.Context, code string, device Device) (*AuthResponse, *Challenge, error) {
+	accountToken, err := s.consumeAccountToken(ctx, code, purposeOIDCExchange)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user models.User
+	if err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": accountToken.UserID}).Decode(&user); err != nil {
+		return nil, nil, ErrInvalidAccountToken
+	}
+
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		challenge, err := s.issueChallenge(ctx, &user)
+		return nil, challenge, err
+	}
+
+	resp, err := s.startSession(ctx, &user, device)
+	return resp, nil, err
+}
+
+// userForIdentity returns the user linked to the provider account. An
+// unlinked account is linked to the user with the same email only when
+// both sides have verified it; otherwise whoever registered the address
+// first could take over the account. Failing that, a new user is created.
+func (s *Service) userForIdentity(ctx context.Context, provider string, claims *idTokenClaims) (*models.User, error) {
+	identities := s.db.DB.Collection("identities")
+	users := s.db.DB.Collection("users")
+
+	var identity models.Identity
+	err := identities.FindOne(ctx, bson.M{"provider": provider, "subject": claims.Subject}).Decode(&identity)
+	if err == nil {
+		var user models.User
+		if err := users.FindOne(ctx, bson.M{"_id": identity.UserID}).Decode(&user); err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	email := ""
+	if claims.emailVerified() {
+		email = validation.NormalizeEmail(claims.Email)
+	}
+
+	var user *models.User
+	if email != "" {
+		var existing models.User
+		err := users.FindOne(ctx, bson.M{"email": email}).Decode(&existing)
+		switch {
+		case err == nil && !existing.EmailVerified:
+			return nil, ErrUnverifiedEmailUse
+		case err == nil:
+			user = &existing
+		case err != mongo.ErrNoDocuments:
+			return nil, err
+		}
+	}
+
+	if user == nil {
+		if user, err = s.createOIDCUser(ctx, claims, email); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = identities.InsertOne(ctx, &models.Identity{
+		UserID:   user.ID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now(),
+	})
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+	if err != nil {
+		// A concurrent callback linked the account first; use its user
+		return s.userForIdentity(ctx, provider, claims)
+	}
+
+	return user, nil
+}
+
+var usernameUnsafe = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// createOIDCUser registers a user who signed in through a provider. They
+// have no password until they set one with a password reset.
+func (s *Service) createOIDCUser(ctx context.Context, claims *idTokenClaims, email string) (*models.User, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = strings.Trim(usernameUnsafe.ReplaceAllString(strings.ToLower(base), "_"), "_")
+	if len(base) > 20 {
+		base = base[:20]
+	}
+	if s.usernames.Check(base) != nil {
+		base = "user"
+	}
+
+	now := time.Now()
+	user := &models.User{
+		Email:         email,
+		EmailVerified: email != "",
+		Presence: models.Presence{
+			Status:   "offline",
+			LastSeen: now,
+		},
+		Settings: models.UserSettings{
+			ReadReceipts:    true,
+			LastSeenPrivacy: "everyone",
+		},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	// Try the provider's username first, then add digits until one is free
+	username := base
+	for attempt := 0; attempt < 5; attempt++ {
+		user.Username = username
+		user.UsernameLower = strings.ToLower(username)
+		reserved, err := s.usernameReserved(ctx, username, nil)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			username = fmt.Sprintf("%s_%04d", base, rand.Intn(10000))
+			continue
+		}
+		result, err := s.db.DB.Collection("users").InsertOne(ctx, user)
+		if err == nil {
+			user.ID = result.InsertedID.(primitive.ObjectID)
+			return user, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		if index := database.DuplicateKeyIndex(err); index != "username_1" && index != "username_lower_1" {
+			return nil, duplicateUserError(err)
+		}
+		username = fmt.Sprintf("%s_%04d", base, rand.Intn(10000))
+	}
+
+	return nil, errors.New("could not pick a free username")
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	if c.Email == "" {
+		return false
+	}
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	default:
+		return false
+	}
+}
+
+func (s *Service) oidcRedirectURI(name string) string {
+	return s.cfg.PublicURL + "/api/auth/oidc/" + name + "/callback"
+}
+
+// discover fetches and caches the issuer's OpenID configuration
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery for %s failed: %w", p.cfg.Name, err)
+	}
+	// Required by OpenID Connect Discovery, and what ID tokens are checked against
+	if strings.TrimSuffix(discovery.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery for %s returned issuer %q", p.cfg.Name, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery for %s is missing endpoints", p.cfg.Name)
+	}
+
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// redeem exchanges an authorization code for the ID token
+func (p *oidcProvider) redeem(ctx context.Context, code, verifier, redirectURI string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		log.Printf("OIDC token exchange with %s failed: %s %s", p.cfg.Name, resp.Status, tokens.Error)
+		return "", ErrInvalidIDToken
+	}
+
+	return tokens.IDToken, nil
+}
+
+// verify checks the ID token's signature, issuer, audience, expiry and nonce
+func (p *oidcProvider) verify(ctx context.Context, rawIDToken, nonce string) (*idTokenClaims, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			return p.key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		log.Printf("Rejected ID token from %s: %v", p.cfg.Name, err)
+		return nil, ErrInvalidIDToken
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, ErrInvalidIDToken
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return nil, ErrInvalidIDToken
+	}
+	if claims.Subject == "" {
+		return nil, ErrInvalidIDToken
+	}
+
+	return claims, nil
+}
+
+// key returns the issuer's signing key with the given ID, refetching the
+// key set when the ID is unknown in case the issuer rotated
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, jwtkeys.ErrUnknownKey
+	}
+
+	var set jwtkeys.JWKS
+	if err := p.getJSON(ctx, p.discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+	p.keys = map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.PublicKey(); err == nil {
+			p.keys[jwk.KeyID] = key
+		}
+	}
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, jwtkeys.ErrUnknownKey
+}
+
+// lookup finds a cached key; a token without a kid is accepted only when
+// the issuer publishes a single key
+func (p *oidcProvider) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(v)
+}
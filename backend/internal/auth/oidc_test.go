@@ -0,0 +1,533 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/jwtkeys"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+const (
+	testProvider = "test"
+	testClientID = "client-1"
+)
+
+// testIssuer is a minimal OpenID provider: discovery, a JWKS with one RSA
+// key, and a token endpoint that checks the PKCE verifier
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+
+	mu         sync.Mutex
+	issuer     string            // reported by discovery; the server URL when empty
+	challenges map[string]string // authorization code -> PKCE challenge
+	claims     jwt.MapClaims     // claims of the next ID token
+	verifiers  []string          // code_verifier of each token request
+	jwksHits   int
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key, kid: "key-1", challenges: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		issuer := iss.issuer
+		iss.mu.Unlock()
+		if issuer == "" {
+			issuer = iss.URL
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": iss.URL + "/authorize",
+			"token_endpoint":         iss.URL + "/token",
+			"jwks_uri":               iss.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		iss.jwksHits++
+		iss.mu.Unlock()
+		writeJSON(w, http.StatusOK, jwtkeys.JWKS{Keys: []jwtkeys.JWK{{
+			KeyType:   "RSA",
+			KeyID:     iss.kid,
+			Use:       "sig",
+			Algorithm: "RS256",
+			N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+			return
+		}
+		if r.Form.Get("client_id") != testClientID || r.Form.Get("redirect_uri") == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_client"})
+			return
+		}
+
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		verifier := r.Form.Get("code_verifier")
+		iss.verifiers = append(iss.verifiers, verifier)
+		challenge, ok := iss.challenges[r.Form.Get("code")]
+		if !ok || challenge != pkceChallenge(verifier) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"id_token": iss.sign(t, iss.claims, iss.kid, iss.key)})
+	})
+
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// validClaims returns claims the provider accepts for nonce
+func (iss *testIssuer) validClaims(nonce string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            iss.URL,
+		"aud":            testClientID,
+		"sub":            "subject-1",
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+	}
+}
+
+func (iss *testIssuer) sign(t *testing.T, claims jwt.MapClaims, kid string, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func newOIDCTestService(t *testing.T, issuer string, db *database.Database) *Service {
+	t.Helper()
+
+	usernames, err := validation.NewUsernameRules(3, 32, "a-zA-Z0-9_.", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		PublicURL: "http://api.test",
+		AppURL:    "http://app.test",
+		OIDCProviders: []config.OIDCProvider{{
+			Name:         testProvider,
+			Issuer:       issuer,
+			ClientID:     testClientID,
+			ClientSecret: "secret",
+			Scopes:       []string{"openid", "email"},
+		}},
+	}
+	return &Service{db: db, cfg: cfg, oidc: newOIDCProviders(cfg.OIDCProviders), usernames: usernames}
+}
+
+func mockDatabase(mt *mtest.T) *database.Database {
+	return &database.Database{Client: mt.Client, DB: mt.DB}
+}
+
+func TestOIDCDiscoveryAndKeys(t *testing.T) {
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	provider := newOIDCTestService(t, iss.URL, nil).oidc[testProvider]
+
+	discovery, err := provider.discover(ctx)
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if discovery.TokenEndpoint != iss.URL+"/token" || discovery.JWKSURI != iss.URL+"/jwks" {
+		t.Fatalf("unexpected discovery document: %+v", discovery)
+	}
+
+	if _, err := provider.key(ctx, iss.kid); err != nil {
+		t.Fatalf("key %q: %v", iss.kid, err)
+	}
+	// An unknown key ID doesn't refetch the set again right away
+	if _, err := provider.key(ctx, "unknown"); !errors.Is(err, jwtkeys.ErrUnknownKey) {
+		t.Fatalf("unknown key: got %v, want ErrUnknownKey", err)
+	}
+	if iss.jwksHits != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", iss.jwksHits)
+	}
+}
+
+func TestOIDCDiscoveryRejectsOtherIssuer(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.issuer = "https://evil.example.com"
+	provider := newOIDCTestService(t, iss.URL, nil).oidc[testProvider]
+
+	if _, err := provider.discover(context.Background()); err == nil {
+		t.Fatal("discovery accepted a document for another issuer")
+	}
+}
+
+func TestOIDCRedeemSendsPKCEVerifier(t *testing.T) {
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	iss.challenges["code-1"] = pkceChallenge("verifier-1")
+	iss.claims = iss.validClaims("nonce-1")
+	provider := newOIDCTestService(t, iss.URL, nil).oidc[testProvider]
+
+	token, err := provider.redeem(ctx, "code-1", "verifier-1", "http://api.test/callback")
+	if err != nil || token == "" {
+		t.Fatalf("redeem with the right verifier: %q, %v", token, err)
+	}
+
+	if _, err := provider.redeem(ctx, "code-1", "wrong-verifier", "http://api.test/callback"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("redeem with the wrong verifier: got %v, want ErrInvalidIDToken", err)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	iss := newTestIssuer(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := iss.validClaims("nonce-1")
+		for k, v := range changes {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		nonce string
+		ok    bool
+	}{
+		{"valid", func() string { return iss.sign(t, with(nil), iss.kid, iss.key) }, "nonce-1", true},
+		{"nonce mismatch", func() string { return iss.sign(t, with(nil), iss.kid, iss.key) }, "nonce-2", false},
+		{"missing nonce", func() string { return iss.sign(t, with(jwt.MapClaims{"nonce": nil}), iss.kid, iss.key) }, "nonce-1", false},
+		{"other issuer", func() string {
+			return iss.sign(t, with(jwt.MapClaims{"iss": "https://evil.example.com"}), iss.kid, iss.key)
+		}, "nonce-1", false},
+		{"other audience", func() string { return iss.sign(t, with(jwt.MapClaims{"aud": "client-2"}), iss.kid, iss.key) }, "nonce-1", false},
+		{"several audiences without azp", func() string {
+			return iss.sign(t, with(jwt.MapClaims{"aud": []string{testClientID, "client-2"}}), iss.kid, iss.key)
+		}, "nonce-1", false},
+		{"several audiences, azp for another client", func() string {
+			return iss.sign(t, with(jwt.MapClaims{"aud": []string{testClientID, "client-2"}, "azp": "client-2"}), iss.kid, iss.key)
+		}, "nonce-1", false},
+		{"several audiences, azp for us", func() string {
+			return iss.sign(t, with(jwt.MapClaims{"aud": []string{testClientID, "client-2"}, "azp": testClientID}), iss.kid, iss.key)
+		}, "nonce-1", true},
+		{"expired", func() string {
+			return iss.sign(t, with(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), iss.kid, iss.key)
+		}, "nonce-1", false},
+		{"no subject", func() string { return iss.sign(t, with(jwt.MapClaims{"sub": nil}), iss.kid, iss.key) }, "nonce-1", false},
+		{"unknown key", func() string { return iss.sign(t, with(nil), "key-2", otherKey) }, "nonce-1", false},
+		{"wrong key for kid", func() string { return iss.sign(t, with(nil), iss.kid, otherKey) }, "nonce-1", false},
+		{"HS256", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, with(nil))
+			token.Header["kid"] = iss.kid
+			signed, _ := token.SignedString([]byte("secret"))
+			return signed
+		}, "nonce-1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newOIDCTestService(t, iss.URL, nil).oidc[testProvider]
+
+			claims, err := provider.verify(context.Background(), tt.token(), tt.nonce)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				if claims.Subject != "subject-1" {
+					t.Fatalf("subject = %q", claims.Subject)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("got %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackChecksStateCookie(t *testing.T) {
+	iss := newTestIssuer(t)
+	h := NewHandler(newOIDCTestService(t, iss.URL, nil), nil)
+	app := fiber.New()
+	app.Get("/api/auth/oidc/:provider/callback", h.OIDCCallback)
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		want   string
+	}{
+		{"no cookie", "state=abc&code=x", "", ErrInvalidOIDCState.Error()},
+		{"cookie for another login", "state=abc&code=x", "def", ErrInvalidOIDCState.Error()},
+		{"no state", "code=x", "abc", ErrInvalidOIDCState.Error()},
+		{"provider error", "error=access_denied&state=abc", "abc", "login was cancelled or denied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/test/callback?"+tt.query, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			location, err := url.Parse(resp.Header.Get("Location"))
+			if err != nil || resp.StatusCode != fiber.StatusFound {
+				t.Fatalf("got %d to %q, want a redirect", resp.StatusCode, resp.Header.Get("Location"))
+			}
+			if location.Path != "/login" || location.Query().Get("error") != tt.want {
+				t.Fatalf("redirected to %s, want /login with error %q", location, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("code exchange with PKCE", func(mt *mtest.T) {
+		ctx := context.Background()
+		iss := newTestIssuer(t)
+		s := newOIDCTestService(t, iss.URL, mockDatabase(mt))
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+		authURL, state, err := s.StartOIDC(ctx, testProvider)
+		if err != nil {
+			mt.Fatalf("StartOIDC: %v", err)
+		}
+		login := insertedDocument(mt)
+
+		redirect, err := url.Parse(authURL)
+		if err != nil {
+			mt.Fatal(err)
+		}
+		query := redirect.Query()
+		if query.Get("state") != state || query.Get("code_challenge_method") != "S256" {
+			mt.Fatalf("authorization URL %s", authURL)
+		}
+		if query.Get("code_challenge") != pkceChallenge(login.Lookup("code_verifier").StringValue()) {
+			mt.Fatal("code challenge doesn't match the stored verifier")
+		}
+
+		// The provider redirects back with a code bound to the challenge
+		iss.challenges["code-1"] = query.Get("code_challenge")
+		iss.claims = iss.validClaims(query.Get("nonce"))
+
+		userID := primitive.NewObjectID()
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+				{Key: "state_hash", Value: hashToken(state)},
+				{Key: "provider", Value: testProvider},
+				{Key: "nonce", Value: login.Lookup("nonce").StringValue()},
+				{Key: "code_verifier", Value: login.Lookup("code_verifier").StringValue()},
+			}}),
+			mtest.CreateCursorResponse(0, "test.identities", mtest.FirstBatch, bson.D{
+				{Key: "user_id", Value: userID},
+				{Key: "provider", Value: testProvider},
+				{Key: "subject", Value: "subject-1"},
+			}),
+			mtest.CreateCursorResponse(0, "test.users", mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: userID},
+				{Key: "username", Value: "alice"},
+			}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}), // old exchange codes
+			mtest.CreateSuccessResponse(),                           // new exchange code
+		)
+
+		code, err := s.FinishOIDC(ctx, testProvider, state, "code-1")
+		if err != nil {
+			mt.Fatalf("FinishOIDC: %v", err)
+		}
+		if code == "" {
+			mt.Fatal("FinishOIDC returned no exchange code")
+		}
+		if len(iss.verifiers) != 1 || iss.verifiers[0] != login.Lookup("code_verifier").StringValue() {
+			mt.Fatalf("token endpoint got verifiers %q", iss.verifiers)
+		}
+	})
+
+	mt.Run("nonce mismatch", func(mt *mtest.T) {
+		iss := newTestIssuer(t)
+		s := newOIDCTestService(t, iss.URL, mockDatabase(mt))
+		iss.challenges["code-1"] = pkceChallenge("verifier-1")
+		iss.claims = iss.validClaims("someone-elses-nonce")
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: bson.D{
+			{Key: "provider", Value: testProvider},
+			{Key: "nonce", Value: "nonce-1"},
+			{Key: "code_verifier", Value: "verifier-1"},
+		}}))
+
+		if _, err := s.FinishOIDC(context.Background(), testProvider, "state-1", "code-1"); !errors.Is(err, ErrInvalidIDToken) {
+			mt.Fatalf("got %v, want ErrInvalidIDToken", err)
+		}
+	})
+
+	mt.Run("unknown state", func(mt *mtest.T) {
+		iss := newTestIssuer(t)
+		s := newOIDCTestService(t, iss.URL, mockDatabase(mt))
+
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil}))
+
+		if _, err := s.FinishOIDC(context.Background(), testProvider, "state-1", "code-1"); !errors.Is(err, ErrInvalidOIDCState) {
+			mt.Fatalf("got %v, want ErrInvalidOIDCState", err)
+		}
+		if len(iss.verifiers) != 0 {
+			mt.Fatal("redeemed a code without a matching login")
+		}
+	})
+}
+
+func TestOIDCLinksOnlyVerifiedEmails(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	claims := func(emailVerified interface{}) *idTokenClaims {
+		return &idTokenClaims{
+			Email:            "alice@example.com",
+			EmailVerified:    emailVerified,
+			RegisteredClaims: jwt.RegisteredClaims{Subject: "subject-1"},
+		}
+	}
+	noIdentity := mtest.CreateCursorResponse(0, "test.identities", mtest.FirstBatch)
+	existing := func(verified bool, id primitive.ObjectID) bson.D {
+		return bson.D{
+			{Key: "_id", Value: id},
+			{Key: "username", Value: "alice"},
+			{Key: "email", Value: "alice@example.com"},
+			{Key: "email_verified", Value: verified},
+		}
+	}
+
+	mt.Run("existing account with unverified email", func(mt *mtest.T) {
+		s := newOIDCTestService(t, "http://issuer.test", mockDatabase(mt))
+		mt.AddMockResponses(
+			noIdentity,
+			mtest.CreateCursorResponse(0, "test.users", mtest.FirstBatch, existing(false, primitive.NewObjectID())),
+		)
+
+		if _, err := s.userForIdentity(context.Background(), testProvider, claims(true)); !errors.Is(err, ErrUnverifiedEmailUse) {
+			mt.Fatalf("got %v, want ErrUnverifiedEmailUse", err)
+		}
+	})
+
+	mt.Run("verified on both sides", func(mt *mtest.T) {
+		s := newOIDCTestService(t, "http://issuer.test", mockDatabase(mt))
+		id := primitive.NewObjectID()
+		mt.AddMockResponses(
+			noIdentity,
+			mtest.CreateCursorResponse(0, "test.users", mtest.FirstBatch, existing(true, id)),
+			mtest.CreateSuccessResponse(),
+		)
+
+		user, err := s.userForIdentity(context.Background(), testProvider, claims("true"))
+		if err != nil {
+			mt.Fatalf("userForIdentity: %v", err)
+		}
+		if user.ID != id {
+			mt.Fatalf("signed in as %s, want the existing user %s", user.ID.Hex(), id.Hex())
+		}
+		if linked := insertedDocument(mt).Lookup("user_id").ObjectID(); linked != id {
+			mt.Fatalf("identity linked to %s, want %s", linked.Hex(), id.Hex())
+		}
+	})
+
+	mt.Run("provider didn't verify the email", func(mt *mtest.T) {
+		s := newOIDCTestService(t, "http://issuer.test", mockDatabase(mt))
+		mt.AddMockResponses(
+			noIdentity,
+			mtest.CreateCursorResponse(0, "test.username_reservations", mtest.FirstBatch),
+			mtest.CreateSuccessResponse(), // new user
+			mtest.CreateSuccessResponse(), // identity
+		)
+
+		user, err := s.userForIdentity(context.Background(), testProvider, claims(false))
+		if err != nil {
+			mt.Fatalf("userForIdentity: %v", err)
+		}
+		if user.Email != "" || user.EmailVerified {
+			mt.Fatalf("new user took the unverified email %q", user.Email)
+		}
+		for _, event := range mt.GetAllStartedEvents() {
+			if event.CommandName == "find" && event.Command.Lookup("find").StringValue() == "users" {
+				mt.Fatal("looked up an account by an unverified email")
+			}
+		}
+	})
+}
+
+// insertedDocument returns the document of the most recent insert
+func insertedDocument(mt *mtest.T) bson.Raw {
+	mt.Helper()
+
+	events := mt.GetAllStartedEvents()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].CommandName == "insert" {
+			docs, err := events[i].Command.Lookup("documents").Array().Values()
+			if err == nil && len(docs) > 0 {
+				return docs[0].Document()
+			}
+		}
+	}
+	mt.Fatal("no insert was sent")
+	return nil
+}
@@ -2,12 +2,16 @@ package auth
 
 import (
 	"context"
-	"errors"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/jwtkeys"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/mailer"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
 	"github.com/golang-jwt/jwt/v5"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,35 +20,78 @@ import (
 )
 
 type Service struct {
-	db  *database.Database
-	cfg *config.Config
+	db        *database.Database
+	cfg       *config.Config
+	keys      *jwtkeys.KeySet
+	mailer    mailer.Mailer
+	oidc      map[string]*oidcProvider
+	usernames *validation.UsernameRules
+	passwords validation.PasswordPolicy
 }
 
-func NewService(db *database.Database, cfg *config.Config) *Service {
-	return &Service{db: db, cfg: cfg}
+func NewService(db *database.Database, cfg *config.Config, keys *jwtkeys.KeySet, mail mailer.Mailer, usernames *validation.UsernameRules) *Service {
+	return &Service{
+		db:        db,
+		cfg:       cfg,
+		keys:      keys,
+		mailer:    mail,
+		oidc:      newOIDCProviders(cfg.OIDCProviders),
+		usernames: usernames,
+		passwords: validation.PasswordPolicy{
+			MinLength:  cfg.PasswordMinLength,
+			MinClasses: cfg.PasswordMinClasses,
+		},
+	}
 }
 
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	Phone    string `json:"phone"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Email      string `json:"email"`
+	Phone      string `json:"phone"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 
 type AuthResponse struct {
-	Token string       `json:"token"`
-	User  *models.User `json:"user"`
+	Token        string       `json:"token"`
+	RefreshToken string       `json:"refresh_token"`
+	ExpiresAt    time.Time    `json:"expires_at"`
+	SessionID    string       `json:"session_id"`
+	User         *models.User `json:"user"`
 }
 
-func (s *Service) Register(ctx context.Context, req *RegisterRequest) (*AuthResponse, error) {
-	// Validate input
-	if req.Username == "" || req.Password == "" {
-		return nil, errors.New("username and password are required")
+func (s *Service) Register(ctx context.Context, req *RegisterRequest, device Device) (*AuthResponse, error) {
+	// Validate input, reporting every bad field at once
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = validation.NormalizeEmail(req.Email)
+
+	errs := validation.Errors{}
+	errs.Add("username", s.usernames.Check(req.Username))
+	if req.Email != "" {
+		errs.Add("email", validation.Email(req.Email))
+	}
+	if req.Phone != "" {
+		phone, err := validation.NormalizePhone(req.Phone)
+		errs.Add("phone", err)
+		req.Phone = phone
+	}
+	errs.Add("password", s.passwords.Check(req.Password, req.Username, req.Email))
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+
+	reserved, err := s.usernameReserved(ctx, req.Username, nil)
+	if err != nil {
+		return nil, err
+	}
+	if reserved {
+		return nil, validation.Errors{"username": "username is already taken"}
 	}
 
 	// Hash password
@@ -55,10 +102,11 @@ func (s *Service) Register(ctx context.Context, req *RegisterRequest) (*AuthResp
 
 	// Create user
 	user := &models.User{
-		Username:     req.Username,
-		Email:        req.Email,
-		Phone:        req.Phone,
-		PasswordHash: string(hashedPassword),
+		Username:      req.Username,
+		UsernameLower: strings.ToLower(req.Username),
+		Email:         req.Email,
+		Phone:         req.Phone,
+		PasswordHash:  string(hashedPassword),
 		Presence: models.Presence{
 			Status:   "offline",
 			LastSeen: time.Now(),
@@ -74,46 +122,90 @@ func (s *Service) Register(ctx context.Context, req *RegisterRequest) (*AuthResp
 	result, err := s.db.DB.Collection("users").InsertOne(ctx, user)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
-			return nil, errors.New("username already exists")
+			return nil, duplicateUserError(err)
 		}
 		return nil, err
 	}
 
 	user.ID = result.InsertedID.(primitive.ObjectID)
 
-	// Generate token
-	token, err := s.generateToken(user)
-	if err != nil {
-		return nil, err
+	if user.Email != "" {
+		if err := s.sendVerification(ctx, user); err != nil {
+			log.Printf("Failed to send verification email: %v", err)
+		}
 	}
 
-	// Remove password hash from response
-	user.PasswordHash = ""
+	device.Name = req.DeviceName
+	return s.startSession(ctx, user, device)
+}
 
-	return &AuthResponse{
-		Token: token,
-		User:  user,
-	}, nil
+// duplicateUserError names the field that collided with an existing user
+func duplicateUserError(err error) error {
+	switch database.DuplicateKeyIndex(err) {
+	case "email_1":
+		return validation.Errors{"email": "email address is already in use"}
+	case "phone_1":
+		return validation.Errors{"phone": "phone number is already in use"}
+	default:
+		return validation.Errors{"username": "username is already taken"}
+	}
 }
 
-func (s *Service) Login(ctx context.Context, req *LoginRequest) (*AuthResponse, error) {
+// Login checks the password. Users with 2FA get a Challenge to complete
+// with CompleteLogin instead of tokens.
+func (s *Service) Login(ctx context.Context, req *LoginRequest, device Device) (*AuthResponse, *Challenge, error) {
+	// Throttled attempts are refused before the username is even looked up,
+	// so known and unknown accounts behave the same
+	keys := throttleKeys(req.Username, device.IP)
+	if err := s.checkThrottle(ctx, keys); err != nil {
+		s.auditFailure(ctx, req.Username, nil, device, "throttled")
+		return nil, nil, err
+	}
+
 	// Find user
 	var user models.User
-	err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"username": req.Username}).Decode(&user)
+	err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"username_lower": strings.ToLower(strings.TrimSpace(req.Username))}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
-			return nil, errors.New("invalid username or password")
+			_ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+			s.recordFailure(ctx, keys)
+			s.auditFailure(ctx, req.Username, nil, device, "unknown_user")
+			return nil, nil, ErrInvalidCredentials
 		}
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Check password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		return nil, errors.New("invalid username or password")
+		s.recordFailure(ctx, keys)
+		s.auditFailure(ctx, req.Username, &user.ID, device, "invalid_password")
+		return nil, nil, ErrInvalidCredentials
+	}
+	s.clearAccountFailures(ctx, req.Username)
+
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		challenge, err := s.issueChallenge(ctx, &user)
+		return nil, challenge, err
 	}
 
-	// Generate token
-	token, err := s.generateToken(&user)
+	device.Name = req.DeviceName
+	resp, err := s.startSession(ctx, &user, device)
+	return resp, nil, err
+}
+
+// startSession opens a session for a user who just proved who they are
+func (s *Service) startSession(ctx context.Context, user *models.User, device Device) (*AuthResponse, error) {
+	session, refreshToken, err := s.createSession(ctx, user.ID, device)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.authResponse(user, session, refreshToken)
+}
+
+func (s *Service) authResponse(user *models.User, session *models.Session, refreshToken string) (*AuthResponse, error) {
+	expiresAt := time.Now().Add(s.cfg.JWTExpiry)
+	token, err := s.generateToken(user, session.ID.Hex(), expiresAt)
 	if err != nil {
 		return nil, err
 	}
@@ -122,19 +214,22 @@ func (s *Service) Login(ctx context.Context, req *LoginRequest) (*AuthResponse,
 	user.PasswordHash = ""
 
 	return &AuthResponse{
-		Token: token,
-		User:  &user,
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+		SessionID:    session.ID.Hex(),
+		User:         user,
 	}, nil
 }
 
-func (s *Service) generateToken(user *models.User) (string, error) {
+func (s *Service) generateToken(user *models.User, sessionID string, expiresAt time.Time) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":  user.ID.Hex(),
 		"username": user.Username,
-		"exp":      time.Now().Add(s.cfg.JWTExpiry).Unix(),
+		"sid":      sessionID,
+		"exp":      expiresAt.Unix(),
 		"iat":      time.Now().Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.cfg.JWTSecret))
+	return s.keys.Sign(claims)
 }
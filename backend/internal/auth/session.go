@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// Device describes the client a session was opened from
+type Device struct {
+	Name      string
+	UserAgent string
+	IP        string
+}
+
+// createSession opens a session for a fresh login and returns its first
+// refresh token. Each session is one token family: every refresh replaces
+// the token, and the replaced ones are remembered to detect reuse.
+func (s *Service) createSession(ctx context.Context, userID primitive.ObjectID, device Device) (*models.Session, string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		ID:               primitive.NewObjectID(),
+		UserID:           userID,
+		RefreshTokenHash: hash,
+		UsedTokenHashes:  []string{},
+		DeviceName:       device.Name,
+		UserAgent:        device.UserAgent,
+		IP:               device.IP,
+		CreatedAt:        now,
+		LastUsedAt:       now,
+		ExpiresAt:        now.Add(s.cfg.RefreshTokenExpiry),
+	}
+
+	if _, err := s.db.DB.Collection("sessions").InsertOne(ctx, session); err != nil {
+		return nil, "", err
+	}
+
+	return session, token, nil
+}
+
+// maxUsedTokenHashes caps how many replaced refresh tokens a session
+// remembers; reuse of an older one is only refused, not detected
+const maxUsedTokenHashes = 100
+
+// Refresh exchanges a refresh token for a new access and refresh token.
+// Presenting a token that was already exchanged means it leaked, or the
+// legitimate client and an attacker are racing; either way the whole
+// session is revoked so neither can continue.
+func (s *Service) Refresh(ctx context.Context, refreshToken string, device Device) (*AuthResponse, error) {
+	if refreshToken == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+	hash := hashToken(refreshToken)
+	sessions := s.db.DB.Collection("sessions")
+
+	next, nextHash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"refresh_token_hash": nextHash,
+			"last_used_at":       now,
+			"expires_at":         now.Add(s.cfg.RefreshTokenExpiry),
+			"user_agent":         device.UserAgent,
+			"ip":                 device.IP,
+		},
+		"$push": bson.M{"used_token_hashes": bson.M{"$each": []string{hash}, "$slice": -maxUsedTokenHashes}},
+	}
+
+	var session models.Session
+	err = sessions.FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"refresh_token_hash": hash,
+			"revoked_at":         nil,
+			"expires_at":         bson.M{"$gt": now},
+		},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		s.detectReuse(ctx, hash)
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	if err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": session.UserID}).Decode(&user); err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	return s.authResponse(&user, &session, next)
+}
+
+// detectReuse revokes the session a replaced refresh token belonged to
+func (s *Service) detectReuse(ctx context.Context, hash string) {
+	result, err := s.db.DB.Collection("sessions").UpdateOne(
+		ctx,
+		bson.M{"used_token_hashes": hash, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoked_reason": "refresh_token_reuse"}},
+	)
+	if err == nil && result.ModifiedCount > 0 {
+		log.Printf("Refresh token reuse detected; session revoked")
+	}
+}
+
+// Logout revokes the session the caller is signed in with
+func (s *Service) Logout(ctx context.Context, userID, sessionID string) error {
+	return s.revokeSession(ctx, userID, sessionID, "logout")
+}
+
+// ListSessions returns the user's active sessions, most recently used first
+func (s *Service) ListSessions(ctx context.Context, userID string) ([]*models.Session, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	cursor, err := s.db.DB.Collection("sessions").Find(
+		ctx,
+		bson.M{"user_id": uid, "revoked_at": nil, "expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "last_used_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	sessions := []*models.Session{}
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession ends one of the user's sessions; its refresh token stops
+// working immediately and its access tokens at their expiry
+func (s *Service) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	return s.revokeSession(ctx, userID, sessionID, "revoked")
+}
+
+func (s *Service) revokeSession(ctx context.Context, userID, sessionID, reason string) error {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return errors.New("invalid user ID")
+	}
+	sid, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	result, err := s.db.DB.Collection("sessions").UpdateOne(
+		ctx,
+		bson.M{"_id": sid, "user_id": uid, "revoked_at": nil},
+		bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoked_reason": reason}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+
+	return nil
+}
+
+// newToken returns a random token and the hash stored in its place
+func newToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,228 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Failed attempts an account gets before each further attempt has to wait
+const freeLoginAttempts = 3
+
+// ThrottleError rejects a login without checking the password. It looks the
+// same whether or not the username exists, so lockouts can't be used to
+// find accounts.
+type ThrottleError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	return "too many failed login attempts; try again later"
+}
+
+// dummyPasswordHash is compared against when the username doesn't exist,
+// so unknown users take as long to reject as wrong passwords
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// throttleKeys returns the counters a login attempt is tracked under. The
+// account counter is keyed by the name as typed, existing or not.
+func throttleKeys(username, ip string) []string {
+	keys := []string{"account:" + strings.ToLower(strings.TrimSpace(username))}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+// checkThrottle returns a ThrottleError if any counter is backing off or
+// locked
+func (s *Service) checkThrottle(ctx context.Context, keys []string) error {
+	cursor, err := s.db.DB.Collection("login_throttles").Find(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		// Fail open: a database problem shouldn't lock everyone out
+		log.Printf("Failed to read login throttles: %v", err)
+		return nil
+	}
+	defer cursor.Close(ctx)
+
+	var throttles []models.LoginThrottle
+	if err := cursor.All(ctx, &throttles); err != nil {
+		log.Printf("Failed to read login throttles: %v", err)
+		return nil
+	}
+
+	now := time.Now()
+	var wait time.Duration
+	for _, throttle := range throttles {
+		for _, until := range []*time.Time{throttle.LockedUntil, throttle.NextAttemptAt} {
+			if until != nil && until.After(now) && until.Sub(now) > wait {
+				wait = until.Sub(now)
+			}
+		}
+	}
+
+	if wait > 0 {
+		return &ThrottleError{RetryAfter: wait.Round(time.Second) + time.Second}
+	}
+	return nil
+}
+
+// recordFailure counts a failed attempt against each key. Accounts back off
+// exponentially after a few failures and lock after LoginMaxFailures; an IP
+// only locks, after LoginIPMaxFailures, since many users may share it.
+func (s *Service) recordFailure(ctx context.Context, keys []string) {
+	throttles := s.db.DB.Collection("login_throttles")
+	now := time.Now()
+
+	for _, key := range keys {
+		var throttle models.LoginThrottle
+		err := throttles.FindOneAndUpdate(
+			ctx,
+			bson.M{"_id": key},
+			bson.M{
+				"$inc": bson.M{"failures": 1},
+				"$set": bson.M{"last_failure_at": now, "expires_at": now.Add(s.cfg.LoginFailureWindow)},
+			},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+		).Decode(&throttle)
+		if err != nil {
+			log.Printf("Failed to record login failure: %v", err)
+			continue
+		}
+
+		set := bson.M{}
+		isAccount := strings.HasPrefix(key, "account:")
+		maxFailures := s.cfg.LoginIPMaxFailures
+		if isAccount {
+			maxFailures = s.cfg.LoginMaxFailures
+			if throttle.Failures >= freeLoginAttempts {
+				set["next_attempt_at"] = now.Add(s.backoff(throttle.Failures))
+			}
+		}
+		if throttle.Failures >= maxFailures {
+			lockedUntil := now.Add(s.cfg.LoginLockoutDuration)
+			set["locked_until"] = lockedUntil
+			// Remember the failures at least as long as the lock lasts
+			if lockedUntil.After(throttle.ExpiresAt) {
+				set["expires_at"] = lockedUntil
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+
+		if _, err := throttles.UpdateOne(ctx, bson.M{"_id": key}, bson.M{"$set": set}); err != nil {
+			log.Printf("Failed to update login throttle: %v", err)
+		}
+	}
+}
+
+// backoff doubles the wait with each failure past the free ones, capped at
+// the lockout duration
+func (s *Service) backoff(failures int) time.Duration {
+	wait := s.cfg.LoginBackoffBase
+	for i := freeLoginAttempts; i < failures && wait < s.cfg.LoginLockoutDuration; i++ {
+		wait *= 2
+	}
+	if wait > s.cfg.LoginLockoutDuration {
+		wait = s.cfg.LoginLockoutDuration
+	}
+	return wait
+}
+
+// clearAccountFailures resets an account's counter after a successful
+// login. The IP counter is left alone, or one valid account would let an
+// attacker keep guessing others from the same address.
+func (s *Service) clearAccountFailures(ctx context.Context, username string) {
+	key := throttleKeys(username, "")[0]
+	if _, err := s.db.DB.Collection("login_throttles").DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+		log.Printf("Failed to clear login throttle: %v", err)
+	}
+}
+
+// UnlockLogin clears the failure counters of a username, an IP, or both
+func (s *Service) UnlockLogin(ctx context.Context, username, ip string) (int64, error) {
+	var keys []string
+	if username != "" {
+		keys = append(keys, throttleKeys(username, "")[0])
+	}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	if len(keys) == 0 {
+		return 0, errors.New("username or ip is required")
+	}
+
+	result, err := s.db.DB.Collection("login_throttles").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+// auditFailure records a failed sign-in attempt
+func (s *Service) auditFailure(ctx context.Context, username string, userID *primitive.ObjectID, device Device, reason string) {
+	_, err := s.db.DB.Collection("auth_failures").InsertOne(ctx, &models.AuthFailure{
+		Username:  username,
+		UserID:    userID,
+		IP:        device.IP,
+		UserAgent: device.UserAgent,
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Failed to audit login failure: %v", err)
+	}
+}
+
+// ListAuthFailures returns recent failed sign-ins, newest first, optionally
+// filtered by username or IP
+func (s *Service) ListAuthFailures(ctx context.Context, username, ip string, limit int64) ([]*models.AuthFailure, error) {
+	filter := bson.M{}
+	if username != "" {
+		filter["username"] = username
+	}
+	if ip != "" {
+		filter["ip"] = ip
+	}
+
+	cursor, err := s.db.DB.Collection("auth_failures").Find(
+		ctx,
+		filter,
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	failures := []*models.AuthFailure{}
+	if err := cursor.All(ctx, &failures); err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// IsAdmin reports whether the user has the admin role
+func (s *Service) IsAdmin(ctx context.Context, userID string) (bool, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return false, nil
+	}
+
+	count, err := s.db.DB.Collection("users").CountDocuments(ctx, bson.M{"_id": uid, "role": models.RoleAdmin})
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
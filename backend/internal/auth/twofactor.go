@@ -0,0 +1,337 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/totp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotSetUp   = errors.New("start two-factor setup first")
+	ErrInvalidCode         = errors.New("invalid authentication code")
+	ErrInvalidChallenge    = errors.New("invalid or expired login challenge")
+)
+
+const (
+	purposeTwoFactorLogin = "two_factor_login"
+
+	// A challenge allows a few mistyped codes, not a search of the code space
+	challengeTTL         = 5 * time.Minute
+	maxChallengeAttempts = 5
+
+	recoveryCodeCount = 10
+	totpSkew          = 1 // accept the previous and next code for clock drift
+)
+
+// Challenge is returned by Login instead of tokens when the user has 2FA on.
+// The client completes the login by sending the token with a code.
+type Challenge struct {
+	TwoFactorRequired bool      `json:"two_factor_required"`
+	ChallengeToken    string    `json:"challenge_token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+type TwoFactorSetup struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type TwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// TwoFactorStatus reports whether the user has 2FA on
+func (s *Service) TwoFactorStatus(ctx context.Context, userID string) (*TwoFactorStatus, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &TwoFactorStatus{}
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		status.Enabled = true
+		status.RecoveryCodesRemaining = len(user.TwoFactor.RecoveryCodeHashes)
+	}
+	return status, nil
+}
+
+// SetupTwoFactor starts enrollment with a fresh secret. 2FA stays off until
+// the user proves their authenticator works with EnableTwoFactor.
+func (s *Service) SetupTwoFactor(ctx context.Context, userID string) (*TwoFactorSetup, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": user.ID},
+		bson.M{"$set": bson.M{"two_factor": &models.TwoFactor{PendingSecret: secret}, "updated_at": time.Now()}},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	account := user.Username
+	if user.Email != "" {
+		account = user.Email
+	}
+
+	return &TwoFactorSetup{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(s.cfg.TOTPIssuer, account, secret),
+	}, nil
+}
+
+// EnableTwoFactor turns 2FA on once the user enters a code from the pending
+// secret. It returns recovery codes, which are only ever shown this once.
+func (s *Service) EnableTwoFactor(ctx context.Context, userID, code string) ([]string, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TwoFactor == nil || user.TwoFactor.PendingSecret == "" {
+		return nil, ErrTwoFactorNotSetUp
+	}
+
+	step, ok := totp.Validate(user.TwoFactor.PendingSecret, normalizeCode(code), time.Now(), totpSkew)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result, err := s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": user.ID, "two_factor.pending_secret": user.TwoFactor.PendingSecret},
+		bson.M{"$set": bson.M{
+			"two_factor": &models.TwoFactor{
+				Enabled:            true,
+				Secret:             user.TwoFactor.PendingSecret,
+				RecoveryCodeHashes: hashes,
+				LastUsedStep:       step,
+				EnabledAt:          &now,
+			},
+			"updated_at": now,
+		}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, ErrTwoFactorNotSetUp
+	}
+
+	return codes, nil
+}
+
+// DisableTwoFactor turns 2FA off. The user re-authenticates with both
+// their password and a current or recovery code, so a hijacked session
+// alone can't remove the second factor.
+func (s *Service) DisableTwoFactor(ctx context.Context, userID, password, code string) error {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		return ErrTwoFactorNotEnabled
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return ErrWrongPassword
+	}
+	if err := s.checkSecondFactor(ctx, user, code); err != nil {
+		return err
+	}
+
+	_, err = s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": user.ID},
+		bson.M{
+			"$unset": bson.M{"two_factor": ""},
+			"$set":   bson.M{"updated_at": time.Now()},
+		},
+	)
+	return err
+}
+
+// issueChallenge records that the user passed the password step
+func (s *Service) issueChallenge(ctx context.Context, user *models.User) (*Challenge, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	challenge := &models.AccountToken{
+		UserID:    user.ID,
+		Purpose:   purposeTwoFactorLogin,
+		TokenHash: hash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(challengeTTL),
+	}
+	if _, err := s.db.DB.Collection("account_tokens").InsertOne(ctx, challenge); err != nil {
+		return nil, err
+	}
+
+	return &Challenge{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresAt:         challenge.ExpiresAt,
+	}, nil
+}
+
+// CompleteLogin finishes a two-step login with the challenge from Login and
+// a TOTP or recovery code
+func (s *Service) CompleteLogin(ctx context.Context, challengeToken, code string, device Device) (*AuthResponse, error) {
+	if challengeToken == "" {
+		return nil, ErrInvalidChallenge
+	}
+
+	tokens := s.db.DB.Collection("account_tokens")
+	filter := bson.M{
+		"token_hash": hashToken(challengeToken),
+		"purpose":    purposeTwoFactorLogin,
+		"expires_at": bson.M{"$gt": time.Now()},
+		"attempts":   bson.M{"$lt": maxChallengeAttempts},
+	}
+
+	var challenge models.AccountToken
+	if err := tokens.FindOne(ctx, filter).Decode(&challenge); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidChallenge
+		}
+		return nil, err
+	}
+
+	var user models.User
+	if err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": challenge.UserID}).Decode(&user); err != nil {
+		return nil, ErrInvalidChallenge
+	}
+
+	if err := s.checkSecondFactor(ctx, &user, code); err != nil {
+		_, _ = tokens.UpdateOne(ctx, bson.M{"_id": challenge.ID}, bson.M{"$inc": bson.M{"attempts": 1}})
+		if err == ErrInvalidCode {
+			// Count against the account too, or fresh challenges would allow
+			// unlimited guessing once the password is known
+			s.recordFailure(ctx, throttleKeys(user.Username, device.IP))
+			s.auditFailure(ctx, user.Username, &user.ID, device, "invalid_2fa_code")
+		}
+		return nil, err
+	}
+
+	// Delete rather than mark used, so a racing request can't reuse it
+	result, err := tokens.DeleteOne(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if result.DeletedCount == 0 {
+		return nil, ErrInvalidChallenge
+	}
+
+	return s.startSession(ctx, &user, device)
+}
+
+// checkSecondFactor accepts a TOTP code not used before, or an unused
+// recovery code, which is then spent
+func (s *Service) checkSecondFactor(ctx context.Context, user *models.User, code string) error {
+	if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+		return ErrTwoFactorNotEnabled
+	}
+	users := s.db.DB.Collection("users")
+	code = normalizeCode(code)
+
+	if step, ok := totp.Validate(user.TwoFactor.Secret, code, time.Now(), totpSkew); ok {
+		result, err := users.UpdateOne(
+			ctx,
+			bson.M{"_id": user.ID, "two_factor.last_used_step": bson.M{"$lt": step}},
+			bson.M{"$set": bson.M{"two_factor.last_used_step": step}},
+		)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	hash := hashToken(code)
+	result, err := users.UpdateOne(
+		ctx,
+		bson.M{"_id": user.ID, "two_factor.recovery_code_hashes": hash},
+		bson.M{"$pull": bson.M{"two_factor.recovery_code_hashes": hash}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (s *Service) findUser(ctx context.Context, userID string) (*models.User, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	var user models.User
+	if err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": uid}).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// newRecoveryCodes returns codes like "k7pqm-3xw2a" and their hashes. With
+// 50 random bits each, a fast hash is enough.
+func newRecoveryCodes() ([]string, []string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(encoding.EncodeToString(buf))[:10]
+		codes[i] = raw[:5] + "-" + raw[5:]
+		hashes[i] = hashToken(raw)
+	}
+	return codes, hashes, nil
+}
+
+// normalizeCode tolerates the spaces authenticator apps show and recovery
+// codes typed without the dash or in upper case
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(code)))
+}
@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UsernameCooldownError rejects a username change made too soon after the
+// last one
+type UsernameCooldownError struct {
+	NextChangeAt time.Time
+}
+
+func (e *UsernameCooldownError) Error() string {
+	return "username was changed recently; try again later"
+}
+
+// UsernameChangeResponse carries a fresh access token, since the caller's
+// current one still names the old username
+type UsernameChangeResponse struct {
+	User      *models.User `json:"user"`
+	Token     string       `json:"token"`
+	ExpiresAt time.Time    `json:"expires_at"`
+}
+
+// ChangeUsername renames a user. The old name stays reserved for them for
+// UsernameReservation, so they can take it back but nobody else can claim
+// it in the meantime. Other sessions pick up the new name on their next
+// refresh; tokens identify users by ID, so until then they keep working.
+func (s *Service) ChangeUsername(ctx context.Context, userID, sessionID, username string) (*UsernameChangeResponse, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	username = strings.TrimSpace(username)
+	if err := s.usernames.Check(username); err != nil {
+		return nil, validation.Errors{"username": err.Error()}
+	}
+	if username == user.Username {
+		return nil, validation.Errors{"username": "that is already your username"}
+	}
+
+	now := time.Now()
+	if user.UsernameChangedAt != nil {
+		if next := user.UsernameChangedAt.Add(s.cfg.UsernameCooldown); now.Before(next) {
+			return nil, &UsernameCooldownError{NextChangeAt: next}
+		}
+	}
+
+	oldLower := user.UsernameLower
+	newLower := strings.ToLower(username)
+	caseOnly := oldLower == newLower
+	if !caseOnly {
+		reserved, err := s.usernameReserved(ctx, username, user)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return nil, validation.Errors{"username": "username is already taken"}
+		}
+	}
+
+	// Match the old name and change time so concurrent changes can't both
+	// pass the cooldown check
+	filter := bson.M{"_id": user.ID, "username": user.Username}
+	if user.UsernameChangedAt != nil {
+		filter["username_changed_at"] = *user.UsernameChangedAt
+	} else {
+		filter["username_changed_at"] = bson.M{"$exists": false}
+	}
+
+	var updated models.User
+	err = s.db.DB.Collection("users").FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$set": bson.M{
+			"username":            username,
+			"username_lower":      newLower,
+			"username_changed_at": now,
+			"updated_at":          now,
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, validation.Errors{"username": "username is already taken"}
+		}
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.New("username was changed concurrently; try again")
+		}
+		return nil, err
+	}
+
+	if !caseOnly {
+		reservations := s.db.DB.Collection("username_reservations")
+		// Taking back an old name ends its reservation
+		if _, err := reservations.DeleteOne(ctx, bson.M{"_id": newLower, "user_id": user.ID}); err != nil {
+			return nil, err
+		}
+		_, err = reservations.ReplaceOne(
+			ctx,
+			bson.M{"_id": oldLower},
+			&models.UsernameReservation{
+				Username:   oldLower,
+				UserID:     user.ID,
+				ReleasedAt: now,
+				ExpiresAt:  now.Add(s.cfg.UsernameReservation),
+			},
+			options.Replace().SetUpsert(true),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = s.db.DB.Collection("username_history").InsertOne(ctx, &models.UsernameHistory{
+		UserID:      user.ID,
+		OldUsername: user.Username,
+		NewUsername: username,
+		ChangedAt:   now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := now.Add(s.cfg.JWTExpiry)
+	token, err := s.generateToken(&updated, sessionID, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	updated.PasswordHash = ""
+	return &UsernameChangeResponse{
+		User:      &updated,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// UsernameHistory lists a user's username changes, newest first
+func (s *Service) UsernameHistory(ctx context.Context, userID string) ([]*models.UsernameHistory, error) {
+	user, err := s.findUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := s.db.DB.Collection("username_history").Find(
+		ctx,
+		bson.M{"user_id": user.ID},
+		options.Find().SetSort(bson.D{{Key: "changed_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	history := []*models.UsernameHistory{}
+	if err := cursor.All(ctx, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// usernameReserved reports whether username was recently released by
+// someone other than user, who may be nil for a new account
+func (s *Service) usernameReserved(ctx context.Context, username string, user *models.User) (bool, error) {
+	filter := bson.M{
+		"_id":        strings.ToLower(username),
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+	if user != nil {
+		filter["user_id"] = bson.M{"$ne": user.ID}
+	}
+
+	count, err := s.db.DB.Collection("username_reservations").CountDocuments(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
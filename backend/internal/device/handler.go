@@ -0,0 +1,63 @@
+package device
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type Handler struct {
+	service     *Service
+	connections Disconnector
+}
+
+// Disconnector closes the live connections of a signed out device
+type Disconnector interface {
+	CloseSession(sessionID string)
+	CloseDevice(userID, deviceID string)
+}
+
+func NewHandler(service *Service, connections Disconnector) *Handler {
+	return &Handler{service: service, connections: connections}
+}
+
+func (h *Handler) List(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+
+	devices, err := h.service.List(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	for _, device := range devices {
+		device.Current = sessionID != "" && device.SessionID == sessionID
+	}
+
+	return c.JSON(devices)
+}
+
+// SignOut remotely signs a device out
+func (h *Handler) SignOut(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	device, err := h.service.SignOut(c.Context(), userID, c.Params("id"))
+	if err != nil {
+		status := fiber.StatusInternalServerError
+		if errors.Is(err, ErrDeviceNotFound) {
+			status = fiber.StatusNotFound
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if device.SessionID != "" {
+		h.connections.CloseSession(device.SessionID)
+	}
+	h.connections.CloseDevice(userID, device.DeviceID)
+
+	return c.JSON(fiber.Map{"message": "device signed out successfully"})
+}
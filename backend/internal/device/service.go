@@ -0,0 +1,195 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrDeviceNotFound = errors.New("device not found")
+
+var (
+	deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+	deviceTypes     = map[string]bool{"web": true, "desktop": true, "ios": true, "android": true}
+)
+
+const maxNameLength = 64
+
+// Info is what a client says about itself when it connects
+type Info struct {
+	DeviceID  string
+	Type      string
+	Name      string
+	UserAgent string
+	IP        string
+}
+
+type Service struct {
+	db *database.Database
+}
+
+func NewService(db *database.Database) *Service {
+	return &Service{db: db}
+}
+
+// Normalize fills in what a client left out or sent malformed. Clients that
+// don't send a device ID are identified by their session, so each login
+// still shows up as a device.
+func (info Info) Normalize(sessionID string) Info {
+	if !deviceIDPattern.MatchString(info.DeviceID) {
+		info.DeviceID = ""
+		if sessionID != "" {
+			info.DeviceID = "session-" + sessionID
+		}
+	}
+	info.Type = strings.ToLower(strings.TrimSpace(info.Type))
+	if !deviceTypes[info.Type] {
+		info.Type = "web"
+	}
+	info.Name = strings.TrimSpace(info.Name)
+	if runes := []rune(info.Name); len(runes) > maxNameLength {
+		info.Name = string(runes[:maxNameLength])
+	}
+	return info
+}
+
+// Register records a connection from a device, creating the device the
+// first time it is seen
+func (s *Service) Register(ctx context.Context, userID, sessionID string, info Info) (*models.Device, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+	if info.DeviceID == "" {
+		return nil, errors.New("device ID is required")
+	}
+
+	now := time.Now()
+	set := bson.M{
+		"type":         info.Type,
+		"session_id":   sessionID,
+		"user_agent":   info.UserAgent,
+		"ip":           info.IP,
+		"last_seen_at": now,
+	}
+	if info.Name != "" {
+		set["name"] = info.Name
+	}
+
+	var device models.Device
+	err = s.db.DB.Collection("devices").FindOneAndUpdate(
+		ctx,
+		bson.M{"user_id": uid, "device_id": info.DeviceID},
+		bson.M{
+			"$set":         set,
+			"$setOnInsert": bson.M{"created_at": now},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&device)
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// Touch records when a device was last connected
+func (s *Service) Touch(ctx context.Context, userID, deviceID string) error {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return errors.New("invalid user ID")
+	}
+
+	_, err = s.db.DB.Collection("devices").UpdateOne(
+		ctx,
+		bson.M{"user_id": uid, "device_id": deviceID},
+		bson.M{"$set": bson.M{"last_seen_at": time.Now()}},
+	)
+	return err
+}
+
+// List returns the user's devices, most recently seen first, marking those
+// with a live connection on any instance as online
+func (s *Service) List(ctx context.Context, userID string) ([]*models.Device, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	cursor, err := s.db.DB.Collection("devices").Find(
+		ctx,
+		bson.M{"user_id": uid},
+		options.Find().SetSort(bson.D{{Key: "last_seen_at", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	devices := []*models.Device{}
+	if err := cursor.All(ctx, &devices); err != nil {
+		return nil, err
+	}
+
+	online, err := s.db.DB.Collection("active_connections").Distinct(ctx, "device_id", bson.M{
+		"user_id":    uid,
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	connected := make(map[string]bool, len(online))
+	for _, id := range online {
+		if deviceID, ok := id.(string); ok {
+			connected[deviceID] = true
+		}
+	}
+	for _, device := range devices {
+		device.Online = connected[device.DeviceID]
+	}
+
+	return devices, nil
+}
+
+// SignOut removes a device and revokes the session it was using, so it has
+// to log in again. The caller closes its live connections.
+func (s *Service) SignOut(ctx context.Context, userID, id string) (*models.Device, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, ErrDeviceNotFound
+	}
+
+	var device models.Device
+	err = s.db.DB.Collection("devices").FindOneAndDelete(ctx, bson.M{"_id": oid, "user_id": uid}).Decode(&device)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrDeviceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sid, err := primitive.ObjectIDFromHex(device.SessionID); err == nil {
+		_, err = s.db.DB.Collection("sessions").UpdateOne(
+			ctx,
+			bson.M{"_id": sid, "user_id": uid, "revoked_at": nil},
+			bson.M{"$set": bson.M{"revoked_at": time.Now(), "revoked_reason": "device_signed_out"}},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &device, nil
+}
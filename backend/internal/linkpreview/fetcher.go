@@ -0,0 +1,165 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBlockedAddress = errors.New("address is not publicly routable")
+	ErrUnsupportedURL = errors.New("only http and https URLs can be previewed")
+)
+
+const maxRedirects = 5
+
+// Page is a fetched document, truncated to the fetcher's size limit
+type Page struct {
+	URL         *url.URL // after redirects
+	ContentType string
+	Body        []byte
+}
+
+// Fetcher retrieves the page behind a URL found in a message
+type Fetcher interface {
+	Fetch(ctx context.Context, rawURL string) (*Page, error)
+}
+
+// HTTPFetcher fetches pages over the internet. Every connection, including
+// those made for redirects, is checked after DNS resolution so a hostname
+// cannot point the server at itself or its private network.
+type HTTPFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+func NewHTTPFetcher(timeout time.Duration, maxBytes int64) *HTTPFetcher {
+	return newHTTPFetcher(timeout, maxBytes, nil, checkPublic)
+}
+
+// newHTTPFetcher resolves hostnames with resolver, or the default resolver
+// when nil, and dials only addresses that pass check
+func newHTTPFetcher(timeout time.Duration, maxBytes int64, resolver *net.Resolver, check func(netip.Addr) error) *HTTPFetcher {
+	dialer := &net.Dialer{
+		Timeout:  timeout,
+		Resolver: resolver,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return check(addrPort.Addr())
+		},
+	}
+
+	transport := &http.Transport{
+		// Never go through an environment proxy, which would bypass the check
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return ErrUnsupportedURL
+			}
+			return nil
+		},
+	}
+
+	return &HTTPFetcher{client: client, maxBytes: maxBytes}
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (*Page, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, ErrUnsupportedURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "MessagingPlatformBot/1.0 (link preview)")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,image/*;q=0.8")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	// Open Graph tags live in the head, so a truncated body is still useful
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Page{
+		URL:         resp.Request.URL,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        body,
+	}, nil
+}
+
+// blockedPrefixes are special-purpose ranges not covered by the netip
+// predicates used in checkPublic
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, may embed a private IPv4
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/32"),       // Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, may embed a private IPv4
+	netip.MustParsePrefix("fec0::/10"),       // deprecated site-local
+}
+
+// checkPublic rejects loopback, private, link-local and other addresses
+// that are not reachable on the public internet
+func checkPublic(addr netip.Addr) error {
+	// Judge IPv4-mapped IPv6 addresses by the IPv4 address they carry
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() {
+		return ErrBlockedAddress
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return ErrBlockedAddress
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func allowAll(netip.Addr) error { return nil }
+
+func TestFetchTruncatesBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<head><meta property="og:title" content="Big page"></head><body>`)
+		fmt.Fprint(w, strings.Repeat("x", 1<<20))
+	}))
+	defer srv.Close()
+
+	page, err := newHTTPFetcher(5*time.Second, 1024, nil, allowAll).Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if len(page.Body) != 1024 {
+		t.Fatalf("read %d bytes, want 1024", len(page.Body))
+	}
+	if preview := parse(page); preview == nil || preview.Title != "Big page" {
+		t.Fatalf("preview of a truncated page: %+v", preview)
+	}
+}
+
+func TestFetchRedirectLimit(t *testing.T) {
+	// /hops/n redirects n more times before serving the page
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+		if n > 0 {
+			http.Redirect(w, r, "/hops/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>Done</title>`)
+	}))
+	defer srv.Close()
+
+	fetcher := newHTTPFetcher(5*time.Second, 1024, nil, allowAll)
+	ctx := context.Background()
+
+	page, err := fetcher.Fetch(ctx, fmt.Sprintf("%s/hops/%d", srv.URL, maxRedirects))
+	if err != nil {
+		t.Fatalf("%d redirects: %v", maxRedirects, err)
+	}
+	if page.URL.Path != "/hops/0" {
+		t.Fatalf("ended at %s, want /hops/0", page.URL)
+	}
+
+	if _, err := fetcher.Fetch(ctx, fmt.Sprintf("%s/hops/%d", srv.URL, maxRedirects+1)); err == nil {
+		t.Fatalf("followed %d redirects", maxRedirects+1)
+	}
+}
+
+func TestFetchRefusesRedirectToOtherSchemes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	_, err := newHTTPFetcher(5*time.Second, 1024, nil, allowAll).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrUnsupportedURL) {
+		t.Fatalf("got %v, want ErrUnsupportedURL", err)
+	}
+}
+
+func TestFetchRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the server")
+	}))
+	defer srv.Close()
+
+	_, err := NewHTTPFetcher(5*time.Second, 1024).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("got %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestFetchRefusesHostnameResolvingToLoopback(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>Internal</title>`)
+	}))
+	defer srv.Close()
+
+	srvURL, _ := url.Parse(srv.URL)
+	target := "http://preview.example.com:" + srvURL.Port() + "/"
+	resolver := loopbackResolver(t)
+	ctx := context.Background()
+
+	// The name resolves, so the refusal below comes from the address check
+	if _, err := newHTTPFetcher(5*time.Second, 1024, resolver, allowAll).Fetch(ctx, target); err != nil {
+		t.Fatalf("Fetch without the address check: %v", err)
+	}
+
+	_, err := newHTTPFetcher(5*time.Second, 1024, resolver, checkPublic).Fetch(ctx, target)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("got %v, want ErrBlockedAddress", err)
+	}
+	if hits != 1 {
+		t.Fatalf("server got %d requests, want only the unchecked one", hits)
+	}
+}
+
+func TestCheckPublic(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"224.0.0.1":        false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fc00::1":          false,
+		"fe80::1":          false,
+		"64:ff9b::a00:1":   false,
+		"8.8.8.8":          true,
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+	}
+	for addr, public := range tests {
+		err := checkPublic(netip.MustParseAddr(addr))
+		if public && err != nil {
+			t.Errorf("%s refused: %v", addr, err)
+		}
+		if !public && !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("%s allowed", addr)
+		}
+	}
+}
+
+// loopbackResolver returns a resolver whose DNS server answers every A
+// query with 127.0.0.1, like a public name pointed at the server itself
+func loopbackResolver(t *testing.T) *net.Resolver {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp, err := answerLoopback(buf[:n]); err == nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func answerLoopback(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(question); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if question.Type == dnsmessage.TypeA {
+		err := b.AResource(
+			dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,175 @@
+package linkpreview
+
+import (
+	"bytes"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 500
+)
+
+var urlPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'` + "`" + `]+`)
+
+// FirstURL returns the first http or https URL in a message, without the
+// punctuation that usually follows a link in running text
+func FirstURL(text string) string {
+	match := urlPattern.FindString(text)
+	if match == "" {
+		return ""
+	}
+
+	for len(match) > 0 {
+		last := match[len(match)-1]
+		switch {
+		case strings.ContainsRune(".,;:!?'\"", rune(last)):
+			match = match[:len(match)-1]
+		case last == ')' && strings.Count(match, "(") < strings.Count(match, ")"):
+			// "(see https://example.com)" but keep wiki-style "Go_(language)"
+			match = match[:len(match)-1]
+		default:
+			return match
+		}
+	}
+	return match
+}
+
+// parse builds a preview from a fetched page. Images link to themselves;
+// HTML pages are read for Open Graph tags, falling back to <title> and the
+// description meta tag. It returns nil when the page has nothing to show.
+func parse(page *Page) *models.LinkPreview {
+	mediaType, params, _ := mime.ParseMediaType(page.ContentType)
+
+	if strings.HasPrefix(mediaType, "image/") {
+		return &models.LinkPreview{URL: page.URL.String(), Image: page.URL.String()}
+	}
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil
+	}
+
+	meta := map[string]string{}
+	var title string
+
+	reader, err := charset.NewReader(bytes.NewReader(page.Body), "text/html; charset="+params["charset"])
+	if err != nil {
+		return nil
+	}
+	tokenizer := html.NewTokenizer(reader)
+	inTitle := false
+
+loop:
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			switch string(name) {
+			case "meta":
+				if hasAttr {
+					readMeta(tokenizer, meta)
+				}
+			case "title":
+				inTitle = title == ""
+			case "body":
+				// Everything a preview needs is in the head
+				break loop
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				break loop
+			}
+		}
+	}
+
+	preview := &models.LinkPreview{
+		URL:         page.URL.String(),
+		Title:       clean(first(meta["og:title"], meta["twitter:title"], title), maxTitleLength),
+		Description: clean(first(meta["og:description"], meta["twitter:description"], meta["description"]), maxDescriptionLength),
+		SiteName:    clean(meta["og:site_name"], maxTitleLength),
+		Image:       resolveImage(page.URL, first(meta["og:image:secure_url"], meta["og:image"], meta["twitter:image"])),
+	}
+	if preview.Title == "" && preview.Description == "" && preview.Image == "" {
+		return nil
+	}
+	if preview.SiteName == "" {
+		preview.SiteName = strings.TrimPrefix(page.URL.Hostname(), "www.")
+	}
+
+	return preview
+}
+
+// readMeta records a <meta> tag keyed by its property or name, keeping the
+// first occurrence
+func readMeta(tokenizer *html.Tokenizer, meta map[string]string) {
+	var key, content string
+	for {
+		name, value, more := tokenizer.TagAttr()
+		switch string(name) {
+		case "property", "name":
+			if key == "" {
+				key = strings.ToLower(strings.TrimSpace(string(value)))
+			}
+		case "content":
+			content = string(value)
+		}
+		if !more {
+			break
+		}
+	}
+
+	if key != "" && content != "" {
+		if _, seen := meta[key]; !seen {
+			meta[key] = content
+		}
+	}
+}
+
+// resolveImage makes an image URL absolute and drops anything that isn't
+// http or https, such as data: or javascript: URLs
+func resolveImage(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(strings.TrimSpace(ref))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+func first(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// clean collapses whitespace and truncates to limit runes
+func clean(s string, limit int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:limit-1])) + "…"
+}
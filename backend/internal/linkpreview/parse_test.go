@@ -0,0 +1,127 @@
+package linkpreview
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        *models.LinkPreview
+	}{
+		{
+			name:        "Open Graph wins over Twitter and title",
+			contentType: "text/html; charset=utf-8",
+			body: `<html><head><title>Page title</title>
+				<meta name="twitter:title" content="Twitter title">
+				<meta property="og:title" content="OG title">
+				<meta name="twitter:description" content="Twitter description">
+				<meta property="og:description" content="OG description">
+				<meta name="description" content="Meta description">
+				<meta property="og:site_name" content="Example">
+				<meta name="twitter:image" content="https://cdn.example.com/twitter.png">
+				<meta property="og:image" content="/og.png">
+				</head><body></body></html>`,
+			want: &models.LinkPreview{
+				Title:       "OG title",
+				Description: "OG description",
+				SiteName:    "Example",
+				Image:       "https://www.example.com/og.png",
+			},
+		},
+		{
+			name:        "Twitter tags without Open Graph",
+			contentType: "text/html",
+			body: `<head><title>Page title</title>
+				<meta name="twitter:title" content="Twitter title">
+				<meta name="twitter:description" content="Twitter description">
+				<meta name="twitter:image" content="https://cdn.example.com/twitter.png"></head>`,
+			want: &models.LinkPreview{
+				Title:       "Twitter title",
+				Description: "Twitter description",
+				SiteName:    "example.com",
+				Image:       "https://cdn.example.com/twitter.png",
+			},
+		},
+		{
+			name:        "title and description meta",
+			contentType: "text/html",
+			body: `<head><title>
+				  Page
+				  title </title><meta name="Description" content="Meta description"></head>`,
+			want: &models.LinkPreview{
+				Title:       "Page title",
+				Description: "Meta description",
+				SiteName:    "example.com",
+			},
+		},
+		{
+			name:        "tags in the body are ignored",
+			contentType: "text/html",
+			body:        `<head><title>Page title</title></head><body><meta property="og:title" content="Injected"></body>`,
+			want:        &models.LinkPreview{Title: "Page title", SiteName: "example.com"},
+		},
+		{
+			name:        "script image URLs are dropped",
+			contentType: "text/html",
+			body:        `<head><title>Page title</title><meta property="og:image" content="javascript:alert(1)"></head>`,
+			want:        &models.LinkPreview{Title: "Page title", SiteName: "example.com"},
+		},
+		{
+			name:        "image",
+			contentType: "image/png",
+			body:        "\x89PNG",
+			want: &models.LinkPreview{
+				Image: "https://www.example.com/page",
+			},
+		},
+		{
+			name:        "nothing to show",
+			contentType: "text/html",
+			body:        `<html><head></head><body>Hello</body></html>`,
+		},
+		{
+			name:        "not a page",
+			contentType: "application/pdf",
+			body:        "%PDF-1.7",
+		},
+	}
+
+	pageURL, _ := url.Parse("https://www.example.com/page")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parse(&Page{URL: pageURL, ContentType: tt.contentType, Body: []byte(tt.body)})
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("got %+v, want no preview", got)
+				}
+				return
+			}
+
+			tt.want.URL = pageURL.String()
+			if got == nil || *got != *tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFirstURL(t *testing.T) {
+	tests := map[string]string{
+		"see https://example.com/a.":              "https://example.com/a",
+		"(see https://example.com/a)":             "https://example.com/a",
+		"https://en.wikipedia.org/wiki/Go_(lang)": "https://en.wikipedia.org/wiki/Go_(lang)",
+		"ftp://example.com and http://b.test/x?y": "http://b.test/x?y",
+		"no links here":                           "",
+	}
+	for text, want := range tests {
+		if got := FirstURL(text); got != want {
+			t.Errorf("FirstURL(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package linkpreview
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Notifier delivers real-time events to connected users
+type Notifier interface {
+	SendToUser(userID string, message interface{}) error
+}
+
+// Processor fetches previews for queued messages on a fixed number of
+// workers, attaches them and tells the conversation with message_updated
+type Processor struct {
+	service  *Service
+	notifier Notifier
+	workers  int
+	timeout  time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewProcessor(service *Service, notifier Notifier, workers int, timeout time.Duration) *Processor {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Processor{
+		service:  service,
+		notifier: notifier,
+		workers:  workers,
+		timeout:  timeout,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (p *Processor) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+}
+
+func (p *Processor) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *Processor) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case j := <-p.service.queue:
+			p.process(j)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Processor) process(j job) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	preview, err := p.service.Preview(ctx, j.URL)
+	if err != nil {
+		log.Printf("Link preview failed for %s: %v", j.URL, err)
+		return
+	}
+	if preview == nil {
+		return
+	}
+
+	// Skip messages that were edited or deleted while the page was fetched
+	var message models.Message
+	err = p.service.db.DB.Collection("messages").FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":     j.MessageID,
+			"content": j.Content,
+			"deleted": bson.M{"$ne": true},
+		},
+		bson.M{"$set": bson.M{"link_preview": preview}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&message)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Failed to save link preview for %s: %v", j.MessageID.Hex(), err)
+		}
+		return
+	}
+
+	var conversation models.Conversation
+	err = p.service.db.DB.Collection("conversations").FindOne(ctx, bson.M{"_id": j.ConversationID}).Decode(&conversation)
+	if err != nil {
+		return
+	}
+
+	event := map[string]interface{}{
+		"type":    "message_updated",
+		"message": message,
+	}
+	for _, participant := range conversation.Participants {
+		_ = p.notifier.SendToUser(participant.Hex(), event)
+	}
+}
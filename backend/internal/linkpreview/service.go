@@ -0,0 +1,85 @@
+package linkpreview
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/cache"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	cacheTTL         = 6 * time.Hour
+	negativeCacheTTL = 15 * time.Minute
+	queueSize        = 256
+)
+
+// job is a message waiting for its preview. Content is kept so a preview
+// fetched for an older version of an edited message is discarded.
+type job struct {
+	MessageID      primitive.ObjectID
+	ConversationID primitive.ObjectID
+	Content        string
+	URL            string
+}
+
+type Service struct {
+	db      *database.Database
+	fetcher Fetcher
+	cache   cache.Cache[string, *models.LinkPreview] // keyed by URL
+	queue   chan job
+}
+
+func NewService(db *database.Database, fetcher Fetcher, cache cache.Cache[string, *models.LinkPreview]) *Service {
+	return &Service{
+		db:      db,
+		fetcher: fetcher,
+		cache:   cache,
+		queue:   make(chan job, queueSize),
+	}
+}
+
+// Enqueue schedules a preview for the first URL in a text message. It
+// never blocks the sender: when the queue is full the preview is skipped.
+func (s *Service) Enqueue(msg *models.Message) {
+	if msg.Type != "text" {
+		return
+	}
+	u := FirstURL(msg.Content)
+	if u == "" {
+		return
+	}
+
+	select {
+	case s.queue <- job{MessageID: msg.ID, ConversationID: msg.ConversationID, Content: msg.Content, URL: u}:
+	default:
+		log.Printf("Link preview queue full, skipping message %s", msg.ID.Hex())
+	}
+}
+
+// Preview returns the preview for a URL, fetching it only when it isn't
+// cached. Failures are cached too, for a shorter time, so a dead link
+// pasted repeatedly isn't fetched every time.
+func (s *Service) Preview(ctx context.Context, rawURL string) (*models.LinkPreview, error) {
+	if cached, ok := s.cache.Get(rawURL); ok {
+		return cached, nil
+	}
+
+	page, err := s.fetcher.Fetch(ctx, rawURL)
+	if err != nil {
+		s.cache.SetWithTTL(rawURL, (*models.LinkPreview)(nil), negativeCacheTTL)
+		return nil, err
+	}
+
+	preview := parse(page)
+	if preview == nil {
+		s.cache.SetWithTTL(rawURL, preview, negativeCacheTTL)
+		return nil, nil
+	}
+
+	s.cache.SetWithTTL(rawURL, preview, cacheTTL)
+	return preview, nil
+}
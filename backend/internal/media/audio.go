@@ -0,0 +1,479 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// waveformPoints is the number of amplitude samples kept for a voice note,
+// enough for a preview bar without bloating every message that embeds it
+const waveformPoints = 64
+
+// audioInfo is what the server learns from a voice note or audio file
+type audioInfo struct {
+	Duration float64 // seconds
+	Waveform []int   // 0-100 per point, at most waveformPoints long
+}
+
+// audioContainer identifies the container of an audio file from its first
+// bytes, or returns "" when it isn't one we can read
+func audioContainer(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return "ogg"
+	case len(head) >= 4 && binary.BigEndian.Uint32(head) == ebmlHeader:
+		return "webm"
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return "mp4"
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return "wav"
+	case bytes.HasPrefix(head, []byte("ID3")):
+		return "mp3"
+	case len(head) >= 4 && parseMP3Header(head) != nil:
+		return "mp3"
+	}
+	return ""
+}
+
+// audioContainers maps declared audio types to the container they must be
+var audioContainers = map[string]string{
+	"audio/ogg":   "ogg",
+	"audio/opus":  "ogg",
+	"audio/webm":  "webm",
+	"audio/mp4":   "mp4",
+	"audio/x-m4a": "mp4",
+	"audio/mpeg":  "mp3",
+	"audio/mp3":   "mp3",
+	"audio/wav":   "wav",
+	"audio/x-wav": "wav",
+	"audio/wave":  "wav",
+}
+
+// probeAudio reads the duration of an audio file and builds its waveform.
+// Uncompressed WAV gets a true RMS envelope; for compressed formats the
+// size of each packet stands in for loudness, since encoders spend more
+// bits on louder, busier audio and very few on silence.
+func probeAudio(data []byte) (*audioInfo, error) {
+	switch audioContainer(data) {
+	case "wav":
+		return probeWAV(data)
+	case "ogg":
+		return probeOgg(data)
+	case "mp3":
+		return probeMP3(data)
+	case "webm":
+		info, err := probeWebM(data)
+		if err != nil {
+			return nil, err
+		}
+		return &audioInfo{Duration: info.Duration, Waveform: densityWaveform(webmBlockSizes(data))}, nil
+	case "mp4":
+		info, err := probeMP4(data)
+		if err != nil {
+			return nil, err
+		}
+		return &audioInfo{Duration: info.Duration, Waveform: densityWaveform(mp4SampleSizes(data))}, nil
+	}
+	return nil, errUnknownContainer
+}
+
+func probeWAV(data []byte) (*audioInfo, error) {
+	var format, channels, bits uint16
+	var byteRate uint32
+	var samples []byte
+
+	pos := 12
+	for pos+8 <= len(data) {
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		body := data[pos+8:]
+		if size >= 0 && size <= len(body) {
+			body = body[:size]
+		}
+
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, errUnknownContainer
+			}
+			format = binary.LittleEndian.Uint16(body[0:])
+			channels = binary.LittleEndian.Uint16(body[2:])
+			byteRate = binary.LittleEndian.Uint32(body[8:])
+			bits = binary.LittleEndian.Uint16(body[14:])
+			if format == 0xFFFE && len(body) >= 26 {
+				// WAVE_FORMAT_EXTENSIBLE keeps the real format in its GUID
+				format = binary.LittleEndian.Uint16(body[24:])
+			}
+		case "data":
+			samples = body
+		}
+
+		// Chunks are padded to an even length
+		pos += 8 + size + size%2
+		if samples != nil {
+			break
+		}
+	}
+
+	if byteRate == 0 || samples == nil || channels == 0 {
+		return nil, errUnknownContainer
+	}
+
+	info := &audioInfo{Duration: float64(len(samples)) / float64(byteRate)}
+
+	width := int(bits) / 8
+	frame := width * int(channels)
+	if frame == 0 || len(samples) < frame {
+		return info, nil
+	}
+
+	var sample func(b []byte) float64
+	switch {
+	case format == 1 && bits == 8:
+		sample = func(b []byte) float64 { return (float64(b[0]) - 128) / 128 }
+	case format == 1 && bits == 16:
+		sample = func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / 32768 }
+	case format == 1 && bits == 24:
+		sample = func(b []byte) float64 {
+			v := int32(b[0]) | int32(b[1])<<8 | int32(int8(b[2]))<<16
+			return float64(v) / 8388608
+		}
+	case format == 1 && bits == 32:
+		sample = func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648 }
+	case format == 3 && bits == 32:
+		sample = func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	default:
+		// Compressed WAV (ADPCM, mu-law, ...): duration only
+		return info, nil
+	}
+
+	frames := len(samples) / frame
+	points := min(waveformPoints, frames)
+	rms := make([]float64, points)
+	for p := 0; p < points; p++ {
+		start, end := p*frames/points, (p+1)*frames/points
+		var sum float64
+		for f := start; f < end; f++ {
+			for ch := 0; ch < int(channels); ch++ {
+				at := f*frame + ch*width
+				v := sample(samples[at : at+width])
+				sum += v * v
+			}
+		}
+		rms[p] = math.Sqrt(sum / float64((end-start)*int(channels)))
+	}
+	info.Waveform = normalizeWaveform(rms)
+
+	return info, nil
+}
+
+// probeOgg reads an Ogg Opus or Vorbis stream. Its duration comes from the
+// granule position of the last page and its waveform from packet sizes.
+func probeOgg(data []byte) (*audioInfo, error) {
+	var sampleRate, preSkip float64
+	var lastGranule int64
+	var packets []int
+	packet := 0
+
+	pos := 0
+	for pos+27 <= len(data) && string(data[pos:pos+4]) == "OggS" {
+		granule := int64(binary.LittleEndian.Uint64(data[pos+6:]))
+		segments := int(data[pos+26])
+		if pos+27+segments > len(data) {
+			break
+		}
+		lacing := data[pos+27 : pos+27+segments]
+		body := pos + 27 + segments
+
+		if sampleRate == 0 && body+19 <= len(data) {
+			switch {
+			case bytes.HasPrefix(data[body:], []byte("OpusHead")):
+				// Opus granules always count 48 kHz samples
+				sampleRate = 48000
+				preSkip = float64(binary.LittleEndian.Uint16(data[body+10:]))
+			case bytes.HasPrefix(data[body:], []byte("\x01vorbis")):
+				sampleRate = float64(binary.LittleEndian.Uint32(data[body+12:]))
+			}
+		}
+
+		if granule > 0 {
+			lastGranule = granule
+		}
+		// Packets continue across segments of 255 bytes; header packets
+		// carry a granule position of 0 and are skipped
+		for _, l := range lacing {
+			packet += int(l)
+			if l < 255 {
+				if granule > 0 {
+					packets = append(packets, packet)
+				}
+				packet = 0
+			}
+		}
+
+		size := 0
+		for _, l := range lacing {
+			size += int(l)
+		}
+		pos = body + size
+	}
+
+	if sampleRate == 0 {
+		return nil, errUnknownContainer
+	}
+
+	return &audioInfo{
+		Duration: math.Max(0, float64(lastGranule)-preSkip) / sampleRate,
+		Waveform: densityWaveform(packets),
+	}, nil
+}
+
+// mp3Frame is a decoded MPEG audio frame header
+type mp3Frame struct {
+	Length          int // bytes, including the header
+	SampleRate      int
+	SamplesPerFrame int
+	Bitrate         int // bits per second
+	XingOffset      int // where a Xing/Info header would start
+}
+
+var (
+	mp3Bitrates = [2][16]int{
+		// MPEG-1 Layer III
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		// MPEG-2/2.5 Layer III
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	}
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},  // MPEG-2.5
+		{0, 0, 0},             // reserved
+		{22050, 24000, 16000}, // MPEG-2
+		{44100, 48000, 32000}, // MPEG-1
+	}
+)
+
+// parseMP3Header decodes a Layer III frame header, the only layer used for
+// MP3 files
+func parseMP3Header(b []byte) *mp3Frame {
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return nil
+	}
+	version := int(b[1]>>3) & 3
+	layer := int(b[1]>>1) & 3
+	bitrateIndex := int(b[2] >> 4)
+	rateIndex := int(b[2]>>2) & 3
+	padding := int(b[2]>>1) & 1
+	mono := b[3]>>6 == 3
+	if version == 1 || layer != 1 || rateIndex == 3 || bitrateIndex == 0 || bitrateIndex == 15 {
+		return nil
+	}
+
+	frame := &mp3Frame{SampleRate: mp3SampleRates[version][rateIndex]}
+	table, samples := 0, 1152
+	if version != 3 {
+		table, samples = 1, 576
+	}
+	frame.SamplesPerFrame = samples
+	frame.Bitrate = mp3Bitrates[table][bitrateIndex] * 1000
+	frame.Length = samples/8*frame.Bitrate/frame.SampleRate + padding
+
+	switch {
+	case version == 3 && !mono:
+		frame.XingOffset = 36
+	case version == 3 || !mono:
+		frame.XingOffset = 21
+	default:
+		frame.XingOffset = 13
+	}
+
+	return frame
+}
+
+// probeMP3 walks the frames of an MP3 file. A Xing or Info header gives the
+// exact frame count of VBR files; otherwise every frame is counted.
+func probeMP3(data []byte) (*audioInfo, error) {
+	pos := 0
+	if bytes.HasPrefix(data, []byte("ID3")) && len(data) >= 10 {
+		// ID3v2 sizes are syncsafe: 7 bits per byte
+		size := int(data[6]&0x7F)<<21 | int(data[7]&0x7F)<<14 | int(data[8]&0x7F)<<7 | int(data[9]&0x7F)
+		pos = 10 + size
+		if data[5]&0x10 != 0 {
+			pos += 10 // footer
+		}
+	}
+
+	var first *mp3Frame
+	var sizes []int
+	xingFrames := 0
+	for pos+4 <= len(data) {
+		frame := parseMP3Header(data[pos:])
+		if frame == nil || frame.Length < 4 {
+			if first != nil {
+				break // trailing ID3v1 tag or junk
+			}
+			pos++
+			continue
+		}
+
+		if first == nil {
+			first = frame
+			at := pos + frame.XingOffset
+			if at+12 <= len(data) {
+				tag := string(data[at : at+4])
+				if (tag == "Xing" || tag == "Info") && data[at+7]&1 != 0 {
+					// The Xing frame itself holds no audio
+					xingFrames = int(binary.BigEndian.Uint32(data[at+8:]))
+					pos += frame.Length
+					continue
+				}
+			}
+		}
+
+		sizes = append(sizes, frame.Length)
+		pos += frame.Length
+	}
+
+	if first == nil {
+		return nil, errUnknownContainer
+	}
+
+	frames := len(sizes)
+	if xingFrames > 0 {
+		frames = xingFrames
+	}
+
+	return &audioInfo{
+		Duration: float64(frames*first.SamplesPerFrame) / float64(first.SampleRate),
+		Waveform: densityWaveform(sizes),
+	}, nil
+}
+
+// EBML element IDs for the blocks inside a Matroska cluster
+const (
+	ebmlSimpleBlock = 0xA3
+	ebmlBlockGroup  = 0xA0
+	ebmlBlock       = 0xA1
+)
+
+// webmBlockSizes returns the size of every block in a WebM file's clusters
+func webmBlockSizes(data []byte) []int {
+	var sizes []int
+
+	var walk func(buf []byte)
+	walk = func(buf []byte) {
+		for len(buf) > 0 {
+			id, idLen := readEBMLID(buf)
+			if idLen == 0 {
+				return
+			}
+			size, sizeLen := readEBMLSize(buf[idLen:])
+			if sizeLen == 0 {
+				return
+			}
+			start := idLen + sizeLen
+			end := len(buf)
+			if size >= 0 && start+size <= len(buf) {
+				end = start + size
+			}
+
+			switch id {
+			case ebmlSegment, ebmlCluster, ebmlBlockGroup:
+				walk(buf[start:end])
+			case ebmlSimpleBlock, ebmlBlock:
+				sizes = append(sizes, end-start)
+			}
+
+			buf = buf[end:]
+		}
+	}
+
+	walk(data)
+	return sizes
+}
+
+// mp4SampleSizes returns the sample sizes from the first track's stsz box
+func mp4SampleSizes(data []byte) []int {
+	var sizes []int
+
+	var walk func(buf []byte) bool
+	walk = func(buf []byte) bool {
+		for len(buf) >= 8 {
+			size := int(binary.BigEndian.Uint32(buf[0:4]))
+			boxType := string(buf[4:8])
+			if size == 0 {
+				size = len(buf)
+			}
+			if size < 8 || size > len(buf) {
+				return false
+			}
+			body := buf[8:size]
+
+			switch boxType {
+			case "moov", "trak", "mdia", "minf", "stbl":
+				if walk(body) {
+					return true
+				}
+			case "stsz":
+				if len(body) < 12 {
+					return false
+				}
+				fixed := int(binary.BigEndian.Uint32(body[4:]))
+				count := int(binary.BigEndian.Uint32(body[8:]))
+				if fixed != 0 {
+					return false // constant sample size says nothing
+				}
+				for i := 0; i < count && 12+i*4+4 <= len(body); i++ {
+					sizes = append(sizes, int(binary.BigEndian.Uint32(body[12+i*4:])))
+				}
+				return true
+			}
+
+			buf = buf[size:]
+		}
+		return false
+	}
+
+	walk(data)
+	return sizes
+}
+
+// densityWaveform buckets packet sizes into waveformPoints averages. Codec
+// packets cover equal stretches of time, so packet size tracks how much is
+// going on in the audio.
+func densityWaveform(sizes []int) []int {
+	if len(sizes) == 0 {
+		return nil
+	}
+
+	points := min(waveformPoints, len(sizes))
+	levels := make([]float64, points)
+	for p := 0; p < points; p++ {
+		start, end := p*len(sizes)/points, (p+1)*len(sizes)/points
+		var sum int
+		for _, s := range sizes[start:end] {
+			sum += s
+		}
+		levels[p] = float64(sum) / float64(end-start)
+	}
+
+	return normalizeWaveform(levels)
+}
+
+// normalizeWaveform scales levels to 0-100 relative to the loudest point,
+// so quiet recordings still show their shape
+func normalizeWaveform(levels []float64) []int {
+	peak := 0.0
+	for _, l := range levels {
+		peak = math.Max(peak, l)
+	}
+
+	out := make([]int, len(levels))
+	if peak == 0 {
+		return out
+	}
+	for i, l := range levels {
+		out[i] = int(math.Round(l / peak * 100))
+	}
+	return out
+}
@@ -0,0 +1,266 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// probe holds what could be learned from a media container without decoding
+// any audio or video frames
+type probe struct {
+	Width       int
+	Height      int
+	Duration    float64 // seconds
+	Orientation int     // EXIF orientation, 1 when upright
+}
+
+var errUnknownContainer = errors.New("unrecognized media container")
+
+// probeMP4 reads the movie and track headers of an ISO base media file
+// (MP4, MOV, M4A)
+func probeMP4(data []byte) (*probe, error) {
+	result := &probe{Orientation: 1}
+	found := false
+
+	var walk func(buf []byte) error
+	walk = func(buf []byte) error {
+		for len(buf) >= 8 {
+			size := uint64(binary.BigEndian.Uint32(buf[0:4]))
+			boxType := string(buf[4:8])
+			header := uint64(8)
+			switch size {
+			case 0:
+				size = uint64(len(buf))
+			case 1:
+				if len(buf) < 16 {
+					return errUnknownContainer
+				}
+				size = binary.BigEndian.Uint64(buf[8:16])
+				header = 16
+			}
+			if size < header || size > uint64(len(buf)) {
+				return errUnknownContainer
+			}
+			body := buf[header:size]
+
+			switch boxType {
+			case "moov", "trak":
+				if err := walk(body); err != nil {
+					return err
+				}
+			case "mvhd":
+				found = true
+				parseMVHD(body, result)
+			case "tkhd":
+				parseTKHD(body, result)
+			}
+
+			buf = buf[size:]
+		}
+		return nil
+	}
+
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return nil, errUnknownContainer
+	}
+	if err := walk(data); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errUnknownContainer
+	}
+
+	return result, nil
+}
+
+func parseMVHD(body []byte, result *probe) {
+	if len(body) < 20 {
+		return
+	}
+
+	var timescale, duration uint64
+	if body[0] == 1 {
+		if len(body) < 32 {
+			return
+		}
+		timescale = uint64(binary.BigEndian.Uint32(body[20:24]))
+		duration = binary.BigEndian.Uint64(body[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(body[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	}
+
+	if timescale > 0 {
+		result.Duration = float64(duration) / float64(timescale)
+	}
+}
+
+// parseTKHD records the display size and rotation of the first video track
+func parseTKHD(body []byte, result *probe) {
+	matrixAt, sizeAt := 40, 76
+	if len(body) > 0 && body[0] == 1 {
+		matrixAt, sizeAt = 52, 88
+	}
+	if len(body) < sizeAt+8 || result.Width > 0 {
+		return
+	}
+
+	width := int(binary.BigEndian.Uint32(body[sizeAt:]) >> 16)
+	height := int(binary.BigEndian.Uint32(body[sizeAt+4:]) >> 16)
+	if width == 0 || height == 0 {
+		return // audio track
+	}
+
+	a := int32(binary.BigEndian.Uint32(body[matrixAt:]))
+	b := int32(binary.BigEndian.Uint32(body[matrixAt+4:]))
+	switch {
+	case a == 0 && b > 0:
+		result.Orientation = 6 // rotate 90 clockwise
+	case a < 0 && b == 0:
+		result.Orientation = 3 // rotate 180
+	case a == 0 && b < 0:
+		result.Orientation = 8 // rotate 270 clockwise
+	}
+
+	result.Width, result.Height = width, height
+}
+
+// EBML element IDs used by Matroska and WebM
+const (
+	ebmlSegment       = 0x18538067
+	ebmlInfo          = 0x1549A966
+	ebmlTimecodeScale = 0x2AD7B1
+	ebmlDuration      = 0x4489
+	ebmlTracks        = 0x1654AE6B
+	ebmlTrackEntry    = 0xAE
+	ebmlVideo         = 0xE0
+	ebmlPixelWidth    = 0xB0
+	ebmlPixelHeight   = 0xBA
+	ebmlCluster       = 0x1F43B675
+	ebmlHeader        = 0x1A45DFA3
+)
+
+// probeWebM reads the segment info and video track of a Matroska/WebM file
+func probeWebM(data []byte) (*probe, error) {
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != ebmlHeader {
+		return nil, errUnknownContainer
+	}
+
+	result := &probe{Orientation: 1}
+	timecodeScale := uint64(1000000)
+	var rawDuration float64
+
+	var walk func(buf []byte) error
+	walk = func(buf []byte) error {
+		for len(buf) > 0 {
+			id, idLen := readEBMLID(buf)
+			if idLen == 0 {
+				return errUnknownContainer
+			}
+			size, sizeLen := readEBMLSize(buf[idLen:])
+			if sizeLen == 0 {
+				return errUnknownContainer
+			}
+			start := idLen + sizeLen
+			end := len(buf)
+			if size >= 0 && start+size <= len(buf) {
+				end = start + size
+			}
+			body := buf[start:end]
+
+			switch id {
+			case ebmlCluster:
+				// Media data starts here; everything needed comes before it
+				return nil
+			case ebmlSegment, ebmlInfo, ebmlTracks, ebmlTrackEntry, ebmlVideo:
+				if err := walk(body); err != nil {
+					return err
+				}
+			case ebmlTimecodeScale:
+				timecodeScale = readEBMLUint(body)
+			case ebmlDuration:
+				switch len(body) {
+				case 4:
+					rawDuration = float64(math.Float32frombits(binary.BigEndian.Uint32(body)))
+				case 8:
+					rawDuration = math.Float64frombits(binary.BigEndian.Uint64(body))
+				}
+			case ebmlPixelWidth:
+				if result.Width == 0 {
+					result.Width = int(readEBMLUint(body))
+				}
+			case ebmlPixelHeight:
+				if result.Height == 0 {
+					result.Height = int(readEBMLUint(body))
+				}
+			}
+
+			buf = buf[end:]
+		}
+		return nil
+	}
+
+	if err := walk(data); err != nil {
+		return nil, err
+	}
+
+	result.Duration = rawDuration * float64(timecodeScale) / 1e9
+	return result, nil
+}
+
+// readEBMLID returns an element ID with its length marker kept, as IDs are
+// conventionally written
+func readEBMLID(buf []byte) (uint32, int) {
+	if len(buf) == 0 {
+		return 0, 0
+	}
+	length := leadingZeros(buf[0]) + 1
+	if length > 4 || len(buf) < length {
+		return 0, 0
+	}
+	var id uint32
+	for i := 0; i < length; i++ {
+		id = id<<8 | uint32(buf[i])
+	}
+	return id, length
+}
+
+// readEBMLSize returns an element size, or -1 for the reserved "unknown
+// size" value used by live-streamed segments
+func readEBMLSize(buf []byte) (int, int) {
+	if len(buf) == 0 {
+		return 0, 0
+	}
+	length := leadingZeros(buf[0]) + 1
+	if length > 8 || len(buf) < length {
+		return 0, 0
+	}
+
+	value := uint64(buf[0] & (0xFF >> length))
+	allOnes := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(buf[i])
+		allOnes = allOnes && buf[i] == 0xFF
+	}
+	if allOnes || value > math.MaxInt32 {
+		return -1, length
+	}
+	return int(value), length
+}
+
+func readEBMLUint(body []byte) uint64 {
+	var v uint64
+	for _, b := range body {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func leadingZeros(b byte) int {
+	n := 0
+	for mask := byte(0x80); mask != 0 && b&mask == 0; mask >>= 1 {
+		n++
+	}
+	return n
+}
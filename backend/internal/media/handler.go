@@ -0,0 +1,337 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+type Handler struct {
+	service *Service
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{service: service}
+}
+
+// Upload accepts a whole file as the "file" field of a multipart form
+func (h *Handler) Upload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "file is required",
+		})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid file",
+		})
+	}
+	defer file.Close()
+
+	media, err := h.service.Upload(
+		c.Context(),
+		userID,
+		fileHeader.Filename,
+		fileHeader.Header.Get("Content-Type"),
+		fileHeader.Size,
+		file,
+	)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(media)
+}
+
+type CreateUploadRequest struct {
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	Size     int64  `json:"size"`
+}
+
+// CreateUpload starts a resumable upload
+func (h *Handler) CreateUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var req CreateUploadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	media, err := h.service.CreateUpload(c.Context(), userID, req.FileName, req.MimeType, req.Size)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set("Location", "/api/media/uploads/"+media.ID.Hex())
+	c.Set("Upload-Offset", "0")
+	return c.Status(fiber.StatusCreated).JSON(media)
+}
+
+// AppendChunk receives the next chunk of a resumable upload. The request
+// body is the raw chunk and the Upload-Offset header its starting byte.
+func (h *Handler) AppendChunk(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	uploadID := c.Params("id")
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid Upload-Offset header",
+		})
+	}
+
+	body := c.Body()
+	media, err := h.service.AppendChunk(c.Context(), uploadID, userID, offset, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		if errors.Is(err, ErrOffsetMismatch) {
+			if current, getErr := h.service.GetUpload(c.Context(), uploadID, userID); getErr == nil {
+				c.Set("Upload-Offset", strconv.FormatInt(current.UploadedBytes, 10))
+			}
+		}
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(media.UploadedBytes, 10))
+	return c.JSON(media)
+}
+
+// GetUpload reports how many bytes of a resumable upload were received
+func (h *Handler) GetUpload(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	media, err := h.service.GetUpload(c.Context(), c.Params("id"), userID)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(media.UploadedBytes, 10))
+	return c.JSON(media)
+}
+
+func (h *Handler) Get(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	media, err := h.authorize(c, userID)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(media)
+}
+
+// Download streams the file to the uploader or to participants of a
+// conversation where it was shared
+func (h *Handler) Download(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	media, err := h.authorize(c, userID)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return h.sendContent(c, media, userID)
+}
+
+// Thumbnail serves the JPEG preview generated for images
+func (h *Handler) Thumbnail(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	media, err := h.authorize(c, userID)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	reader, err := h.service.OpenThumbnail(c.Context(), media)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "image/jpeg")
+	c.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+	return c.SendStream(reader)
+}
+
+// SignURL issues short-lived URLs that can be used without an
+// Authorization header, e.g. as the src of an <img> or <video> element
+func (h *Handler) SignURL(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	urls, err := h.service.SignURLs(c.Context(), c.Params("id"), userID, c.Query("conversation_id"))
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(urls)
+}
+
+// Signed serves a file or its thumbnail through a signed URL
+func (h *Handler) Signed(c *fiber.Ctx) error {
+	variant := c.Params("variant")
+	if variant != "content" && variant != "thumbnail" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": ErrNotFound.Error(),
+		})
+	}
+
+	query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+	media, grant, err := h.service.AuthorizeSigned(c.Context(), c.Params("id"), variant, query)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if variant == "thumbnail" {
+		reader, err := h.service.OpenThumbnail(c.Context(), media)
+		if err != nil {
+			return c.Status(errorStatus(err)).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		c.Set(fiber.HeaderContentType, "image/jpeg")
+		c.Set(fiber.HeaderCacheControl, "private, no-store")
+		return c.SendStream(reader)
+	}
+
+	return h.sendContent(c, media, grant.UserID)
+}
+
+// sendContent streams the file, honouring a single-range Range header so
+// audio and video players can seek
+func (h *Handler) sendContent(c *fiber.Ctx, media *models.MediaFile, userID string) error {
+	offset, length := int64(0), media.Size
+	partial := false
+
+	if header := c.Get(fiber.HeaderRange); header != "" {
+		start, end, ok := parseRange(header, media.Size)
+		if !ok {
+			c.Set(fiber.HeaderContentRange, "bytes */"+strconv.FormatInt(media.Size, 10))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).JSON(fiber.Map{
+				"error": "invalid range",
+			})
+		}
+		offset, length = start, end-start+1
+		partial = true
+	}
+
+	reader, err := h.service.Open(c.Context(), media, userID, offset, length)
+	if err != nil {
+		return c.Status(errorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, media.MimeType)
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set(fiber.HeaderCacheControl, "private, no-store")
+	if partial {
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, media.Size))
+		c.Status(fiber.StatusPartialContent)
+	}
+	return c.SendStream(reader, int(length))
+}
+
+// parseRange parses a single "bytes=" range against a file of the given
+// size and returns its inclusive bounds. Multiple ranges aren't supported.
+func parseRange(header string, size int64) (int64, int64, bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") || size == 0 {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(0, size-n), size - 1, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+func (h *Handler) authorize(c *fiber.Ctx, userID string) (*models.MediaFile, error) {
+	media, err := h.service.Get(c.Context(), c.Params("id"))
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := h.service.CanAccess(c.Context(), media, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Don't reveal that the file exists
+		return nil, ErrNotFound
+	}
+
+	return media, nil
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return fiber.StatusNotFound
+	case errors.Is(err, ErrInvalidSignature), errors.Is(err, ErrURLExpired):
+		return fiber.StatusForbidden
+	case errors.Is(err, ErrTooLarge):
+		return fiber.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrTypeNotAllowed), errors.Is(err, ErrTypeMismatch):
+		return fiber.StatusUnsupportedMediaType
+	case errors.Is(err, ErrOffsetMismatch), errors.Is(err, ErrUploadFinished), errors.Is(err, ErrUploadIncomplete),
+		errors.Is(err, ErrProcessing), errors.Is(err, ErrFailed):
+		return fiber.StatusConflict
+	default:
+		return fiber.StatusBadRequest
+	}
+}
@@ -0,0 +1,354 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const thumbnailSize = 320
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// VP8X flags announcing EXIF and XMP chunks
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// sanitizeJPEG removes location data from a JPEG: the EXIF GPS directory is
+// emptied in place and XMP packets, which may repeat it, are dropped. It
+// returns the cleaned bytes, the EXIF orientation and whether anything
+// changed.
+func sanitizeJPEG(data []byte) ([]byte, int, bool) {
+	orientation := 1
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return data, orientation, false
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	changed := false
+
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			break
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan: the rest is entropy-coded image data
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			break
+		}
+		segment := data[pos:end]
+		payload := segment[4:]
+
+		if marker == 0xE1 && bytes.HasPrefix(payload, xmpHeader) {
+			changed = true
+			pos = end
+			continue
+		}
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			cleaned := append([]byte(nil), segment...)
+			tiff := cleaned[4+len(exifHeader):]
+			orientation = exifOrientation(tiff)
+			if stripGPS(tiff) {
+				changed = true
+			}
+			segment = cleaned
+		}
+
+		out = append(out, segment...)
+		pos = end
+	}
+
+	if !changed {
+		return data, orientation, false
+	}
+	return append(out, data[pos:]...), orientation, true
+}
+
+// sanitizePNG drops eXIf chunks, which can carry GPS coordinates
+func sanitizePNG(data []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(data, pngHeader) {
+		return data, false
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, pngHeader...)
+	changed := false
+
+	pos := len(pngHeader)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			break
+		}
+		if string(data[pos+4:pos+8]) == "eXIf" {
+			changed = true
+		} else {
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	if !changed {
+		return data, false
+	}
+	return append(out, data[pos:]...), true
+}
+
+// sanitizeWebP drops EXIF and XMP chunks, which can carry GPS coordinates,
+// and clears the flags announcing them
+func sanitizeWebP(data []byte) ([]byte, bool) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return data, false
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+	changed := false
+
+	pos := 12
+	for pos+8 <= len(data) {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		// Chunks are padded to an even length
+		end := pos + 8 + size + size&1
+		if size < 0 || end > len(data) {
+			if pos+8+size != len(data) {
+				break
+			}
+			end = len(data)
+		}
+
+		switch fourCC := string(data[pos : pos+4]); fourCC {
+		case "EXIF", "XMP ":
+			changed = true
+		case "VP8X":
+			chunk := append([]byte(nil), data[pos:end]...)
+			if size > 0 {
+				chunk[8] &^= webpFlagEXIF | webpFlagXMP
+			}
+			out = append(out, chunk...)
+		default:
+			out = append(out, data[pos:end]...)
+		}
+		pos = end
+	}
+
+	if !changed {
+		return data, false
+	}
+	out = append(out, data[pos:]...)
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, true
+}
+
+// tiffReader reads values from an EXIF TIFF block in its declared byte order
+type tiffReader struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFFReader(data []byte) *tiffReader {
+	if len(data) < 8 {
+		return nil
+	}
+	switch string(data[:2]) {
+	case "II":
+		return &tiffReader{data: data, order: binary.LittleEndian}
+	case "MM":
+		return &tiffReader{data: data, order: binary.BigEndian}
+	}
+	return nil
+}
+
+// entries returns the offsets of the 12-byte entries of the IFD at offset
+func (t *tiffReader) entries(offset uint32) []int {
+	if int(offset)+2 > len(t.data) {
+		return nil
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	var result []int
+	for i := 0; i < count; i++ {
+		at := int(offset) + 2 + i*12
+		if at+12 > len(t.data) {
+			break
+		}
+		result = append(result, at)
+	}
+	return result
+}
+
+func exifOrientation(tiff []byte) int {
+	t := newTIFFReader(tiff)
+	if t == nil {
+		return 1
+	}
+	for _, at := range t.entries(t.order.Uint32(tiff[4:])) {
+		if t.order.Uint16(tiff[at:]) == 0x0112 {
+			if o := int(t.order.Uint16(tiff[at+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// stripGPS zeroes every GPS tag and its out-of-line data, leaving an empty
+// GPS directory so offsets elsewhere in the block stay valid
+func stripGPS(tiff []byte) bool {
+	t := newTIFFReader(tiff)
+	if t == nil {
+		return false
+	}
+
+	var gpsOffset uint32
+	for _, at := range t.entries(t.order.Uint32(tiff[4:])) {
+		if t.order.Uint16(tiff[at:]) == 0x8825 {
+			gpsOffset = t.order.Uint32(tiff[at+8:])
+		}
+	}
+	if gpsOffset == 0 {
+		return false
+	}
+
+	entries := t.entries(gpsOffset)
+	if len(entries) == 0 {
+		return false
+	}
+
+	typeSizes := map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	for _, at := range entries {
+		size := typeSizes[t.order.Uint16(tiff[at+2:])] * int(t.order.Uint32(tiff[at+4:]))
+		if size > 4 {
+			valueAt := int(t.order.Uint32(tiff[at+8:]))
+			if valueAt >= 0 && valueAt+size <= len(tiff) {
+				clear(tiff[valueAt : valueAt+size])
+			}
+		}
+		clear(tiff[at : at+12])
+	}
+	t.order.PutUint16(tiff[gpsOffset:], 0)
+
+	return true
+}
+
+// makeThumbnail scales img to fit within thumbnailSize, applies the EXIF
+// orientation and encodes the result as JPEG
+func makeThumbnail(img image.Image, orientation int) ([]byte, error) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return nil, errUnknownContainer
+	}
+
+	scale := float64(thumbnailSize) / float64(max(w, h))
+	if scale > 1 {
+		scale = 1
+	}
+	tw, th := max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+
+	thumb := reorient(resize(img, tw, th), orientation)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resize downsamples with a box filter, averaging every source pixel that
+// falls inside each destination pixel
+func resize(src image.Image, w, h int) *image.RGBA {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*sh/h
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*sh/h)
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*sw/w
+			x1 := max(x0+1, bounds.Min.X+(x+1)*sw/w)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+
+	return dst
+}
+
+// reorient turns an image stored with the given EXIF orientation upright
+func reorient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90 counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.SetRGBA(dx, dy, src.RGBAAt(x, y))
+		}
+	}
+
+	return dst
+}
+
+// displaySize returns the width and height as seen after orientation
+func displaySize(w, h, orientation int) (int, int) {
+	if orientation >= 5 && orientation <= 8 {
+		return h, w
+	}
+	return w, h
+}
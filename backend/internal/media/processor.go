@@ -0,0 +1,288 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Notifier delivers real-time events to connected users
+type Notifier interface {
+	SendToUser(userID string, message interface{}) error
+}
+
+// errLocationKept means the stored file may still carry location data, so
+// it must not be shared
+var errLocationKept = errors.New("location data could not be removed")
+
+// Processor generates thumbnails and extracts metadata for uploaded images,
+// videos and audio on a fixed number of workers, so slow files never hold up
+// request or WebSocket handling.
+type Processor struct {
+	service  *Service
+	notifier Notifier
+	workers  int
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewProcessor(service *Service, notifier Notifier, workers int) *Processor {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Processor{
+		service:  service,
+		notifier: notifier,
+		workers:  workers,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (p *Processor) Start() {
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+
+	go p.requeuePending()
+}
+
+func (p *Processor) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *Processor) work() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case id := <-p.service.queue:
+			p.process(id)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// requeuePending picks up files left in "processing" by a restart or a
+// full queue
+func (p *Processor) requeuePending() {
+	ctx := context.Background()
+	cursor, err := p.service.db.DB.Collection("media").Find(ctx, bson.M{"status": "processing"})
+	if err != nil {
+		log.Printf("Failed to load pending media: %v", err)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var file models.MediaFile
+		if err := cursor.Decode(&file); err != nil {
+			continue
+		}
+		select {
+		case p.service.queue <- file.ID:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *Processor) process(id primitive.ObjectID) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	file, err := p.service.Get(ctx, id.Hex())
+	if err != nil || file.Status != "processing" {
+		return
+	}
+
+	file.Status = "ready"
+	if err := p.extract(ctx, file); err != nil {
+		if errors.Is(err, errLocationKept) {
+			file.Status = "failed"
+		}
+		// Otherwise the file stays usable; it just lacks a thumbnail or
+		// metadata
+		log.Printf("Media processing failed for %s: %v", id.Hex(), err)
+	}
+
+	file.UpdatedAt = time.Now()
+	update := bson.M{
+		"status":      file.Status,
+		"size":        file.Size,
+		"width":       file.Width,
+		"height":      file.Height,
+		"duration":    file.Duration,
+		"orientation": file.Orientation,
+		"waveform":    file.Waveform,
+		"updated_at":  file.UpdatedAt,
+	}
+	if file.ThumbnailKey != "" {
+		update["thumbnail_key"] = file.ThumbnailKey
+	}
+	if _, err := p.service.db.DB.Collection("media").UpdateOne(ctx, bson.M{"_id": file.ID}, bson.M{"$set": update}); err != nil {
+		log.Printf("Failed to save media metadata for %s: %v", id.Hex(), err)
+		return
+	}
+
+	media := attachment(file)
+
+	// Refresh the copies embedded in messages that were sent meanwhile
+	_, err = p.service.db.DB.Collection("messages").UpdateMany(
+		ctx,
+		bson.M{"media.id": media.ID},
+		bson.M{"$set": bson.M{"media": media}},
+	)
+	if err != nil {
+		log.Printf("Failed to update messages for media %s: %v", id.Hex(), err)
+	}
+
+	p.notify(ctx, file, media)
+}
+
+// extract strips location data and fills in dimensions, duration,
+// orientation, the waveform and the thumbnail
+func (p *Processor) extract(ctx context.Context, file *models.MediaFile) error {
+	reader, err := p.service.store.Get(ctx, file.StorageKey, 0, -1)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, file.Size+1))
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case strings.HasPrefix(file.MimeType, "image/"):
+		return p.extractImage(ctx, file, data)
+	case strings.HasPrefix(file.MimeType, "audio/"):
+		info, err := probeAudio(data)
+		if err != nil {
+			return err
+		}
+		file.Duration = info.Duration
+		file.Waveform = info.Waveform
+	case file.MimeType == "video/webm":
+		info, err := probeWebM(data)
+		if err != nil {
+			return err
+		}
+		applyProbe(file, info)
+	case strings.HasPrefix(file.MimeType, "video/"):
+		// Frames can't be decoded without cgo codecs, so videos get
+		// metadata but no thumbnail
+		info, err := probeMP4(data)
+		if err != nil {
+			return err
+		}
+		applyProbe(file, info)
+	}
+
+	return nil
+}
+
+func (p *Processor) extractImage(ctx context.Context, file *models.MediaFile, data []byte) error {
+	orientation := 1
+	cleaned, changed := data, false
+	switch file.MimeType {
+	case "image/jpeg":
+		cleaned, orientation, changed = sanitizeJPEG(data)
+	case "image/png":
+		cleaned, changed = sanitizePNG(data)
+	case "image/webp":
+		cleaned, changed = sanitizeWebP(data)
+	}
+
+	if changed {
+		if err := p.service.store.Put(ctx, file.StorageKey, bytes.NewReader(cleaned), int64(len(cleaned)), file.MimeType); err != nil {
+			return fmt.Errorf("%w: %v", errLocationKept, err)
+		}
+		file.Size = int64(len(cleaned))
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(cleaned))
+	if err != nil {
+		// Formats without a pure Go decoder, such as WebP
+		return nil
+	}
+	file.Orientation = orientation
+	file.Width, file.Height = displaySize(cfg.Width, cfg.Height, orientation)
+
+	// The header is cheap to forge: a small file can claim a size whose
+	// decoded pixels would exhaust memory
+	if int64(cfg.Width)*int64(cfg.Height) > p.service.pixels {
+		return fmt.Errorf("%dx%d image is too large for a thumbnail", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(cleaned))
+	if err != nil {
+		return err
+	}
+	thumb, err := makeThumbnail(img, orientation)
+	if err != nil {
+		return err
+	}
+
+	key := thumbnailKey(file)
+	if err := p.service.store.Put(ctx, key, bytes.NewReader(thumb), int64(len(thumb)), "image/jpeg"); err != nil {
+		return err
+	}
+	file.ThumbnailKey = key
+
+	return nil
+}
+
+func applyProbe(file *models.MediaFile, info *probe) {
+	file.Duration = info.Duration
+	file.Orientation = info.Orientation
+	file.Width, file.Height = displaySize(info.Width, info.Height, info.Orientation)
+}
+
+// notify sends media_ready to the uploader and to everyone in a
+// conversation where the file has already been shared
+func (p *Processor) notify(ctx context.Context, file *models.MediaFile, media *models.Media) {
+	event := map[string]interface{}{
+		"type":  "media_ready",
+		"media": media,
+	}
+
+	recipients := map[string]bool{file.OwnerID.Hex(): true}
+
+	conversationIDs, err := p.service.db.DB.Collection("messages").Distinct(
+		ctx,
+		"conversation_id",
+		bson.M{"media.id": media.ID, "deleted": bson.M{"$ne": true}},
+	)
+	if err == nil && len(conversationIDs) > 0 {
+		participants, err := p.service.db.DB.Collection("conversations").Distinct(
+			ctx,
+			"participants",
+			bson.M{"_id": bson.M{"$in": conversationIDs}},
+		)
+		if err == nil {
+			for _, participant := range participants {
+				if id, ok := participant.(primitive.ObjectID); ok {
+					recipients[id.Hex()] = true
+				}
+			}
+		}
+	}
+
+	for userID := range recipients {
+		_ = p.notifier.SendToUser(userID, event)
+	}
+}
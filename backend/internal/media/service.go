@@ -0,0 +1,640 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/storage"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrNotFound         = errors.New("media not found")
+	ErrTooLarge         = errors.New("file exceeds the maximum upload size")
+	ErrTypeNotAllowed   = errors.New("file type is not allowed")
+	ErrTypeMismatch     = errors.New("file content does not match its declared type")
+	ErrOffsetMismatch   = errors.New("upload offset does not match the bytes received so far")
+	ErrUploadFinished   = errors.New("upload is already complete")
+	ErrUploadIncomplete = errors.New("upload is not complete")
+	ErrProcessing       = errors.New("media is still being processed")
+	ErrFailed           = errors.New("media could not be processed")
+)
+
+// sniffAliases lists the declared types accepted for content that
+// http.DetectContentType reports under a different name
+var sniffAliases = map[string][]string{
+	"application/ogg": {"audio/ogg", "video/ogg"},
+	"video/webm":      {"audio/webm"},
+	"video/mp4":       {"audio/mp4", "audio/x-m4a"},
+	"audio/wave":      {"audio/wav", "audio/x-wav"},
+}
+
+type Service struct {
+	db      *database.Database
+	store   storage.BlobStore
+	maxSize int64
+	pixels  int64 // most pixels an image may have to be decoded
+	allowed map[string]bool
+	queue   chan primitive.ObjectID
+	signer  *Signer
+}
+
+func NewService(db *database.Database, store storage.BlobStore, cfg *config.Config) *Service {
+	allowed := make(map[string]bool, len(cfg.MediaAllowedTypes))
+	for _, t := range cfg.MediaAllowedTypes {
+		allowed[t] = true
+	}
+
+	return &Service{
+		db:      db,
+		store:   store,
+		maxSize: cfg.MediaMaxSize,
+		pixels:  cfg.MediaMaxPixels,
+		allowed: allowed,
+		queue:   make(chan primitive.ObjectID, cfg.MediaQueueSize),
+		signer:  NewSigner(cfg.JWTSecret, cfg.MediaURLTTL),
+	}
+}
+
+// Upload stores a complete file received in a single request
+func (s *Service) Upload(ctx context.Context, ownerID, fileName, mimeType string, size int64, r io.Reader) (*models.MediaFile, error) {
+	uid, err := primitive.ObjectIDFromHex(ownerID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	if size <= 0 {
+		return nil, errors.New("file is empty")
+	}
+	if size > s.maxSize {
+		return nil, ErrTooLarge
+	}
+
+	br := bufio.NewReaderSize(r, 512)
+	head, _ := br.Peek(512)
+	mimeType, err = s.checkType(mimeType, head)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	file := &models.MediaFile{
+		ID:            primitive.NewObjectID(),
+		OwnerID:       uid,
+		FileName:      fileName,
+		MimeType:      mimeType,
+		Size:          size,
+		UploadedBytes: size,
+		Status:        initialStatus(mimeType),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	file.StorageKey = storageKey(file)
+
+	if err := s.store.Put(ctx, file.StorageKey, io.LimitReader(br, size), size, mimeType); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.db.DB.Collection("media").InsertOne(ctx, file); err != nil {
+		_ = s.store.Delete(ctx, file.StorageKey)
+		return nil, err
+	}
+
+	s.enqueue(ctx, file)
+
+	return file, nil
+}
+
+// CreateUpload starts a resumable upload whose bytes arrive through AppendChunk
+func (s *Service) CreateUpload(ctx context.Context, ownerID, fileName, mimeType string, size int64) (*models.MediaFile, error) {
+	uid, err := primitive.ObjectIDFromHex(ownerID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	if size <= 0 {
+		return nil, errors.New("size is required")
+	}
+	if size > s.maxSize {
+		return nil, ErrTooLarge
+	}
+
+	mimeType = normalizeType(mimeType)
+	if !s.allowed[mimeType] {
+		return nil, ErrTypeNotAllowed
+	}
+
+	now := time.Now()
+	file := &models.MediaFile{
+		ID:        primitive.NewObjectID(),
+		OwnerID:   uid,
+		FileName:  fileName,
+		MimeType:  mimeType,
+		Size:      size,
+		Status:    "uploading",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	file.StorageKey = storageKey(file)
+
+	if _, err := s.db.DB.Collection("media").InsertOne(ctx, file); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// AppendChunk stores the next chunk of a resumable upload. Chunks must
+// arrive in order; offset is the number of bytes the client believes were
+// already received. The final chunk assembles the file.
+func (s *Service) AppendChunk(ctx context.Context, uploadID, ownerID string, offset int64, r io.Reader, length int64) (*models.MediaFile, error) {
+	file, err := s.GetUpload(ctx, uploadID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	if file.Status != "uploading" {
+		return nil, ErrUploadFinished
+	}
+	if offset != file.UploadedBytes {
+		return nil, ErrOffsetMismatch
+	}
+	if length <= 0 {
+		return nil, errors.New("chunk is empty")
+	}
+	if offset+length > file.Size {
+		return nil, ErrTooLarge
+	}
+
+	if offset == 0 {
+		br := bufio.NewReaderSize(r, 512)
+		head, _ := br.Peek(512)
+		if _, err := s.checkType(file.MimeType, head); err != nil {
+			return nil, err
+		}
+		r = br
+	}
+
+	// Each attempt writes its own blob, so a concurrent chunk for the same
+	// offset can't overwrite it and the loser only deletes what it wrote
+	key := newPartKey(file, file.Parts)
+	if err := s.store.Put(ctx, key, io.LimitReader(r, length), length, "application/octet-stream"); err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.DB.Collection("media").UpdateOne(
+		ctx,
+		bson.M{"_id": file.ID, "uploaded_bytes": offset, "parts": file.Parts},
+		bson.M{
+			"$inc":  bson.M{"uploaded_bytes": length, "parts": 1},
+			"$push": bson.M{"part_keys": key},
+			"$set":  bson.M{"updated_at": time.Now()},
+		},
+	)
+	if err != nil {
+		_ = s.store.Delete(ctx, key)
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		_ = s.store.Delete(ctx, key)
+		return nil, ErrOffsetMismatch
+	}
+
+	file.UploadedBytes += length
+	file.Parts++
+	file.PartKeys = append(file.PartKeys, key)
+
+	if file.UploadedBytes == file.Size {
+		if err := s.completeUpload(ctx, file); err != nil {
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+// completeUpload concatenates the stored parts into the final blob
+func (s *Service) completeUpload(ctx context.Context, file *models.MediaFile) error {
+	parts := &partsReader{ctx: ctx, store: s.store, file: file}
+	err := s.store.Put(ctx, file.StorageKey, parts, file.Size, file.MimeType)
+	parts.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range file.PartKeys {
+		if err := s.store.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete upload part %s: %v", key, err)
+		}
+	}
+
+	file.Status = initialStatus(file.MimeType)
+	file.UpdatedAt = time.Now()
+	_, err = s.db.DB.Collection("media").UpdateOne(
+		ctx,
+		bson.M{"_id": file.ID},
+		bson.M{"$set": bson.M{"status": file.Status, "updated_at": file.UpdatedAt}},
+	)
+	if err != nil {
+		return err
+	}
+
+	s.enqueue(ctx, file)
+
+	return nil
+}
+
+// enqueue hands a file to the processing workers. When the queue stays
+// full the file is left in "processing" and picked up on the next start.
+func (s *Service) enqueue(ctx context.Context, file *models.MediaFile) {
+	if file.Status != "processing" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	select {
+	case s.queue <- file.ID:
+	case <-ctx.Done():
+		log.Printf("Media processing queue full, deferring %s", file.ID.Hex())
+	}
+}
+
+// GetUpload returns a media file owned by the user
+func (s *Service) GetUpload(ctx context.Context, uploadID, ownerID string) (*models.MediaFile, error) {
+	file, err := s.Get(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if file.OwnerID.Hex() != ownerID {
+		return nil, ErrNotFound
+	}
+	return file, nil
+}
+
+func (s *Service) Get(ctx context.Context, mediaID string) (*models.MediaFile, error) {
+	id, err := primitive.ObjectIDFromHex(mediaID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	var file models.MediaFile
+	if err := s.db.DB.Collection("media").FindOne(ctx, bson.M{"_id": id}).Decode(&file); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &file, nil
+}
+
+// Resolve returns the message attachment for an uploaded file. Only the
+// uploader can attach a file, and only once it has been fully received.
+func (s *Service) Resolve(ctx context.Context, mediaID, userID string) (*models.Media, error) {
+	file, err := s.GetUpload(ctx, mediaID, userID)
+	if err != nil {
+		return nil, err
+	}
+	switch file.Status {
+	case "uploading":
+		return nil, ErrUploadIncomplete
+	case "failed":
+		return nil, ErrFailed
+	}
+
+	return attachment(file), nil
+}
+
+// attachment builds the message attachment describing a file
+func attachment(file *models.MediaFile) *models.Media {
+	media := &models.Media{
+		ID:          file.ID.Hex(),
+		URL:         contentURL(file.ID.Hex()),
+		Size:        file.Size,
+		MimeType:    file.MimeType,
+		FileName:    file.FileName,
+		Status:      file.Status,
+		Width:       file.Width,
+		Height:      file.Height,
+		Duration:    file.Duration,
+		Orientation: file.Orientation,
+		Waveform:    file.Waveform,
+	}
+	if file.ThumbnailKey != "" {
+		media.Thumbnail = thumbnailURL(file.ID.Hex())
+	}
+	return media
+}
+
+// CanAccess reports whether the user uploaded the file or participates in
+// a conversation where it was shared
+func (s *Service) CanAccess(ctx context.Context, file *models.MediaFile, userID string) (bool, error) {
+	if file.OwnerID.Hex() == userID {
+		return true, nil
+	}
+
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return false, nil
+	}
+
+	conversationIDs, err := s.db.DB.Collection("messages").Distinct(
+		ctx,
+		"conversation_id",
+		bson.M{"media.id": file.ID.Hex(), "deleted": bson.M{"$ne": true}, "deleted_for": bson.M{"$ne": uid}},
+	)
+	if err != nil || len(conversationIDs) == 0 {
+		return false, err
+	}
+
+	count, err := s.db.DB.Collection("conversations").CountDocuments(
+		ctx,
+		bson.M{"_id": bson.M{"$in": conversationIDs}, "participants": uid},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+type SignedURLs struct {
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// SignURLs issues expiring URLs for a file as seen from one conversation.
+// Without a conversation only the uploader can get URLs, e.g. to preview
+// a file before sending it.
+func (s *Service) SignURLs(ctx context.Context, mediaID, userID, conversationID string) (*SignedURLs, error) {
+	file, err := s.Get(ctx, mediaID)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.canAccessIn(ctx, file, userID, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	grant := &Grant{MediaID: mediaID, Variant: "content", ConversationID: conversationID, UserID: userID}
+	urls := &SignedURLs{URL: s.signer.URL(grant), ExpiresAt: grant.ExpiresAt}
+	if file.ThumbnailKey != "" {
+		thumb := *grant
+		thumb.Variant = "thumbnail"
+		urls.ThumbnailURL = s.signer.URL(&thumb)
+	}
+
+	return urls, nil
+}
+
+// AuthorizeSigned verifies a signed URL and re-checks, at request time,
+// that its user may still see the file in its conversation. Deleting the
+// message for everyone or leaving the conversation revokes the URL.
+func (s *Service) AuthorizeSigned(ctx context.Context, mediaID, variant string, query url.Values) (*models.MediaFile, *Grant, error) {
+	grant, err := s.signer.Verify(mediaID, variant, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := s.Get(ctx, mediaID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ok, err := s.canAccessIn(ctx, file, grant.UserID, grant.ConversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+
+	return file, grant, nil
+}
+
+// canAccessIn reports whether the user participates in the conversation
+// and the file was shared there in a message that is still visible to them
+func (s *Service) canAccessIn(ctx context.Context, file *models.MediaFile, userID, conversationID string) (bool, error) {
+	if conversationID == "" {
+		return file.OwnerID.Hex() == userID, nil
+	}
+
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return false, nil
+	}
+	convID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return false, nil
+	}
+
+	count, err := s.db.DB.Collection("conversations").CountDocuments(
+		ctx,
+		bson.M{"_id": convID, "participants": uid},
+		options.Count().SetLimit(1),
+	)
+	if err != nil || count == 0 {
+		return false, err
+	}
+
+	count, err = s.db.DB.Collection("messages").CountDocuments(
+		ctx,
+		bson.M{
+			"conversation_id": convID,
+			"media.id":        file.ID.Hex(),
+			"deleted":         bson.M{"$ne": true},
+			"deleted_for":     bson.M{"$ne": uid},
+		},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Open reads the stored bytes of a file. Until processing has removed
+// location metadata, only the uploader may read it; if that failed, it
+// stays that way.
+func (s *Service) Open(ctx context.Context, file *models.MediaFile, userID string, offset, length int64) (io.ReadCloser, error) {
+	switch {
+	case file.Status == "uploading":
+		return nil, ErrUploadIncomplete
+	case file.Status == "processing" && file.OwnerID.Hex() != userID:
+		return nil, ErrProcessing
+	case file.Status == "failed" && file.OwnerID.Hex() != userID:
+		return nil, ErrFailed
+	}
+	return s.store.Get(ctx, file.StorageKey, offset, length)
+}
+
+// OpenThumbnail reads the generated thumbnail of a file
+func (s *Service) OpenThumbnail(ctx context.Context, file *models.MediaFile) (io.ReadCloser, error) {
+	if file.ThumbnailKey == "" {
+		return nil, ErrNotFound
+	}
+	return s.store.Get(ctx, file.ThumbnailKey, 0, -1)
+}
+
+// checkType validates the declared MIME type against the allow list and
+// the sniffed content. An empty declared type falls back to the sniffed one.
+func (s *Service) checkType(declared string, head []byte) (string, error) {
+	sniffed := normalizeType(http.DetectContentType(head))
+	declared = normalizeType(declared)
+	if declared == "" || declared == "application/octet-stream" {
+		declared = sniffed
+	}
+
+	if !s.allowed[declared] {
+		return "", ErrTypeNotAllowed
+	}
+	if !contentMatches(declared, sniffed) {
+		return "", ErrTypeMismatch
+	}
+	if container, ok := audioContainers[declared]; ok && audioContainer(head) != container {
+		return "", ErrTypeMismatch
+	}
+
+	return declared, nil
+}
+
+// contentMatches reports whether sniffed content is consistent with the
+// declared type. Media types must be positively identified; other types
+// only need to not look like something else entirely.
+func contentMatches(declared, sniffed string) bool {
+	if declared == sniffed {
+		return true
+	}
+	for _, alias := range sniffAliases[sniffed] {
+		if alias == declared {
+			return true
+		}
+	}
+
+	declaredFamily := strings.SplitN(declared, "/", 2)[0]
+	sniffedFamily := strings.SplitN(sniffed, "/", 2)[0]
+
+	switch declaredFamily {
+	case "image", "audio", "video":
+		// DetectContentType cannot identify every codec; accept a generic
+		// result only for types it has no signature for.
+		if sniffed == "application/octet-stream" {
+			return declared == "image/webp" || declared == "video/quicktime" ||
+				declared == "audio/mp4" || declared == "audio/webm"
+		}
+		return declaredFamily == sniffedFamily
+	}
+
+	return sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain")
+}
+
+func normalizeType(t string) string {
+	if t == "" {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(t))
+	}
+	return mediaType
+}
+
+func storageKey(file *models.MediaFile) string {
+	return fmt.Sprintf("media/%s/%s", file.OwnerID.Hex(), file.ID.Hex())
+}
+
+// newPartKey names the blob for one attempt at storing a part
+func newPartKey(file *models.MediaFile, index int) string {
+	return fmt.Sprintf("uploads/%s/%06d-%s", file.ID.Hex(), index, primitive.NewObjectID().Hex())
+}
+
+func thumbnailKey(file *models.MediaFile) string {
+	return fmt.Sprintf("thumbnails/%s/%s.jpg", file.OwnerID.Hex(), file.ID.Hex())
+}
+
+func contentURL(mediaID string) string {
+	return "/api/media/" + mediaID + "/content"
+}
+
+func thumbnailURL(mediaID string) string {
+	return "/api/media/" + mediaID + "/thumbnail"
+}
+
+// initialStatus marks images, videos and audio for processing: image
+// thumbnails and location stripping, video metadata, and audio durations
+// and waveforms. Everything else is usable as soon as it is stored.
+func initialStatus(mimeType string) string {
+	if strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "video/") ||
+		strings.HasPrefix(mimeType, "audio/") {
+		return "processing"
+	}
+	return "ready"
+}
+
+// partsReader streams the parts of a resumable upload one after another,
+// opening each only when the previous one is exhausted
+type partsReader struct {
+	ctx     context.Context
+	store   storage.BlobStore
+	file    *models.MediaFile
+	index   int
+	current io.ReadCloser
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.current == nil {
+			if p.index >= len(p.file.PartKeys) {
+				return 0, io.EOF
+			}
+			rc, err := p.store.Get(p.ctx, p.file.PartKeys[p.index], 0, -1)
+			if err != nil {
+				return 0, err
+			}
+			p.current = rc
+			p.index++
+		}
+
+		n, err := p.current.Read(b)
+		if err == io.EOF {
+			p.current.Close()
+			p.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.current != nil {
+		return p.current.Close()
+	}
+	return nil
+}
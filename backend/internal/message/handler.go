@@ -1,7 +1,11 @@
 package message
 
 import (
+	"errors"
+	"time"
+
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -26,6 +30,7 @@ type SendMessageRequest struct {
 	RecipientID string `json:"recipient_id"`
 	Content     string `json:"content"`
 	Type        string `json:"type"`
+	MediaID     string `json:"media_id,omitempty"`
 }
 
 func (h *Handler) Send(c *fiber.Ctx) error {
@@ -60,6 +65,14 @@ func (h *Handler) Send(c *fiber.Ctx) error {
 		},
 	}
 
+	if req.MediaID != "" {
+		if err := h.service.AttachMedia(c.Context(), message, req.MediaID); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
 	if err := h.service.CreateMessage(c.Context(), message); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
@@ -72,6 +85,12 @@ func (h *Handler) Send(c *fiber.Ctx) error {
 		"message": message,
 	})
 
+	// Keep the sender's devices in sync
+	_ = h.wsManager.SendToUser(userID, map[string]interface{}{
+		"type":    "message_sent_elsewhere",
+		"message": message,
+	})
+
 	return c.Status(fiber.StatusCreated).JSON(message)
 }
 
@@ -103,6 +122,126 @@ func (h *Handler) GetMessages(c *fiber.Ctx) error {
 	return c.JSON(messages)
 }
 
+func (h *Handler) Search(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	opts := SearchOptions{
+		Query:          c.Query("q"),
+		ConversationID: c.Query("conversation_id"),
+		SenderID:       c.Query("sender_id"),
+		Type:           c.Query("type"),
+		Limit:          int64(c.QueryInt("limit", defaultSearchLimit)),
+		Skip:           int64(c.QueryInt("skip", 0)),
+	}
+
+	if opts.Query == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "search query is required",
+		})
+	}
+
+	var err error
+	if from := c.Query("from"); from != "" {
+		if opts.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid from date, expected RFC3339",
+			})
+		}
+	}
+	if to := c.Query("to"); to != "" {
+		if opts.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid to date, expected RFC3339",
+			})
+		}
+	}
+
+	results, err := h.service.SearchMessages(c.Context(), userID, opts)
+	if err != nil {
+		var fields validation.Errors
+		if errors.As(err, &fields) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":  err.Error(),
+				"fields": fields,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(results)
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content"`
+}
+
+func (h *Handler) Edit(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	messageID := c.Params("id")
+
+	var req EditMessageRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	message, err := h.service.EditMessage(c.Context(), messageID, userID, req.Content)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	h.notifyParticipants(c, message, userID, map[string]interface{}{
+		"type":    "message_updated",
+		"message": message,
+	})
+
+	return c.JSON(message)
+}
+
+func (h *Handler) Delete(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+	messageID := c.Params("id")
+	forEveryone := c.Query("for") == "everyone"
+
+	message, err := h.service.DeleteMessage(c.Context(), messageID, userID, forEveryone)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if forEveryone {
+		h.notifyParticipants(c, message, userID, map[string]interface{}{
+			"type":            "message_deleted",
+			"message_id":      message.ID.Hex(),
+			"conversation_id": message.ConversationID.Hex(),
+		})
+	}
+
+	return c.JSON(fiber.Map{"message": "message deleted successfully"})
+}
+
+// notifyParticipants pushes an event to every participant of the message's
+// conversation except the user who triggered it
+func (h *Handler) notifyParticipants(c *fiber.Ctx, message *models.Message, userID string, event interface{}) {
+	conversation, err := h.service.GetConversation(c.Context(), message.ConversationID.Hex(), userID)
+	if err != nil {
+		return
+	}
+
+	for _, participant := range conversation.Participants {
+		if participant.Hex() == userID {
+			continue
+		}
+		_ = h.wsManager.SendToUser(participant.Hex(), event)
+	}
+}
+
 type UpdateStatusRequest struct {
 	Status string `json:"status"`
 }
@@ -119,7 +258,11 @@ func (h *Handler) UpdateStatus(c *fiber.Ctx) error {
 	}
 
 	if err := h.service.UpdateStatus(c.Context(), messageID, userID, req.Status); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		status := fiber.StatusInternalServerError
+		if errors.Is(err, ErrInvalidMessageID) || errors.Is(err, ErrInvalidStatus) {
+			status = fiber.StatusBadRequest
+		}
+		return c.Status(status).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
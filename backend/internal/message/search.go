@@ -0,0 +1,204 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/search"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+type SearchOptions struct {
+	Query          string
+	ConversationID string
+	SenderID       string
+	Type           string
+	From           time.Time
+	To             time.Time
+	Limit          int64
+	Skip           int64
+}
+
+type SearchHit struct {
+	Message    *models.Message    `json:"message"`
+	Snippet    string             `json:"snippet"`
+	Highlights []search.Highlight `json:"highlights"`
+	Score      float64            `json:"score"`
+}
+
+type SearchResults struct {
+	Results []*SearchHit `json:"results"`
+	Total   int64        `json:"total"`
+	Limit   int64        `json:"limit"`
+	Skip    int64        `json:"skip"`
+	HasMore bool         `json:"has_more"`
+}
+
+// SearchMessages runs a full-text search over the conversations the user
+// participates in. Messages deleted for everyone, deleted for this user or
+// past their disappearing-message expiry are never returned.
+func (s *Service) SearchMessages(ctx context.Context, userID string, opts SearchOptions) (*SearchResults, error) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	opts.Query = strings.TrimSpace(opts.Query)
+	if opts.Query == "" {
+		return nil, validation.Errors{"q": "search query is required"}
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultSearchLimit
+	}
+	if opts.Limit > maxSearchLimit {
+		opts.Limit = maxSearchLimit
+	}
+	if opts.Skip < 0 {
+		opts.Skip = 0
+	}
+
+	conversationIDs, err := s.searchableConversations(ctx, uid, opts.ConversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	results := &SearchResults{Results: []*SearchHit{}, Limit: opts.Limit, Skip: opts.Skip}
+	if len(conversationIDs) == 0 {
+		return results, nil
+	}
+
+	if opts.SenderID != "" {
+		if _, err := primitive.ObjectIDFromHex(opts.SenderID); err != nil {
+			return nil, validation.Errors{"sender_id": "invalid sender ID"}
+		}
+	}
+
+	query := &search.Query{
+		Text:     opts.Query,
+		UserID:   userID,
+		SenderID: opts.SenderID,
+		Type:     opts.Type,
+		From:     opts.From,
+		To:       opts.To,
+		Limit:    int(opts.Limit),
+		Skip:     int(opts.Skip),
+	}
+	for _, id := range conversationIDs {
+		query.ConversationIDs = append(query.ConversationIDs, id.Hex())
+	}
+
+	found, err := s.indexer.Search(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(found.Hits) == 0 {
+		results.Total = int64(found.Total)
+		return results, nil
+	}
+
+	// Load the hits, re-checking visibility in case the index lags behind
+	hitIDs := make([]primitive.ObjectID, 0, len(found.Hits))
+	for _, hit := range found.Hits {
+		if id, err := primitive.ObjectIDFromHex(hit.MessageID); err == nil {
+			hitIDs = append(hitIDs, id)
+		}
+	}
+
+	filter := visibleTo(uid, time.Now())
+	filter["_id"] = bson.M{"$in": hitIDs}
+	filter["conversation_id"] = bson.M{"$in": conversationIDs}
+
+	cursor, err := s.db.DB.Collection("messages").Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	messages := make(map[string]*models.Message, len(hitIDs))
+	for cursor.Next(ctx) {
+		var msg models.Message
+		if err := cursor.Decode(&msg); err != nil {
+			continue
+		}
+		messages[msg.ID.Hex()] = &msg
+	}
+
+	for _, hit := range found.Hits {
+		msg, ok := messages[hit.MessageID]
+		if !ok {
+			continue
+		}
+		snippet, highlights := search.Snippet(msg.Content, opts.Query)
+		results.Results = append(results.Results, &SearchHit{
+			Message:    msg,
+			Snippet:    snippet,
+			Highlights: highlights,
+			Score:      hit.Score,
+		})
+	}
+
+	results.Total = int64(found.Total)
+	results.HasMore = opts.Skip+int64(len(found.Hits)) < results.Total
+
+	return results, nil
+}
+
+// searchableConversations returns the conversations the user participates in,
+// narrowed to a single conversation when one is requested.
+func (s *Service) searchableConversations(ctx context.Context, uid primitive.ObjectID, conversationID string) ([]primitive.ObjectID, error) {
+	filter := bson.M{"participants": uid}
+	if conversationID != "" {
+		convID, err := primitive.ObjectIDFromHex(conversationID)
+		if err != nil {
+			return nil, validation.Errors{"conversation_id": "invalid conversation ID"}
+		}
+		filter["_id"] = convID
+	}
+
+	cursor, err := s.db.DB.Collection("conversations").Find(
+		ctx,
+		filter,
+		options.Find().SetProjection(bson.M{"_id": 1}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var ids []primitive.ObjectID
+	for cursor.Next(ctx) {
+		var conv struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := cursor.Decode(&conv); err != nil {
+			continue
+		}
+		ids = append(ids, conv.ID)
+	}
+
+	if conversationID != "" && len(ids) == 0 {
+		return nil, errors.New("conversation not found")
+	}
+
+	return ids, nil
+}
+
+// visibleTo builds the filter for messages the user is still allowed to see
+func visibleTo(uid primitive.ObjectID, now time.Time) bson.M {
+	return bson.M{
+		"deleted":     bson.M{"$ne": true},
+		"deleted_for": bson.M{"$ne": uid},
+		"expires_at":  bson.M{"$not": bson.M{"$lte": now}},
+	}
+}
@@ -3,9 +3,12 @@ package message
 import (
 	"context"
 	"errors"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/search"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -13,12 +16,31 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+var (
+	ErrInvalidMessageID = errors.New("invalid message ID")
+	ErrInvalidStatus    = errors.New("invalid status")
+)
+
 type Service struct {
-	db *database.Database
+	db       *database.Database
+	indexer  search.Indexer
+	media    MediaResolver
+	previews LinkPreviewer
 }
 
-func NewService(db *database.Database) *Service {
-	return &Service{db: db}
+// MediaResolver turns an uploaded media ID into a message attachment
+type MediaResolver interface {
+	Resolve(ctx context.Context, mediaID, userID string) (*models.Media, error)
+}
+
+// LinkPreviewer attaches a preview to messages containing a URL, in the
+// background
+type LinkPreviewer interface {
+	Enqueue(msg *models.Message)
+}
+
+func NewService(db *database.Database, indexer search.Indexer, media MediaResolver, previews LinkPreviewer) *Service {
+	return &Service{db: db, indexer: indexer, media: media, previews: previews}
 }
 
 func (s *Service) CreateMessage(ctx context.Context, msg *models.Message) error {
@@ -35,9 +57,177 @@ func (s *Service) CreateMessage(ctx context.Context, msg *models.Message) error
 	// Update conversation's last message
 	_ = s.updateConversationLastMessage(ctx, msg)
 
+	s.index(ctx, msg)
+	s.previews.Enqueue(msg)
+
+	return nil
+}
+
+// AttachMedia populates msg.Media from a file the sender uploaded and
+// derives the message type from its MIME type when none was given
+func (s *Service) AttachMedia(ctx context.Context, msg *models.Message, mediaID string) error {
+	media, err := s.media.Resolve(ctx, mediaID, msg.SenderID.Hex())
+	if err != nil {
+		return err
+	}
+
+	msg.Media = media
+	if msg.Type == "" || msg.Type == "text" {
+		switch {
+		case strings.HasPrefix(media.MimeType, "image/"):
+			msg.Type = "image"
+		case strings.HasPrefix(media.MimeType, "video/"):
+			msg.Type = "video"
+		case strings.HasPrefix(media.MimeType, "audio/"):
+			msg.Type = "audio"
+		default:
+			msg.Type = "file"
+		}
+	}
+
 	return nil
 }
 
+// EditMessage replaces the content of a text message. Only the sender may
+// edit, and messages deleted for everyone can no longer be changed.
+func (s *Service) EditMessage(ctx context.Context, messageID, userID, content string) (*models.Message, error) {
+	msgID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrInvalidMessageID
+	}
+
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	if content == "" {
+		return nil, errors.New("content is required")
+	}
+
+	now := time.Now()
+	var msg models.Message
+	err = s.db.DB.Collection("messages").FindOneAndUpdate(
+		ctx,
+		bson.M{
+			"_id":       msgID,
+			"sender_id": uid,
+			"type":      "text",
+			"deleted":   bson.M{"$ne": true},
+		},
+		bson.M{
+			"$set":   bson.M{"content": content, "edited_at": now},
+			"$unset": bson.M{"link_preview": ""},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&msg)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.New("message not found")
+		}
+		return nil, err
+	}
+
+	s.index(ctx, &msg)
+	s.previews.Enqueue(&msg)
+
+	return &msg, nil
+}
+
+// DeleteMessage hides a message for the requesting participant, or removes
+// it for everyone when the sender asks for it.
+func (s *Service) DeleteMessage(ctx context.Context, messageID, userID string, forEveryone bool) (*models.Message, error) {
+	msgID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrInvalidMessageID
+	}
+
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	var msg models.Message
+	if err := s.db.DB.Collection("messages").FindOne(ctx, bson.M{"_id": msgID}).Decode(&msg); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.New("message not found")
+		}
+		return nil, err
+	}
+
+	if _, err := s.GetConversation(ctx, msg.ConversationID.Hex(), userID); err != nil {
+		return nil, errors.New("message not found")
+	}
+
+	var update bson.M
+	if forEveryone {
+		if msg.SenderID != uid {
+			return nil, errors.New("only the sender can delete a message for everyone")
+		}
+		update = bson.M{
+			"$set":   bson.M{"deleted": true, "content": ""},
+			"$unset": bson.M{"media": "", "link_preview": ""},
+		}
+	} else {
+		update = bson.M{"$addToSet": bson.M{"deleted_for": uid}}
+	}
+
+	err = s.db.DB.Collection("messages").FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": msgID},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Deleted {
+		if err := s.indexer.Delete(ctx, msg.ID.Hex()); err != nil {
+			log.Printf("Failed to remove message %s from search index: %v", msg.ID.Hex(), err)
+		}
+		if err := s.clearLastMessage(ctx, &msg); err != nil {
+			log.Printf("Failed to clear last message of conversation %s: %v", msg.ConversationID.Hex(), err)
+		}
+	} else {
+		s.index(ctx, &msg)
+	}
+
+	return &msg, nil
+}
+
+// GetConversation returns a conversation the user participates in
+func (s *Service) GetConversation(ctx context.Context, conversationID, userID string) (*models.Conversation, error) {
+	convID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return nil, errors.New("invalid conversation ID")
+	}
+
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	var conversation models.Conversation
+	err = s.db.DB.Collection("conversations").FindOne(ctx, bson.M{"_id": convID, "participants": uid}).Decode(&conversation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.New("conversation not found")
+		}
+		return nil, err
+	}
+
+	return &conversation, nil
+}
+
+// index feeds a message to the search backend. Indexing failures are logged
+// rather than returned so a lagging index never blocks messaging.
+func (s *Service) index(ctx context.Context, msg *models.Message) {
+	if err := s.indexer.Index(ctx, search.DocumentFromMessage(msg)); err != nil {
+		log.Printf("Failed to index message %s: %v", msg.ID.Hex(), err)
+	}
+}
+
 func (s *Service) GetMessages(ctx context.Context, conversationID string, limit int64, skip int64) ([]*models.Message, error) {
 	convID, err := primitive.ObjectIDFromHex(conversationID)
 	if err != nil {
@@ -76,10 +266,13 @@ func (s *Service) GetMessages(ctx context.Context, conversationID string, limit
 	return messages, nil
 }
 
+// statusRank orders delivery statuses; a recipient's status only moves up
+var statusRank = map[string]int{"sent": 0, "delivered": 1, "read": 2, "played": 3}
+
 func (s *Service) UpdateStatus(ctx context.Context, messageID, userID, status string) error {
 	msgID, err := primitive.ObjectIDFromHex(messageID)
 	if err != nil {
-		return errors.New("invalid message ID")
+		return ErrInvalidMessageID
 	}
 
 	uid, err := primitive.ObjectIDFromHex(userID)
@@ -87,12 +280,34 @@ func (s *Service) UpdateStatus(ctx context.Context, messageID, userID, status st
 		return errors.New("invalid user ID")
 	}
 
-	// Update the specific user's delivery status
-	_, err = s.db.DB.Collection("messages").UpdateOne(
+	// Playback only counts for voice notes, which MarkPlayed checks
+	if _, ok := statusRank[status]; !ok || status == "played" {
+		return ErrInvalidStatus
+	}
+
+	return s.setStatus(ctx, msgID, uid, status)
+}
+
+// setStatus moves a recipient's delivery status up to status
+func (s *Service) setStatus(ctx context.Context, msgID, uid primitive.ObjectID, status string) error {
+	rank := statusRank[status]
+	var lower []string
+	for name, r := range statusRank {
+		if r < rank {
+			lower = append(lower, name)
+		}
+	}
+
+	// Update the specific user's delivery status, unless it is already
+	// further along (a late read receipt must not undo "played")
+	_, err := s.db.DB.Collection("messages").UpdateOne(
 		ctx,
 		bson.M{
-			"_id":                     msgID,
-			"delivery_status.user_id": uid,
+			"_id": msgID,
+			"delivery_status": bson.M{"$elemMatch": bson.M{
+				"user_id": uid,
+				"status":  bson.M{"$in": lower},
+			}},
 		},
 		bson.M{
 			"$set": bson.M{
@@ -109,6 +324,40 @@ func (s *Service) UpdateStatus(ctx context.Context, messageID, userID, status st
 	return s.updateOverallStatus(ctx, msgID)
 }
 
+// MarkPlayed records that a recipient listened to a voice note and returns
+// the message so the sender can be told
+func (s *Service) MarkPlayed(ctx context.Context, messageID, userID string) (*models.Message, error) {
+	msgID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrInvalidMessageID
+	}
+
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	var msg models.Message
+	err = s.db.DB.Collection("messages").FindOne(ctx, bson.M{
+		"_id":                     msgID,
+		"type":                    "audio",
+		"delivery_status.user_id": uid,
+		"deleted":                 bson.M{"$ne": true},
+	}).Decode(&msg)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, errors.New("message not found")
+		}
+		return nil, err
+	}
+
+	if err := s.setStatus(ctx, msgID, uid, "played"); err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
 // updateOverallStatus calculates and updates the top-level status field based on all delivery statuses
 func (s *Service) updateOverallStatus(ctx context.Context, messageID primitive.ObjectID) error {
 	var msg models.Message
@@ -132,7 +381,7 @@ func (s *Service) updateOverallStatus(ctx context.Context, messageID primitive.O
 
 // calculateOverallStatus determines the overall status based on all recipients' statuses
 // For group chats: returns the "lowest" status (if any is "sent", return "sent", etc.)
-// Status hierarchy: sent < delivered < read
+// Status hierarchy: sent < delivered < read < played
 func (s *Service) calculateOverallStatus(deliveryStatuses []models.DeliveryStatus) string {
 	if len(deliveryStatuses) == 0 {
 		return "sent"
@@ -142,6 +391,7 @@ func (s *Service) calculateOverallStatus(deliveryStatuses []models.DeliveryStatu
 	hasSent := false
 	hasDelivered := false
 	hasRead := false
+	hasPlayed := false
 
 	for _, ds := range deliveryStatuses {
 		switch ds.Status {
@@ -151,6 +401,8 @@ func (s *Service) calculateOverallStatus(deliveryStatuses []models.DeliveryStatu
 			hasDelivered = true
 		case "read":
 			hasRead = true
+		case "played":
+			hasPlayed = true
 		}
 	}
 
@@ -164,6 +416,9 @@ func (s *Service) calculateOverallStatus(deliveryStatuses []models.DeliveryStatu
 	if hasRead {
 		return "read"
 	}
+	if hasPlayed {
+		return "played"
+	}
 
 	return "sent"
 }
@@ -319,8 +574,31 @@ func (s *Service) GetQueuedMessages(ctx context.Context, userID string, limit in
 	return messages, nil
 }
 
+// clearLastMessage removes a deleted message from the conversation list's
+// preview. Previews recorded before they carried the message ID are
+// matched by sender and time.
+func (s *Service) clearLastMessage(ctx context.Context, msg *models.Message) error {
+	_, err := s.db.DB.Collection("conversations").UpdateOne(
+		ctx,
+		bson.M{
+			"_id": msg.ConversationID,
+			"$or": []bson.M{
+				{"last_message.id": msg.ID},
+				{
+					"last_message.id":        bson.M{"$exists": false},
+					"last_message.sender_id": msg.SenderID,
+					"last_message.timestamp": msg.Timestamp,
+				},
+			},
+		},
+		bson.M{"$unset": bson.M{"last_message": ""}},
+	)
+	return err
+}
+
 func (s *Service) updateConversationLastMessage(ctx context.Context, msg *models.Message) error {
 	lastMsg := &models.LastMessage{
+		ID:        msg.ID,
 		Content:   msg.Content,
 		SenderID:  msg.SenderID,
 		Timestamp: msg.Timestamp,
@@ -1,20 +1,46 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"strings"
 
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/jwtkeys"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type Claims struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-func AuthMiddleware(jwtSecret string) fiber.Handler {
+// ParseToken verifies an access token and returns its claims. Besides the
+// middleware, WebSocket connections use it to re-authenticate in-band.
+func ParseToken(tokenString string, keys *jwtkeys.KeySet) (*Claims, error) {
+	token, err := keys.Parse(tokenString, &Claims{})
+	if err != nil || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || claims.UserID == "" {
+		return nil, errors.New("invalid token claims")
+	}
+
+	return claims, nil
+}
+
+// SessionChecker reports whether the session a token was issued for has
+// been revoked since
+type SessionChecker interface {
+	SessionActive(ctx context.Context, sessionID string) bool
+}
+
+func AuthMiddleware(keys *jwtkeys.KeySet, sessions SessionChecker) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
@@ -30,30 +56,26 @@ func AuthMiddleware(jwtSecret string) fiber.Handler {
 			})
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := ParseToken(tokenString, keys)
+		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "invalid token",
+				"error": err.Error(),
 			})
 		}
-
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
+		if !sessions.SessionActive(c.UserContext(), claims.SessionID) {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "invalid token claims",
+				"error": "session revoked",
 			})
 		}
 
 		c.Locals("userID", claims.UserID)
 		c.Locals("username", claims.Username)
+		c.Locals("sessionID", claims.SessionID)
 		return c.Next()
 	}
 }
 
-func WSAuthMiddleware(jwtSecret string) fiber.Handler {
+func WSAuthMiddleware(keys *jwtkeys.KeySet) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
 			// Get token from query parameter or header
@@ -69,25 +91,19 @@ func WSAuthMiddleware(jwtSecret string) fiber.Handler {
 				})
 			}
 
-			jwtToken, err := jwt.ParseWithClaims(token, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-				return []byte(jwtSecret), nil
-			})
-
-			if err != nil || !jwtToken.Valid {
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"error": "invalid token",
-				})
-			}
-
-			claims, ok := jwtToken.Claims.(*Claims)
-			if !ok {
+			claims, err := ParseToken(token, keys)
+			if err != nil {
 				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-					"error": "invalid token claims",
+					"error": err.Error(),
 				})
 			}
 
 			c.Locals("userID", claims.UserID)
 			c.Locals("username", claims.Username)
+			c.Locals("sessionID", claims.SessionID)
+			c.Locals("tokenExpiry", claims.ExpiresAt.Time)
+			// The upgraded connection no longer has the request
+			c.Locals("ip", c.IP())
 			return c.Next()
 		}
 		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{
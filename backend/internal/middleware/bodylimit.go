@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"io"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BodyLimit rejects request bodies larger than limit bytes. The server
+// streams bodies over its own limit instead of buffering them, so this is
+// what bounds them: a body within limit is read into memory for the
+// handler. Requests for which skip returns true are left to a BodyLimit
+// further down the route; skip may be nil.
+func BodyLimit(limit int, skip func(c *fiber.Ctx) bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if skip != nil && skip(c) {
+			return c.Next()
+		}
+
+		if c.Request().Header.ContentLength() > limit {
+			return tooLarge(c)
+		}
+		if !c.Request().IsBodyStream() {
+			return c.Next()
+		}
+
+		// Chunked bodies don't declare their length up front
+		body, err := io.ReadAll(io.LimitReader(c.Context().RequestBodyStream(), int64(limit)+1))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "failed to read request body",
+			})
+		}
+		if len(body) > limit {
+			return tooLarge(c)
+		}
+		c.Request().SetBody(body)
+		return c.Next()
+	}
+}
+
+func tooLarge(c *fiber.Ctx) error {
+	// The rest of the body is never read, so the connection can't be reused
+	c.Context().SetConnectionClose()
+	return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+		"error": "request body is too large",
+	})
+}
@@ -7,24 +7,79 @@ import (
 )
 
 type User struct {
-	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
-	Username       string             `json:"username" bson:"username"`
-	Email          string             `json:"email,omitempty" bson:"email,omitempty"`
-	Phone          string             `json:"phone,omitempty" bson:"phone,omitempty"`
-	PasswordHash   string             `json:"-" bson:"password_hash"`
-	ProfilePicture string             `json:"profile_picture,omitempty" bson:"profile_picture,omitempty"`
-	StatusMessage  string             `json:"status_message,omitempty" bson:"status_message,omitempty"`
-	Presence       Presence           `json:"presence" bson:"presence"`
-	Settings       UserSettings       `json:"settings" bson:"settings"`
-	CreatedAt      time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt      time.Time          `json:"updated_at" bson:"updated_at"`
+	ID                primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Username          string             `json:"username" bson:"username"`
+	UsernameLower     string             `json:"-" bson:"username_lower"` // enforces case-insensitive uniqueness
+	UsernameChangedAt *time.Time         `json:"username_changed_at,omitempty" bson:"username_changed_at,omitempty"`
+	Email             string             `json:"email,omitempty" bson:"email,omitempty"`
+	EmailVerified     bool               `json:"email_verified" bson:"email_verified"`
+	Phone             string             `json:"phone,omitempty" bson:"phone,omitempty"`
+	PasswordHash      string             `json:"-" bson:"password_hash"`
+	TwoFactor         *TwoFactor         `json:"-" bson:"two_factor,omitempty"`
+	Role              string             `json:"role,omitempty" bson:"role,omitempty"` // admin, or empty for regular users
+	DisplayName       string             `json:"display_name,omitempty" bson:"display_name,omitempty"`
+	ProfilePicture    string             `json:"profile_picture,omitempty" bson:"profile_picture,omitempty"`
+	StatusMessage     string             `json:"status_message,omitempty" bson:"status_message,omitempty"`
+	CustomStatus      *CustomStatus      `json:"custom_status,omitempty" bson:"custom_status,omitempty"`
+	Presence          Presence           `json:"presence" bson:"presence"`
+	Settings          UserSettings       `json:"settings" bson:"settings"`
+	DeleteAfter       *time.Time         `json:"delete_after,omitempty" bson:"delete_after,omitempty"` // set while deletion is pending
+	CreatedAt         time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt         time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// CustomStatus is a short-lived status such as "In a meeting until 3pm".
+// While DoNotDisturb is set, new messages are delivered silently.
+type CustomStatus struct {
+	Emoji        string     `json:"emoji,omitempty" bson:"emoji,omitempty"`
+	Text         string     `json:"text,omitempty" bson:"text,omitempty"`
+	DoNotDisturb bool       `json:"do_not_disturb,omitempty" bson:"do_not_disturb,omitempty"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	SetAt        time.Time  `json:"set_at" bson:"set_at"`
+}
+
+// Active reports whether the status is set and hasn't expired
+func (s *CustomStatus) Active(now time.Time) bool {
+	return s != nil && (s.ExpiresAt == nil || now.Before(*s.ExpiresAt))
 }
 
+// Presence is derived from all of a user's live connections
 type Presence struct {
 	Status      string    `json:"status" bson:"status"` // online, offline, away
 	LastSeen    time.Time `json:"last_seen" bson:"last_seen"`
-	WebSocketID string    `json:"websocket_id,omitempty" bson:"websocket_id,omitempty"`
-	DeviceID    string    `json:"device_id,omitempty" bson:"device_id,omitempty"`
+	Connections int       `json:"connections,omitempty" bson:"connections,omitempty"`
+}
+
+const RoleAdmin = "admin"
+
+// DeletedUserID replaces the sender of group messages left behind by a
+// deleted account
+var DeletedUserID = primitive.NilObjectID
+
+// DataExport is a user's request for a copy of their data. The archive is
+// kept in blob storage until ExpiresAt.
+type DataExport struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID      primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Status      string             `json:"status" bson:"status"` // pending, processing, ready, failed
+	StorageKey  string             `json:"-" bson:"storage_key,omitempty"`
+	Size        int64              `json:"size,omitempty" bson:"size,omitempty"`
+	Error       string             `json:"error,omitempty" bson:"error,omitempty"`
+	CreatedAt   time.Time          `json:"created_at" bson:"created_at"`
+	StartedAt   *time.Time         `json:"started_at,omitempty" bson:"started_at,omitempty"` // when an instance claimed it
+	CompletedAt *time.Time         `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+	ExpiresAt   *time.Time         `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
+
+// TwoFactor holds a user's TOTP enrollment. PendingSecret is set between
+// setup and confirmation; Secret once 2FA is on.
+type TwoFactor struct {
+	Enabled            bool       `bson:"enabled"`
+	Secret             string     `bson:"secret,omitempty"`
+	PendingSecret      string     `bson:"pending_secret,omitempty"`
+	RecoveryCodeHashes []string   `bson:"recovery_code_hashes,omitempty"`
+	LastUsedStep       int64      `bson:"last_used_step,omitempty"` // stops a code from being used twice
+	EnabledAt          *time.Time `bson:"enabled_at,omitempty"`
 }
 
 type UserSettings struct {
@@ -32,6 +87,95 @@ type UserSettings struct {
 	LastSeenPrivacy string `json:"last_seen_privacy" bson:"last_seen_privacy"` // everyone, contacts, none
 }
 
+type Session struct {
+	ID               primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID           primitive.ObjectID `json:"user_id" bson:"user_id"`
+	RefreshTokenHash string             `json:"-" bson:"refresh_token_hash"`
+	UsedTokenHashes  []string           `json:"-" bson:"used_token_hashes"`
+	DeviceName       string             `json:"device_name,omitempty" bson:"device_name,omitempty"`
+	UserAgent        string             `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	IP               string             `json:"ip,omitempty" bson:"ip,omitempty"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+	LastUsedAt       time.Time          `json:"last_used_at" bson:"last_used_at"`
+	ExpiresAt        time.Time          `json:"expires_at" bson:"expires_at"`
+	RevokedAt        *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+	RevokedReason    string             `json:"revoked_reason,omitempty" bson:"revoked_reason,omitempty"` // revoked, logout, refresh_token_reuse, password_change, password_reset
+	Current          bool               `json:"current,omitempty" bson:"-"`
+}
+
+// AccountToken is a single-use token emailed to a user, stored by hash
+type AccountToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Purpose   string             `bson:"purpose"` // verify_email, reset_password, change_email, two_factor_login, oidc_exchange
+	TokenHash string             `bson:"token_hash"`
+	Email     string             `bson:"email,omitempty"` // the address the token was sent to
+	Attempts  int                `bson:"attempts"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+}
+
+// UsernameReservation holds a released username for its previous owner
+// until ExpiresAt, so nobody else can take it over right away
+type UsernameReservation struct {
+	Username   string             `bson:"_id"` // lower case
+	UserID     primitive.ObjectID `bson:"user_id"`
+	ReleasedAt time.Time          `bson:"released_at"`
+	ExpiresAt  time.Time          `bson:"expires_at"`
+}
+
+// UsernameHistory records one username change
+type UsernameHistory struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID      primitive.ObjectID `json:"user_id" bson:"user_id"`
+	OldUsername string             `json:"old_username" bson:"old_username"`
+	NewUsername string             `json:"new_username" bson:"new_username"`
+	ChangedAt   time.Time          `json:"changed_at" bson:"changed_at"`
+}
+
+// LoginThrottle counts recent failed logins for an account name or an IP.
+// The ID is "account:<username>" or "ip:<address>".
+type LoginThrottle struct {
+	ID            string     `bson:"_id"`
+	Failures      int        `bson:"failures"`
+	LastFailureAt time.Time  `bson:"last_failure_at"`
+	NextAttemptAt *time.Time `bson:"next_attempt_at,omitempty"`
+	LockedUntil   *time.Time `bson:"locked_until,omitempty"`
+	ExpiresAt     time.Time  `bson:"expires_at"`
+}
+
+// AuthFailure is an audit record of a failed sign-in attempt
+type AuthFailure struct {
+	ID        primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	Username  string              `json:"username" bson:"username"` // as submitted
+	UserID    *primitive.ObjectID `json:"user_id,omitempty" bson:"user_id,omitempty"`
+	IP        string              `json:"ip" bson:"ip"`
+	UserAgent string              `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	Reason    string              `json:"reason" bson:"reason"` // unknown_user, invalid_password, throttled, invalid_2fa_code
+	CreatedAt time.Time           `json:"created_at" bson:"created_at"`
+}
+
+// Identity links a user to an account at an OIDC provider
+type Identity struct {
+	ID       primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID   primitive.ObjectID `json:"user_id" bson:"user_id"`
+	Provider string             `json:"provider" bson:"provider"`
+	Subject  string             `json:"subject" bson:"subject"` // the provider's stable user ID
+	Email    string             `json:"email,omitempty" bson:"email,omitempty"`
+	LinkedAt time.Time          `json:"linked_at" bson:"linked_at"`
+}
+
+// OIDCLogin is an OIDC authorization request waiting for its callback
+type OIDCLogin struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	StateHash    string             `bson:"state_hash"`
+	Provider     string             `bson:"provider"`
+	Nonce        string             `bson:"nonce"`
+	CodeVerifier string             `bson:"code_verifier"`
+	CreatedAt    time.Time          `bson:"created_at"`
+	ExpiresAt    time.Time          `bson:"expires_at"`
+}
+
 type Conversation struct {
 	ID           primitive.ObjectID   `json:"id" bson:"_id,omitempty"`
 	Type         string               `json:"type" bson:"type"` // direct, group
@@ -47,6 +191,7 @@ type Conversation struct {
 }
 
 type LastMessage struct {
+	ID        primitive.ObjectID `json:"id,omitempty" bson:"id,omitempty"`
 	Content   string             `json:"content" bson:"content"`
 	SenderID  primitive.ObjectID `json:"sender_id" bson:"sender_id"`
 	Timestamp time.Time          `json:"timestamp" bson:"timestamp"`
@@ -60,20 +205,61 @@ type Message struct {
 	Content        string               `json:"content" bson:"content"`
 	Type           string               `json:"type" bson:"type"` // text, image, file, audio, video
 	Media          *Media               `json:"media,omitempty" bson:"media,omitempty"`
+	LinkPreview    *LinkPreview         `json:"link_preview,omitempty" bson:"link_preview,omitempty"`
 	Timestamp      time.Time            `json:"timestamp" bson:"timestamp"`
-	Status         string               `json:"status" bson:"status"` // sent, delivered, read
+	Status         string               `json:"status" bson:"status"` // sent, delivered, read, played
 	DeliveryStatus []DeliveryStatus     `json:"delivery_status,omitempty" bson:"delivery_status,omitempty"`
 	RepliedTo      primitive.ObjectID   `json:"replied_to,omitempty" bson:"replied_to,omitempty"`
 	Forwarded      bool                 `json:"forwarded,omitempty" bson:"forwarded,omitempty"`
+	EditedAt       *time.Time           `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
 	Deleted        bool                 `json:"deleted,omitempty" bson:"deleted,omitempty"`
 	DeletedFor     []primitive.ObjectID `json:"deleted_for,omitempty" bson:"deleted_for,omitempty"`
+	ExpiresAt      *time.Time           `json:"expires_at,omitempty" bson:"expires_at,omitempty"` // set for disappearing messages
 }
 
 type Media struct {
+	ID        string `json:"id,omitempty" bson:"id,omitempty"`
 	URL       string `json:"url" bson:"url"`
 	Thumbnail string `json:"thumbnail,omitempty" bson:"thumbnail,omitempty"`
 	Size      int64  `json:"size" bson:"size"`
 	MimeType  string `json:"mime_type" bson:"mime_type"`
+	FileName  string `json:"file_name,omitempty" bson:"file_name,omitempty"`
+	Status    string `json:"status,omitempty" bson:"status,omitempty"` // processing, ready
+
+	Width       int     `json:"width,omitempty" bson:"width,omitempty"`
+	Height      int     `json:"height,omitempty" bson:"height,omitempty"`
+	Duration    float64 `json:"duration,omitempty" bson:"duration,omitempty"` // seconds
+	Orientation int     `json:"orientation,omitempty" bson:"orientation,omitempty"`
+	Waveform    []int   `json:"waveform,omitempty" bson:"waveform,omitempty"` // audio amplitude, 0-100 per point
+}
+
+type LinkPreview struct {
+	URL         string `json:"url" bson:"url"`
+	Title       string `json:"title,omitempty" bson:"title,omitempty"`
+	Description string `json:"description,omitempty" bson:"description,omitempty"`
+	Image       string `json:"image,omitempty" bson:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty" bson:"site_name,omitempty"`
+}
+
+type MediaFile struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OwnerID       primitive.ObjectID `json:"owner_id" bson:"owner_id"`
+	StorageKey    string             `json:"-" bson:"storage_key"`
+	FileName      string             `json:"file_name,omitempty" bson:"file_name,omitempty"`
+	MimeType      string             `json:"mime_type" bson:"mime_type"`
+	Size          int64              `json:"size" bson:"size"`
+	UploadedBytes int64              `json:"uploaded_bytes" bson:"uploaded_bytes"`
+	Parts         int                `json:"-" bson:"parts"`
+	PartKeys      []string           `json:"-" bson:"part_keys,omitempty"`
+	Status        string             `json:"status" bson:"status"` // uploading, processing, ready, failed
+	ThumbnailKey  string             `json:"-" bson:"thumbnail_key,omitempty"`
+	Width         int                `json:"width,omitempty" bson:"width,omitempty"`
+	Height        int                `json:"height,omitempty" bson:"height,omitempty"`
+	Duration      float64            `json:"duration,omitempty" bson:"duration,omitempty"`
+	Orientation   int                `json:"orientation,omitempty" bson:"orientation,omitempty"`
+	Waveform      []int              `json:"waveform,omitempty" bson:"waveform,omitempty"`
+	CreatedAt     time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time          `json:"updated_at" bson:"updated_at"`
 }
 
 type DeliveryStatus struct {
@@ -103,12 +289,31 @@ type Contact struct {
 	AddedAt     time.Time          `json:"added_at" bson:"added_at"`
 }
 
+// Device is a client a user has connected from. Clients generate their
+// DeviceID once and send it with every connection.
+type Device struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID     primitive.ObjectID `json:"user_id" bson:"user_id"`
+	DeviceID   string             `json:"device_id" bson:"device_id"`
+	Type       string             `json:"type" bson:"type"` // web, desktop, ios, android
+	Name       string             `json:"name,omitempty" bson:"name,omitempty"`
+	SessionID  string             `json:"-" bson:"session_id,omitempty"`
+	UserAgent  string             `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+	IP         string             `json:"ip,omitempty" bson:"ip,omitempty"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	LastSeenAt time.Time          `json:"last_seen_at" bson:"last_seen_at"`
+	Online     bool               `json:"online" bson:"-"`
+	Current    bool               `json:"current,omitempty" bson:"-"`
+}
+
 type ActiveConnection struct {
 	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
 	UserID         primitive.ObjectID `json:"user_id" bson:"user_id"`
 	ConnectionID   string             `json:"connection_id" bson:"connection_id"`
 	DeviceID       string             `json:"device_id,omitempty" bson:"device_id,omitempty"`
 	DeviceType     string             `json:"device_type,omitempty" bson:"device_type,omitempty"`
+	Activity       string             `json:"activity,omitempty" bson:"activity,omitempty"` // active, idle, background
+	LastActivity   time.Time          `json:"last_activity" bson:"last_activity"`
 	ConnectedAt    time.Time          `json:"connected_at" bson:"connected_at"`
 	LastHeartbeat  time.Time          `json:"last_heartbeat" bson:"last_heartbeat"`
 	ServerInstance string             `json:"server_instance,omitempty" bson:"server_instance,omitempty"`
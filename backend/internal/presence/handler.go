@@ -0,0 +1,43 @@
+package presence
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type Handler struct {
+	service  *Service
+	maxUsers int
+}
+
+func NewHandler(service *Service, maxUsers int) *Handler {
+	return &Handler{service: service, maxUsers: maxUsers}
+}
+
+// Get returns the presence of the comma-separated user_ids the caller is
+// allowed to see
+func (h *Handler) Get(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var ids []string
+	for _, id := range strings.Split(c.Query("user_ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > h.maxUsers {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": ErrTooManyUsers.Error(),
+		})
+	}
+
+	presence, err := h.service.Snapshot(c.Context(), userID, ids)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(presence)
+}
@@ -0,0 +1,136 @@
+package presence
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrTooManyUsers rejects presence requests for more users than allowed
+var ErrTooManyUsers = errors.New("too many users requested")
+
+// CanSee applies a user's LastSeenPrivacy to a viewer. contact is the
+// user's contact entry for the viewer, if they have one; blocked viewers
+// never see presence.
+func CanSee(privacy string, contact *models.Contact) bool {
+	if contact != nil && contact.Blocked {
+		return false
+	}
+	switch privacy {
+	case "contacts":
+		return contact != nil
+	case "none":
+		return false
+	default:
+		return true
+	}
+}
+
+// VisibleTo reports which viewers may see userID's presence
+func (s *Service) VisibleTo(ctx context.Context, userID string, viewers []string) (map[string]bool, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	if err := s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user); err != nil {
+		return nil, err
+	}
+
+	viewerIDs := objectIDs(viewers)
+	var contacts []models.Contact
+	cursor, err := s.db.DB.Collection("contacts").Find(ctx, bson.M{"user_id": id, "contact_id": bson.M{"$in": viewerIDs}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return nil, err
+	}
+	byViewer := make(map[primitive.ObjectID]*models.Contact, len(contacts))
+	for i := range contacts {
+		byViewer[contacts[i].ContactID] = &contacts[i]
+	}
+
+	visible := make(map[string]bool, len(viewers))
+	for _, viewer := range viewers {
+		viewerID, err := primitive.ObjectIDFromHex(viewer)
+		if err != nil {
+			continue
+		}
+		visible[viewer] = viewer == userID || CanSee(user.Settings.LastSeenPrivacy, byViewer[viewerID])
+	}
+	return visible, nil
+}
+
+// Snapshot returns the presence of the users viewer is allowed to see,
+// leaving out the rest
+func (s *Service) Snapshot(ctx context.Context, viewer string, userIDs []string) ([]*PresenceInfo, error) {
+	viewerID, err := primitive.ObjectIDFromHex(viewer)
+	if err != nil {
+		return nil, err
+	}
+	ids := objectIDs(userIDs)
+	if len(ids) == 0 {
+		return []*PresenceInfo{}, nil
+	}
+
+	var users []models.User
+	cursor, err := s.db.DB.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	var contacts []models.Contact
+	cursor, err = s.db.DB.Collection("contacts").Find(ctx, bson.M{"user_id": bson.M{"$in": ids}, "contact_id": viewerID})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return nil, err
+	}
+	byUser := make(map[primitive.ObjectID]*models.Contact, len(contacts))
+	for i := range contacts {
+		byUser[contacts[i].UserID] = &contacts[i]
+	}
+
+	allowed := make([]string, 0, len(users))
+	for _, user := range users {
+		if user.ID == viewerID || CanSee(user.Settings.LastSeenPrivacy, byUser[user.ID]) {
+			allowed = append(allowed, user.ID.Hex())
+		}
+	}
+
+	presence, err := s.GetMultiplePresence(ctx, allowed)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*PresenceInfo, 0, len(allowed))
+	for _, userID := range allowed {
+		if info, ok := presence[userID]; ok {
+			result = append(result, info)
+		}
+	}
+	return result, nil
+}
+
+// objectIDs parses the valid, distinct IDs in ids
+func objectIDs(ids []string) []primitive.ObjectID {
+	seen := make(map[primitive.ObjectID]bool, len(ids))
+	result := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil || seen[oid] {
+			continue
+		}
+		seen[oid] = true
+		result = append(result, oid)
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package presence
+
+import (
+	"context"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Reconcile removes the connections a previous run of serverID left behind
+// when it stopped without cleaning up, and returns the users whose status
+// changed as a result. Call it before the instance accepts connections.
+func (s *Service) Reconcile(ctx context.Context, serverID string) ([]string, error) {
+	return s.reap(ctx, bson.M{"server_instance": serverID})
+}
+
+// ReapStale removes connections on any instance that haven't sent a
+// heartbeat within timeout, then sets users offline who are still shown
+// online without a live connection anywhere. It returns the users whose
+// status changed.
+func (s *Service) ReapStale(ctx context.Context, timeout time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-timeout)
+
+	changed, err := s.reap(ctx, bson.M{"last_heartbeat": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return changed, err
+	}
+
+	// Connections the TTL index already removed leave nothing to reap, so
+	// look for users whose status outlived them
+	live, err := s.db.DB.Collection("active_connections").Distinct(ctx, "user_id", bson.M{
+		"expires_at": bson.M{"$gt": time.Now()},
+	})
+	if err != nil {
+		return changed, err
+	}
+	cursor, err := s.db.DB.Collection("users").Find(ctx, bson.M{
+		"presence.status": bson.M{"$in": []string{StatusOnline, StatusAway}},
+		"_id":             bson.M{"$nin": live},
+	})
+	if err != nil {
+		return changed, err
+	}
+	var orphaned []models.User
+	if err := cursor.All(ctx, &orphaned); err != nil {
+		return changed, err
+	}
+
+	for _, user := range orphaned {
+		// Their last heartbeat was at least a timeout ago
+		_, ok, err := s.refresh(ctx, user.ID.Hex(), cutoff)
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			changed = append(changed, user.ID.Hex())
+		}
+	}
+	return changed, nil
+}
+
+// reap deletes the connections matching filter and refreshes their users,
+// dating a user going offline to when their connections were last alive
+func (s *Service) reap(ctx context.Context, filter bson.M) ([]string, error) {
+	connections := s.db.DB.Collection("active_connections")
+
+	cursor, err := connections.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var dead []models.ActiveConnection
+	if err := cursor.All(ctx, &dead); err != nil {
+		return nil, err
+	}
+	if len(dead) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(dead))
+	lastAlive := make(map[primitive.ObjectID]time.Time)
+	for _, conn := range dead {
+		ids = append(ids, conn.ID)
+		alive := conn.ConnectedAt
+		for _, t := range []time.Time{conn.LastHeartbeat, conn.LastActivity} {
+			if t.After(alive) {
+				alive = t
+			}
+		}
+		if alive.After(lastAlive[conn.UserID]) {
+			lastAlive[conn.UserID] = alive
+		}
+	}
+
+	if _, err := connections.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for userID, alive := range lastAlive {
+		_, ok, err := s.refresh(ctx, userID.Hex(), alive)
+		if err != nil {
+			return changed, err
+		}
+		if ok {
+			changed = append(changed, userID.Hex())
+		}
+	}
+	return changed, nil
+}
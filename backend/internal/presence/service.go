@@ -2,7 +2,6 @@ package presence
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
@@ -12,15 +11,33 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// Activity states clients report for a connection
+const (
+	ActivityActive     = "active"
+	ActivityIdle       = "idle"
+	ActivityBackground = "background"
+)
+
+// How long presence read from the database is cached, keyed by user ID
+const cacheTTL = time.Minute
+
 type Service struct {
-	db    *database.Database
-	cache *cache.Cache
+	db        *database.Database
+	cache     cache.Cache[string, *PresenceInfo]
+	awayAfter time.Duration
 }
 
-func NewService(db *database.Database, cache *cache.Cache) *Service {
+func NewService(db *database.Database, cache cache.Cache[string, *PresenceInfo], awayAfter time.Duration) *Service {
 	return &Service{
-		db:    db,
-		cache: cache,
+		db:        db,
+		cache:     cache,
+		awayAfter: awayAfter,
 	}
 }
 
@@ -28,111 +45,146 @@ type PresenceInfo struct {
 	UserID      string    `json:"user_id"`
 	Status      string    `json:"status"`
 	LastSeen    time.Time `json:"last_seen"`
-	Connections []string  `json:"connections"`
+	Connections []string  `json:"-"`
+
+	CustomStatus *models.CustomStatus `json:"custom_status,omitempty"`
+}
+
+// SetActivity records what a client reported about one connection.
+// Activity also restarts the away timer.
+func (s *Service) SetActivity(ctx context.Context, connectionID, state string) error {
+	set := bson.M{"activity": state}
+	if state == ActivityActive {
+		set["last_activity"] = time.Now()
+	}
+	_, err := s.db.DB.Collection("active_connections").UpdateOne(ctx, bson.M{"connection_id": connectionID}, bson.M{"$set": set})
+	return err
+}
+
+// Refresh recomputes a user's presence from their live connections on
+// every instance: online while any of them is active and was used within
+// awayAfter, away while connected otherwise, and offline with none. It
+// reports whether the stored status changed, so only one caller announces
+// each change.
+func (s *Service) Refresh(ctx context.Context, userID string) (*PresenceInfo, bool, error) {
+	return s.refresh(ctx, userID, time.Now())
 }
 
-func (s *Service) SetOnline(ctx context.Context, userID, connectionID string) error {
+// refresh is Refresh with the time a user going offline was last seen,
+// which is earlier than now when their connections died unnoticed
+func (s *Service) refresh(ctx context.Context, userID string, offlineSince time.Time) (*PresenceInfo, bool, error) {
 	id, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	// Update database
-	_, err = s.db.DB.Collection("users").UpdateOne(
-		ctx,
-		bson.M{"_id": id},
-		bson.M{
-			"$set": bson.M{
-				"presence.status":       "online",
-				"presence.websocket_id": connectionID,
-				"updated_at":            time.Now(),
-			},
-		},
-	)
+	now := time.Now()
+	cursor, err := s.db.DB.Collection("active_connections").Find(ctx, bson.M{
+		"user_id":    id,
+		"expires_at": bson.M{"$gt": now},
+	})
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	var connections []models.ActiveConnection
+	if err := cursor.All(ctx, &connections); err != nil {
+		return nil, false, err
 	}
 
-	// Update cache
-	cacheKey := fmt.Sprintf("presence:%s", userID)
 	presence := &PresenceInfo{
 		UserID:      userID,
-		Status:      "online",
-		LastSeen:    time.Now(),
-		Connections: []string{connectionID},
+		Status:      StatusOffline,
+		LastSeen:    offlineSince,
+		Connections: make([]string, 0, len(connections)),
 	}
-	s.cache.Set(cacheKey, presence)
-
-	return nil
-}
-
-func (s *Service) SetOffline(ctx context.Context, userID string) error {
-	id, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		return err
+	if len(connections) > 0 {
+		presence.Status = StatusAway
+		presence.LastSeen = time.Time{}
 	}
+	for _, conn := range connections {
+		presence.Connections = append(presence.Connections, conn.ConnectionID)
 
-	now := time.Now()
+		lastActivity := conn.LastActivity
+		if lastActivity.Before(conn.ConnectedAt) {
+			lastActivity = conn.ConnectedAt
+		}
+		if lastActivity.After(presence.LastSeen) {
+			presence.LastSeen = lastActivity
+		}
+		if (conn.Activity == "" || conn.Activity == ActivityActive) && now.Sub(lastActivity) < s.awayAfter {
+			presence.Status = StatusOnline
+		}
+	}
+	if presence.Status == StatusOnline {
+		presence.LastSeen = now
+	}
 
-	// Update database
-	_, err = s.db.DB.Collection("users").UpdateOne(
+	// Read the stored presence while keeping the connection count current
+	users := s.db.DB.Collection("users")
+	var user models.User
+	err = users.FindOneAndUpdate(
 		ctx,
 		bson.M{"_id": id},
 		bson.M{
-			"$set": bson.M{
-				"presence.status":       "offline",
-				"presence.last_seen":    now,
-				"presence.websocket_id": "",
-				"updated_at":            now,
-			},
+			"$set":   bson.M{"presence.connections": len(connections)},
+			"$unset": bson.M{"presence.websocket_id": ""},
 		},
-	)
+	).Decode(&user)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
+	presence.CustomStatus = activeStatus(user.CustomStatus, now)
 
-	// Update cache
-	cacheKey := fmt.Sprintf("presence:%s", userID)
-	presence := &PresenceInfo{
-		UserID:      userID,
-		Status:      "offline",
-		LastSeen:    now,
-		Connections: []string{},
+	changed := false
+	if user.Presence.Status != presence.Status {
+		// Compare and swap, so when instances race only one reports the change
+		result, err := users.UpdateOne(
+			ctx,
+			bson.M{"_id": id, "presence.status": user.Presence.Status},
+			bson.M{"$set": bson.M{
+				"presence.status":    presence.Status,
+				"presence.last_seen": presence.LastSeen,
+				"updated_at":         now,
+			}},
+		)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = result.ModifiedCount > 0
+	} else if presence.Status == StatusOffline {
+		presence.LastSeen = user.Presence.LastSeen
 	}
-	s.cache.SetWithTTL(cacheKey, presence, 1*time.Minute)
-
-	return nil
-}
 
-func (s *Service) GetPresence(ctx context.Context, userID string) (*PresenceInfo, error) {
-	// Check cache first
-	cacheKey := fmt.Sprintf("presence:%s", userID)
-	if cached, ok := s.cache.Get(cacheKey); ok {
-		return cached.(*PresenceInfo), nil
-	}
+	s.cache.SetWithTTL(userID, presence, cacheTTL)
 
-	// Query database
-	id, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		return nil, err
-	}
+	return presence, changed, nil
+}
 
-	var user models.User
-	err = s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user)
-	if err != nil {
-		return nil, err
-	}
+// Forget drops a user's cached presence after another instance changed it
+func (s *Service) Forget(userID string) {
+	s.cache.Delete(userID)
+}
 
-	presence := &PresenceInfo{
-		UserID:   userID,
-		Status:   user.Presence.Status,
-		LastSeen: user.Presence.LastSeen,
-	}
+func (s *Service) GetPresence(ctx context.Context, userID string) (*PresenceInfo, error) {
+	return s.cache.GetOrLoad(ctx, userID, cacheTTL, func(ctx context.Context) (*PresenceInfo, error) {
+		id, err := primitive.ObjectIDFromHex(userID)
+		if err != nil {
+			return nil, err
+		}
 
-	// Cache the result
-	s.cache.SetWithTTL(cacheKey, presence, 1*time.Minute)
+		var user models.User
+		err = s.db.DB.Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+		if err != nil {
+			return nil, err
+		}
 
-	return presence, nil
+		return &PresenceInfo{
+			UserID:       userID,
+			Status:       user.Presence.Status,
+			LastSeen:     user.Presence.LastSeen,
+			CustomStatus: activeStatus(user.CustomStatus, time.Now()),
+		}, nil
+	})
 }
 
 func (s *Service) GetMultiplePresence(ctx context.Context, userIDs []string) (map[string]*PresenceInfo, error) {
@@ -148,9 +200,8 @@ func (s *Service) GetMultiplePresence(ctx context.Context, userIDs []string) (ma
 		ids = append(ids, id)
 
 		// Check cache
-		cacheKey := fmt.Sprintf("presence:%s", userID)
-		if cached, ok := s.cache.Get(cacheKey); ok {
-			result[userID] = cached.(*PresenceInfo)
+		if cached, ok := s.cache.Get(userID); ok {
+			result[userID] = cached
 		}
 	}
 
@@ -171,15 +222,15 @@ func (s *Service) GetMultiplePresence(ctx context.Context, userIDs []string) (ma
 			userID := user.ID.Hex()
 			if _, exists := result[userID]; !exists {
 				presence := &PresenceInfo{
-					UserID:   userID,
-					Status:   user.Presence.Status,
-					LastSeen: user.Presence.LastSeen,
+					UserID:       userID,
+					Status:       user.Presence.Status,
+					LastSeen:     user.Presence.LastSeen,
+					CustomStatus: activeStatus(user.CustomStatus, time.Now()),
 				}
 				result[userID] = presence
 
 				// Cache it
-				cacheKey := fmt.Sprintf("presence:%s", userID)
-				s.cache.SetWithTTL(cacheKey, presence, 1*time.Minute)
+				s.cache.SetWithTTL(userID, presence, cacheTTL)
 			}
 		}
 	}
@@ -187,10 +238,27 @@ func (s *Service) GetMultiplePresence(ctx context.Context, userIDs []string) (ma
 	return result, nil
 }
 
+// DoNotDisturb reports whether the user has do not disturb on
+func (s *Service) DoNotDisturb(ctx context.Context, userID string) bool {
+	presence, err := s.GetPresence(ctx, userID)
+	if err != nil {
+		return false
+	}
+	return presence.CustomStatus.Active(time.Now()) && presence.CustomStatus.DoNotDisturb
+}
+
+// activeStatus hides a status that expired before the cleanup job got to it
+func activeStatus(status *models.CustomStatus, now time.Time) *models.CustomStatus {
+	if !status.Active(now) {
+		return nil
+	}
+	return status
+}
+
 func (s *Service) IsOnline(ctx context.Context, userID string) (bool, error) {
 	presence, err := s.GetPresence(ctx, userID)
 	if err != nil {
 		return false, err
 	}
-	return presence.Status == "online", nil
+	return presence.Status == StatusOnline, nil
 }
@@ -0,0 +1,183 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "if": true, "in": true,
+	"into": true, "is": true, "it": true, "no": true, "not": true, "of": true,
+	"on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true,
+	"this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// Token is an analyzed word together with its rune span in the source text
+type Token struct {
+	Term  string
+	Start int
+	End   int
+}
+
+// Analyze splits text into words, folds case and diacritics, drops stop
+// words and stems what remains.
+func Analyze(text string) []Token {
+	runes := []rune(text)
+
+	var tokens []Token
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+
+		word := fold(string(runes[start:i]))
+		if word == "" || stopWords[word] {
+			continue
+		}
+		tokens = append(tokens, Token{Term: stem(word), Start: start, End: i})
+	}
+
+	return tokens
+}
+
+// Terms returns only the analyzed terms of text
+func Terms(text string) []string {
+	tokens := Analyze(text)
+	terms := make([]string, 0, len(tokens))
+	for _, t := range tokens {
+		terms = append(terms, t.Term)
+	}
+	return terms
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// fold lowercases a word and strips combining marks so "Café" matches "cafe"
+func fold(word string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.ToLower(word)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// stem applies the plural and participle rules of the Porter stemmer
+// (steps 1a-1c). Words containing non-ASCII letters are left untouched.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for _, r := range word {
+		if r < 'a' || r > 'z' {
+			return word
+		}
+	}
+
+	// Step 1a
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+	case strings.HasSuffix(word, "s"):
+		word = word[:len(word)-1]
+	}
+
+	// Step 1b
+	stripped := false
+	switch {
+	case strings.HasSuffix(word, "eed"):
+		if measure(word[:len(word)-3]) > 0 {
+			word = word[:len(word)-1]
+		}
+	case strings.HasSuffix(word, "ed") && hasVowel(word[:len(word)-2]):
+		word = word[:len(word)-2]
+		stripped = true
+	case strings.HasSuffix(word, "ing") && hasVowel(word[:len(word)-3]):
+		word = word[:len(word)-3]
+		stripped = true
+	}
+	if stripped {
+		switch {
+		case strings.HasSuffix(word, "at"), strings.HasSuffix(word, "bl"), strings.HasSuffix(word, "iz"):
+			word += "e"
+		case endsDoubleConsonant(word) && !strings.HasSuffix(word, "l") && !strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "z"):
+			word = word[:len(word)-1]
+		case measure(word) == 1 && endsCVC(word):
+			word += "e"
+		}
+	}
+
+	// Step 1c
+	if strings.HasSuffix(word, "y") && hasVowel(word[:len(word)-1]) {
+		word = word[:len(word)-1] + "i"
+	}
+
+	return word
+}
+
+func isConsonant(word string, i int) bool {
+	switch word[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !isConsonant(word, i-1)
+	}
+	return true
+}
+
+// measure counts the vowel-consonant sequences in word
+func measure(word string) int {
+	m := 0
+	inVowel := false
+	for i := range word {
+		if isConsonant(word, i) {
+			if inVowel {
+				m++
+			}
+			inVowel = false
+		} else {
+			inVowel = true
+		}
+	}
+	return m
+}
+
+func hasVowel(word string) bool {
+	for i := range word {
+		if !isConsonant(word, i) {
+			return true
+		}
+	}
+	return false
+}
+
+func endsDoubleConsonant(word string) bool {
+	n := len(word)
+	return n >= 2 && word[n-1] == word[n-2] && isConsonant(word, n-1)
+}
+
+func endsCVC(word string) bool {
+	n := len(word)
+	if n < 3 {
+		return false
+	}
+	last := word[n-1]
+	return isConsonant(word, n-3) && !isConsonant(word, n-2) && isConsonant(word, n-1) &&
+		last != 'w' && last != 'x' && last != 'y'
+}
@@ -0,0 +1,88 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStem(t *testing.T) {
+	tests := map[string]string{
+		// Step 1a
+		"caresses": "caress",
+		"ponies":   "poni",
+		"ties":     "ti",
+		"caress":   "caress",
+		"cats":     "cat",
+		"lunches":  "lunche",
+		// Step 1b
+		"feed":      "feed",
+		"agreed":    "agree",
+		"plastered": "plaster",
+		"bled":      "bled",
+		"motoring":  "motor",
+		"sing":      "sing",
+		"conflated": "conflate",
+		"troubled":  "trouble",
+		"sized":     "size",
+		"hopping":   "hop",
+		"tanned":    "tan",
+		"falling":   "fall",
+		"hissing":   "hiss",
+		"fizzed":    "fizz",
+		"failing":   "fail",
+		"filing":    "file",
+		// Step 1c
+		"happy": "happi",
+		"sky":   "sky",
+		// Left alone
+		"go":     "go",
+		"straße": "straße",
+		"4g":     "4g",
+	}
+	for word, want := range tests {
+		if got := stem(word); got != want {
+			t.Errorf("stem(%q) = %q, want %q", word, got, want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		text string
+		want []Token
+	}{
+		{
+			text: "The Cafés are OPEN, running!",
+			want: []Token{{"cafe", 4, 9}, {"open", 14, 18}, {"run", 20, 27}},
+		},
+		{
+			// "é" written as "e" plus a combining accent
+			text: "Cafe\u0301 meetings",
+			want: []Token{{"cafe", 0, 5}, {"meet", 6, 14}},
+		},
+		{
+			text: "4G и Wi-Fi",
+			want: []Token{{"4g", 0, 2}, {"и", 3, 4}, {"wi", 5, 7}, {"fi", 8, 10}},
+		},
+		{
+			text: "it is not the one",
+			want: []Token{{"one", 14, 17}},
+		},
+		{
+			text: "  ... !!",
+		},
+	}
+	for _, tt := range tests {
+		if got := Analyze(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Analyze(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTerms(t *testing.T) {
+	got := Terms("Flying flies, flew!")
+	want := []string{"fly", "fli", "flew"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Terms = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package search
+
+import (
+	"strings"
+)
+
+const snippetLength = 160
+
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Snippet returns a window of content around the first word matching the
+// query along with the rune offsets of every match inside that window.
+// Matching uses the same analyzer as the index, so "meetings" highlights
+// "meeting".
+func Snippet(content, query string) (string, []Highlight) {
+	wanted := make(map[string]bool)
+	for _, field := range strings.Fields(query) {
+		if strings.HasPrefix(field, "-") {
+			continue
+		}
+		for _, term := range Terms(field) {
+			wanted[term] = true
+		}
+	}
+
+	matches := []Highlight{}
+	for _, token := range Analyze(content) {
+		if wanted[token.Term] {
+			matches = append(matches, Highlight{Start: token.Start, End: token.End})
+		}
+	}
+
+	runes := []rune(content)
+	if len(runes) <= snippetLength {
+		return content, matches
+	}
+
+	// Center the window on the first match, or show the beginning.
+	start := 0
+	if len(matches) > 0 {
+		start = matches[0].Start - snippetLength/4
+		if start < 0 {
+			start = 0
+		}
+	}
+	end := start + snippetLength
+	if end > len(runes) {
+		end = len(runes)
+		start = end - snippetLength
+	}
+
+	prefix := ""
+	if start > 0 {
+		prefix = "…"
+	}
+	suffix := ""
+	if end < len(runes) {
+		suffix = "…"
+	}
+	offset := start - len([]rune(prefix))
+
+	highlights := []Highlight{}
+	for _, m := range matches {
+		if m.Start >= start && m.End <= end {
+			highlights = append(highlights, Highlight{Start: m.Start - offset, End: m.End - offset})
+		}
+	}
+
+	return prefix + string(runes[start:end]) + suffix, highlights
+}
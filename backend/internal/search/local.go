@@ -0,0 +1,442 @@
+package search
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "journal.log"
+
+	// compactAfter is the number of journal entries after which the
+	// journal is folded into a fresh snapshot.
+	compactAfter = 10000
+
+	// BM25 tuning parameters
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// LocalIndex is an embedded inverted index persisted to a directory as a
+// snapshot plus an append-only journal. Message content itself is never
+// written to disk, only the analyzed term frequencies.
+type LocalIndex struct {
+	mu          sync.RWMutex
+	dir         string
+	docs        map[string]*entry
+	postings    map[string]map[string]int // term -> messageID -> term frequency
+	totalLength int
+	journal     *os.File
+	journalOps  int
+}
+
+type entry struct {
+	MessageID      string         `json:"message_id"`
+	ConversationID string         `json:"conversation_id"`
+	SenderID       string         `json:"sender_id"`
+	Type           string         `json:"type"`
+	Timestamp      time.Time      `json:"timestamp"`
+	ExpiresAt      *time.Time     `json:"expires_at,omitempty"`
+	HiddenFor      []string       `json:"hidden_for,omitempty"`
+	Terms          map[string]int `json:"terms"`
+	Length         int            `json:"length"`
+}
+
+type journalEntry struct {
+	Op        string `json:"op"` // index, delete
+	Entry     *entry `json:"entry,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+type snapshot struct {
+	Docs []*entry `json:"docs"`
+}
+
+// OpenLocalIndex loads the index stored in dir, creating it if needed
+func OpenLocalIndex(dir string) (*LocalIndex, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	l := &LocalIndex{
+		dir:      dir,
+		docs:     make(map[string]*entry),
+		postings: make(map[string]map[string]int),
+	}
+
+	if err := l.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := l.replayJournal(); err != nil {
+		return nil, err
+	}
+
+	journal, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l.journal = journal
+
+	return l, nil
+}
+
+func (l *LocalIndex) Index(ctx context.Context, doc *Document) error {
+	e := newEntry(doc)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.put(e)
+	return l.appendJournal(&journalEntry{Op: "index", Entry: e})
+}
+
+func (l *LocalIndex) Delete(ctx context.Context, messageID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.docs[messageID]; !ok {
+		return nil
+	}
+	l.remove(messageID)
+	return l.appendJournal(&journalEntry{Op: "delete", MessageID: messageID})
+}
+
+func (l *LocalIndex) Search(ctx context.Context, q *Query) (*Results, error) {
+	results := &Results{Hits: []Hit{}}
+
+	var include, exclude []string
+	seen := make(map[string]bool)
+	for _, field := range strings.Fields(q.Text) {
+		negated := strings.HasPrefix(field, "-")
+		for _, term := range Terms(strings.TrimPrefix(field, "-")) {
+			if negated {
+				exclude = append(exclude, term)
+			} else if !seen[term] {
+				seen[term] = true
+				include = append(include, term)
+			}
+		}
+	}
+	if len(include) == 0 || len(q.ConversationIDs) == 0 {
+		return results, nil
+	}
+
+	allowed := make(map[string]bool, len(q.ConversationIDs))
+	for _, id := range q.ConversationIDs {
+		allowed[id] = true
+	}
+	now := time.Now()
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.docs) == 0 {
+		return results, nil
+	}
+	n := float64(len(l.docs))
+	avgLength := float64(l.totalLength) / n
+
+	scores := make(map[string]float64)
+	visible := make(map[string]bool)
+	for _, term := range include {
+		postings := l.postings[term]
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+
+		for id, tf := range postings {
+			ok, checked := visible[id]
+			if !checked {
+				ok = l.matches(l.docs[id], q, allowed, exclude, now)
+				visible[id] = ok
+			}
+			if !ok {
+				continue
+			}
+
+			length := float64(l.docs[id].Length)
+			freq := float64(tf)
+			scores[id] += idf * freq * (bm25K1 + 1) / (freq + bm25K1*(1-bm25B+bm25B*length/avgLength))
+		}
+	}
+
+	hits := make([]Hit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, Hit{MessageID: id, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return l.docs[hits[i].MessageID].Timestamp.After(l.docs[hits[j].MessageID].Timestamp)
+	})
+
+	results.Total = len(hits)
+	if q.Skip >= len(hits) {
+		return results, nil
+	}
+	end := len(hits)
+	if q.Limit > 0 && q.Skip+q.Limit < end {
+		end = q.Skip + q.Limit
+	}
+	results.Hits = hits[q.Skip:end]
+
+	return results, nil
+}
+
+// Rebuild replaces the whole index with the documents returned by next,
+// which signals the end with io.EOF. The result is written as a fresh
+// snapshot and the journal is truncated.
+func (l *LocalIndex) Rebuild(ctx context.Context, next func() (*Document, error)) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.docs = make(map[string]*entry)
+	l.postings = make(map[string]map[string]int)
+	l.totalLength = 0
+
+	count := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		doc, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		l.put(newEntry(doc))
+		count++
+	}
+
+	return count, l.compact()
+}
+
+func (l *LocalIndex) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.journal == nil {
+		return nil
+	}
+	err := l.journal.Sync()
+	if closeErr := l.journal.Close(); err == nil {
+		err = closeErr
+	}
+	l.journal = nil
+	return err
+}
+
+func newEntry(doc *Document) *entry {
+	e := &entry{
+		MessageID:      doc.MessageID,
+		ConversationID: doc.ConversationID,
+		SenderID:       doc.SenderID,
+		Type:           doc.Type,
+		Timestamp:      doc.Timestamp,
+		ExpiresAt:      doc.ExpiresAt,
+		HiddenFor:      doc.HiddenFor,
+		Terms:          make(map[string]int),
+	}
+	for _, term := range Terms(doc.Content) {
+		e.Terms[term]++
+		e.Length++
+	}
+	return e
+}
+
+func (l *LocalIndex) matches(e *entry, q *Query, allowed map[string]bool, exclude []string, now time.Time) bool {
+	if !allowed[e.ConversationID] {
+		return false
+	}
+	if e.ExpiresAt != nil && !e.ExpiresAt.After(now) {
+		return false
+	}
+	for _, id := range e.HiddenFor {
+		if id == q.UserID {
+			return false
+		}
+	}
+	if q.SenderID != "" && e.SenderID != q.SenderID {
+		return false
+	}
+	if q.Type != "" && e.Type != q.Type {
+		return false
+	}
+	if !q.From.IsZero() && e.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Timestamp.After(q.To) {
+		return false
+	}
+	for _, term := range exclude {
+		if e.Terms[term] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// put adds or replaces an entry; the caller must hold the write lock
+func (l *LocalIndex) put(e *entry) {
+	if _, ok := l.docs[e.MessageID]; ok {
+		l.remove(e.MessageID)
+	}
+
+	l.docs[e.MessageID] = e
+	l.totalLength += e.Length
+	for term, tf := range e.Terms {
+		postings, ok := l.postings[term]
+		if !ok {
+			postings = make(map[string]int)
+			l.postings[term] = postings
+		}
+		postings[e.MessageID] = tf
+	}
+}
+
+// remove drops an entry; the caller must hold the write lock
+func (l *LocalIndex) remove(messageID string) {
+	e, ok := l.docs[messageID]
+	if !ok {
+		return
+	}
+
+	for term := range e.Terms {
+		if postings, ok := l.postings[term]; ok {
+			delete(postings, messageID)
+			if len(postings) == 0 {
+				delete(l.postings, term)
+			}
+		}
+	}
+	l.totalLength -= e.Length
+	delete(l.docs, messageID)
+}
+
+func (l *LocalIndex) appendJournal(je *journalEntry) error {
+	if l.journal == nil {
+		return errors.New("search index is closed")
+	}
+
+	data, err := json.Marshal(je)
+	if err != nil {
+		return err
+	}
+	if _, err := l.journal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	l.journalOps++
+	if l.journalOps >= compactAfter {
+		return l.compact()
+	}
+	return nil
+}
+
+// compact writes the in-memory index as a new snapshot and truncates the
+// journal; the caller must hold the write lock
+func (l *LocalIndex) compact() error {
+	snap := snapshot{Docs: make([]*entry, 0, len(l.docs))}
+	for _, e := range l.docs {
+		snap.Docs = append(snap.Docs, e)
+	}
+
+	tmp, err := os.CreateTemp(l.dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(tmp).Encode(&snap); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(l.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	if l.journal != nil {
+		if err := l.journal.Truncate(0); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(filepath.Join(l.dir, journalFile), 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l.journalOps = 0
+
+	return nil
+}
+
+func (l *LocalIndex) loadSnapshot() error {
+	f, err := os.Open(filepath.Join(l.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snap snapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return err
+	}
+	for _, e := range snap.Docs {
+		l.put(e)
+	}
+	return nil
+}
+
+func (l *LocalIndex) replayJournal() error {
+	f, err := os.Open(filepath.Join(l.dir, journalFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var je journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &je); err != nil {
+			// A torn final write after a crash; everything before it is intact.
+			log.Printf("Search index: skipping corrupt journal entry: %v", err)
+			continue
+		}
+		switch je.Op {
+		case "index":
+			if je.Entry != nil {
+				l.put(je.Entry)
+			}
+		case "delete":
+			l.remove(je.MessageID)
+		}
+		l.journalOps++
+	}
+	return scanner.Err()
+}
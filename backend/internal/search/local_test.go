@@ -0,0 +1,155 @@
+package search
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLocalIndexSurvivesReopen(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	docs := []*Document{
+		{MessageID: "m1", ConversationID: "c1", SenderID: "u1", Type: "text", Content: "Lunch at the new cafe?", Timestamp: base},
+		{MessageID: "m2", ConversationID: "c1", SenderID: "u2", Type: "text", Content: "The cafe opens at noon", Timestamp: base.Add(time.Minute)},
+		{MessageID: "m3", ConversationID: "c2", SenderID: "u1", Type: "text", Content: "Cafes and lunch", Timestamp: base.Add(2 * time.Minute)},
+		{MessageID: "m4", ConversationID: "c1", SenderID: "u1", Type: "text", Content: "Lunch is cancelled", Timestamp: base.Add(3 * time.Minute)},
+	}
+	queries := []*Query{
+		{Text: "cafe", UserID: "u1", ConversationIDs: []string{"c1", "c2"}},
+		{Text: "lunch", UserID: "u1", ConversationIDs: []string{"c1", "c2"}},
+		{Text: "lunch -cafe", UserID: "u1", ConversationIDs: []string{"c1"}},
+		{Text: "dinner", UserID: "u1", ConversationIDs: []string{"c1", "c2"}},
+	}
+
+	tests := map[string]func(t *testing.T, index *LocalIndex){
+		"journal only": func(t *testing.T, index *LocalIndex) {
+			for _, doc := range docs {
+				if err := index.Index(context.Background(), doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+		},
+		"snapshot and journal": func(t *testing.T, index *LocalIndex) {
+			next := 0
+			_, err := index.Rebuild(context.Background(), func() (*Document, error) {
+				if next == len(docs) {
+					return nil, io.EOF
+				}
+				next++
+				return docs[next-1], nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	for name, fill := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			ctx := context.Background()
+
+			index, err := OpenLocalIndex(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fill(t, index)
+
+			// Changes after the snapshot only live in the journal
+			edited := *docs[1]
+			edited.Content = "Dinner instead"
+			if err := index.Index(ctx, &edited); err != nil {
+				t.Fatal(err)
+			}
+			if err := index.Delete(ctx, "m4"); err != nil {
+				t.Fatal(err)
+			}
+
+			before := searchAll(t, index, queries)
+			if err := index.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := OpenLocalIndex(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+
+			after := searchAll(t, reopened, queries)
+			if !reflect.DeepEqual(after, before) {
+				t.Fatalf("after reopening got %+v, want %+v", after, before)
+			}
+
+			want := map[string][]string{
+				"cafe":        {"m1", "m3"},
+				"lunch":       {"m1", "m3"},
+				"lunch -cafe": {},
+				"dinner":      {"m2"},
+			}
+			for i, q := range queries {
+				if got := hitIDs(after[i]); !sameIDs(got, want[q.Text]) {
+					t.Errorf("%q found %v, want %v", q.Text, got, want[q.Text])
+				}
+			}
+		})
+	}
+}
+
+func TestLocalIndexClosed(t *testing.T) {
+	index, err := OpenLocalIndex(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+
+	doc := &Document{MessageID: "m1", ConversationID: "c1", Content: "hello"}
+	if err := index.Index(context.Background(), doc); err == nil {
+		t.Fatal("Index succeeded on a closed index")
+	}
+}
+
+func searchAll(t *testing.T, index *LocalIndex, queries []*Query) []*Results {
+	t.Helper()
+
+	results := make([]*Results, 0, len(queries))
+	for _, q := range queries {
+		found, err := index.Search(context.Background(), q)
+		if err != nil {
+			t.Fatalf("Search(%q): %v", q.Text, err)
+		}
+		results = append(results, found)
+	}
+	return results
+}
+
+func hitIDs(results *Results) []string {
+	ids := make([]string, 0, len(results.Hits))
+	for _, hit := range results.Hits {
+		ids = append(ids, hit.MessageID)
+	}
+	return ids
+}
+
+// sameIDs compares hit IDs regardless of order, since equal scores tie
+func sameIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool, len(got))
+	for _, id := range got {
+		seen[id] = true
+	}
+	for _, id := range want {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
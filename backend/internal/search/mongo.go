@@ -0,0 +1,111 @@
+package search
+
+import (
+	"context"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoIndexer searches the messages collection through its text index.
+// MongoDB maintains that index itself, so Index and Delete are no-ops.
+type MongoIndexer struct {
+	db *database.Database
+}
+
+func NewMongoIndexer(db *database.Database) *MongoIndexer {
+	return &MongoIndexer{db: db}
+}
+
+func (m *MongoIndexer) Index(ctx context.Context, doc *Document) error {
+	return nil
+}
+
+func (m *MongoIndexer) Delete(ctx context.Context, messageID string) error {
+	return nil
+}
+
+func (m *MongoIndexer) Close() error {
+	return nil
+}
+
+func (m *MongoIndexer) Search(ctx context.Context, q *Query) (*Results, error) {
+	results := &Results{Hits: []Hit{}}
+
+	conversationIDs := make([]primitive.ObjectID, 0, len(q.ConversationIDs))
+	for _, id := range q.ConversationIDs {
+		if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+			conversationIDs = append(conversationIDs, objID)
+		}
+	}
+	if len(conversationIDs) == 0 {
+		return results, nil
+	}
+
+	filter := bson.M{
+		"$text":           bson.M{"$search": q.Text},
+		"conversation_id": bson.M{"$in": conversationIDs},
+		"deleted":         bson.M{"$ne": true},
+		"expires_at":      bson.M{"$not": bson.M{"$lte": time.Now()}},
+	}
+	if uid, err := primitive.ObjectIDFromHex(q.UserID); err == nil {
+		filter["deleted_for"] = bson.M{"$ne": uid}
+	}
+	if q.SenderID != "" {
+		senderID, err := primitive.ObjectIDFromHex(q.SenderID)
+		if err != nil {
+			return results, nil
+		}
+		filter["sender_id"] = senderID
+	}
+	if q.Type != "" {
+		filter["type"] = q.Type
+	}
+
+	timestamp := bson.M{}
+	if !q.From.IsZero() {
+		timestamp["$gte"] = q.From
+	}
+	if !q.To.IsZero() {
+		timestamp["$lte"] = q.To
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+
+	collection := m.db.DB.Collection("messages")
+
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	results.Total = int(total)
+
+	opts := options.Find().
+		SetProjection(bson.M{"_id": 1, "score": bson.M{"$meta": "textScore"}}).
+		SetSort(bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "timestamp", Value: -1}}).
+		SetLimit(int64(q.Limit)).
+		SetSkip(int64(q.Skip))
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var hit struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Score float64            `bson:"score"`
+		}
+		if err := cursor.Decode(&hit); err != nil {
+			continue
+		}
+		results.Hits = append(results.Hits, Hit{MessageID: hit.ID.Hex(), Score: hit.Score})
+	}
+
+	return results, nil
+}
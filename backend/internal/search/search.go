@@ -0,0 +1,84 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+)
+
+// Indexer is the search backend fed by message.Service on every create,
+// edit and delete. Implementations must only return messages from the
+// conversations listed in the query.
+type Indexer interface {
+	Index(ctx context.Context, doc *Document) error
+	Delete(ctx context.Context, messageID string) error
+	Search(ctx context.Context, q *Query) (*Results, error)
+	Close() error
+}
+
+// Document is the searchable projection of a message
+type Document struct {
+	MessageID      string     `json:"message_id"`
+	ConversationID string     `json:"conversation_id"`
+	SenderID       string     `json:"sender_id"`
+	Type           string     `json:"type"`
+	Content        string     `json:"content,omitempty"`
+	Timestamp      time.Time  `json:"timestamp"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	HiddenFor      []string   `json:"hidden_for,omitempty"`
+}
+
+type Query struct {
+	Text            string
+	UserID          string
+	ConversationIDs []string
+	SenderID        string
+	Type            string
+	From            time.Time
+	To              time.Time
+	Limit           int
+	Skip            int
+}
+
+type Hit struct {
+	MessageID string  `json:"message_id"`
+	Score     float64 `json:"score"`
+}
+
+type Results struct {
+	Hits  []Hit `json:"hits"`
+	Total int   `json:"total"`
+}
+
+// DocumentFromMessage builds the index document for a stored message
+func DocumentFromMessage(msg *models.Message) *Document {
+	doc := &Document{
+		MessageID:      msg.ID.Hex(),
+		ConversationID: msg.ConversationID.Hex(),
+		SenderID:       msg.SenderID.Hex(),
+		Type:           msg.Type,
+		Content:        msg.Content,
+		Timestamp:      msg.Timestamp,
+		ExpiresAt:      msg.ExpiresAt,
+	}
+	for _, id := range msg.DeletedFor {
+		doc.HiddenFor = append(doc.HiddenFor, id.Hex())
+	}
+	return doc
+}
+
+// New returns the indexer selected by cfg.SearchBackend
+func New(cfg *config.Config, db *database.Database) (Indexer, error) {
+	switch cfg.SearchBackend {
+	case "", "mongo":
+		return NewMongoIndexer(db), nil
+	case "local":
+		return OpenLocalIndex(cfg.SearchIndexPath)
+	default:
+		return nil, fmt.Errorf("unknown search backend: %s", cfg.SearchBackend)
+	}
+}
@@ -1,15 +1,32 @@
 package user
 
 import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
 	"github.com/gofiber/fiber/v2"
 )
 
 type Handler struct {
-	service *Service
+	service   *Service
+	wsManager WSManager
+}
+
+type WSManager interface {
+	SendToUser(userID string, message interface{}) error
+	// PresenceChanged pushes the user's presence, including their custom
+	// status, to those watching it
+	PresenceChanged(userID string)
 }
 
-func NewHandler(service *Service) *Handler {
-	return &Handler{service: service}
+func NewHandler(service *Service, wsManager WSManager) *Handler {
+	return &Handler{
+		service:   service,
+		wsManager: wsManager,
+	}
 }
 
 func (h *Handler) GetMe(c *fiber.Ctx) error {
@@ -26,9 +43,10 @@ func (h *Handler) GetMe(c *fiber.Ctx) error {
 }
 
 func (h *Handler) GetByID(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
 	id := c.Params("id")
 
-	user, err := h.service.GetByID(c.Context(), id)
+	user, err := h.service.GetForViewer(c.Context(), userID, id)
 	if err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": err.Error(),
@@ -41,20 +59,98 @@ func (h *Handler) GetByID(c *fiber.Ctx) error {
 func (h *Handler) UpdateMe(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(string)
 
-	var updates map[string]interface{}
-	if err := c.BodyParser(&updates); err != nil {
+	var update ProfileUpdate
+	if err := c.BodyParser(&update); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "invalid request body",
 		})
 	}
 
-	if err := h.service.Update(c.Context(), userID, updates); err != nil {
+	user, err := h.service.UpdateProfile(c.Context(), userID, &update)
+	if err != nil {
+		var fields validation.Errors
+		if errors.As(err, &fields) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":  err.Error(),
+				"fields": fields,
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 
-	return c.JSON(fiber.Map{"message": "user updated successfully"})
+	if update.ChangesPublicProfile() {
+		h.notifyContacts(c.Context(), user)
+	}
+
+	return c.JSON(user)
+}
+
+// SetStatus sets the caller's custom status
+func (h *Handler) SetStatus(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	var update StatusUpdate
+	if err := c.BodyParser(&update); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	status, err := h.service.SetStatus(c.Context(), userID, &update)
+	if err != nil {
+		var fields validation.Errors
+		if errors.As(err, &fields) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":  err.Error(),
+				"fields": fields,
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	h.wsManager.PresenceChanged(userID)
+	return c.JSON(status)
+}
+
+func (h *Handler) ClearStatus(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(string)
+
+	if err := h.service.ClearStatus(c.Context(), userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	h.wsManager.PresenceChanged(userID)
+	return c.JSON(fiber.Map{"message": "status cleared"})
+}
+
+// notifyContacts sends the user's new public profile to everyone who has
+// them as a contact
+func (h *Handler) notifyContacts(ctx context.Context, user *models.User) {
+	watchers, err := h.service.ContactWatchers(ctx, user.ID.Hex())
+	if err != nil {
+		log.Printf("Failed to find contacts to notify of profile update: %v", err)
+		return
+	}
+
+	event := map[string]interface{}{
+		"type":    "profile_updated",
+		"user_id": user.ID.Hex(),
+		"profile": map[string]interface{}{
+			"username":        user.Username,
+			"display_name":    user.DisplayName,
+			"profile_picture": user.ProfilePicture,
+			"status_message":  user.StatusMessage,
+		},
+	}
+	for _, watcher := range watchers {
+		_ = h.wsManager.SendToUser(watcher, event)
+	}
 }
 
 func (h *Handler) Search(c *fiber.Ctx) error {
@@ -65,7 +161,8 @@ func (h *Handler) Search(c *fiber.Ctx) error {
 		})
 	}
 
-	users, err := h.service.Search(c.Context(), query, 20)
+	userID := c.Locals("userID").(string)
+	users, err := h.service.Search(c.Context(), userID, query, 20)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": err.Error(),
@@ -3,10 +3,17 @@ package user
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/url"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/presence"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -40,28 +47,223 @@ func (s *Service) GetByID(ctx context.Context, userID string) (*models.User, err
 	return &user, nil
 }
 
-func (s *Service) Update(ctx context.Context, userID string, updates map[string]interface{}) error {
-	id, err := primitive.ObjectIDFromHex(userID)
+// GetForViewer returns a user as viewer sees them, without the presence
+// and custom status their privacy settings hide from viewer
+func (s *Service) GetForViewer(ctx context.Context, viewer, userID string) (*models.User, error) {
+	user, err := s.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.hidePresence(ctx, viewer, []*models.User{user}); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// hidePresence clears the presence and custom status of the users viewer
+// may not see, by the same rules as presence updates
+func (s *Service) hidePresence(ctx context.Context, viewer string, users []*models.User) error {
+	viewerID, err := primitive.ObjectIDFromHex(viewer)
 	if err != nil {
 		return errors.New("invalid user ID")
 	}
 
-	updates["updated_at"] = time.Now()
-	delete(updates, "password_hash")
-	delete(updates, "_id")
+	ids := make([]primitive.ObjectID, 0, len(users))
+	for _, user := range users {
+		if user.ID != viewerID {
+			ids = append(ids, user.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var contacts []models.Contact
+	cursor, err := s.db.DB.Collection("contacts").Find(ctx, bson.M{"user_id": bson.M{"$in": ids}, "contact_id": viewerID})
+	if err != nil {
+		return err
+	}
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return err
+	}
+	byUser := make(map[primitive.ObjectID]*models.Contact, len(contacts))
+	for i := range contacts {
+		byUser[contacts[i].UserID] = &contacts[i]
+	}
+
+	for _, user := range users {
+		if user.ID != viewerID && !presence.CanSee(user.Settings.LastSeenPrivacy, byUser[user.ID]) {
+			user.Presence = models.Presence{}
+			user.CustomStatus = nil
+		}
+	}
+	return nil
+}
+
+// ProfileUpdate lists the profile fields a user may change. Nil fields are
+// left as they are; an empty string clears the field.
+type ProfileUpdate struct {
+	DisplayName    *string         `json:"display_name"`
+	StatusMessage  *string         `json:"status_message"`
+	ProfilePicture *string         `json:"profile_picture"`
+	Settings       *SettingsUpdate `json:"settings"`
+}
+
+type SettingsUpdate struct {
+	ReadReceipts    *bool   `json:"read_receipts"`
+	LastSeenPrivacy *string `json:"last_seen_privacy"`
+}
+
+// ChangesPublicProfile reports whether contacts see the change
+func (u *ProfileUpdate) ChangesPublicProfile() bool {
+	return u.DisplayName != nil || u.StatusMessage != nil || u.ProfilePicture != nil
+}
+
+const (
+	maxDisplayNameLength   = 64
+	maxStatusMessageLength = 140
+	maxPictureURLLength    = 2048
+)
+
+var lastSeenPrivacyOptions = map[string]bool{"everyone": true, "contacts": true, "none": true}
+
+// UpdateProfile validates every field in the update, then applies the ones
+// that are set and returns the updated user
+func (s *Service) UpdateProfile(ctx context.Context, userID string, update *ProfileUpdate) (*models.User, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	current, err := s.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	setText := func(key, value string) {
+		if value == "" {
+			unset[key] = ""
+		} else {
+			set[key] = value
+		}
+	}
+
+	errs := validation.Errors{}
+	if update.DisplayName != nil {
+		name := strings.TrimSpace(*update.DisplayName)
+		errs.Add("display_name", checkText(name, "display name", maxDisplayNameLength))
+		setText("display_name", name)
+	}
+	if update.StatusMessage != nil {
+		message := strings.TrimSpace(*update.StatusMessage)
+		errs.Add("status_message", checkText(message, "status message", maxStatusMessageLength))
+		setText("status_message", message)
+	}
+	if update.ProfilePicture != nil {
+		picture := strings.TrimSpace(*update.ProfilePicture)
+		errs.Add("profile_picture", checkPictureURL(picture))
+		setText("profile_picture", picture)
+	}
+	if update.Settings != nil {
+		if update.Settings.ReadReceipts != nil {
+			set["settings.read_receipts"] = *update.Settings.ReadReceipts
+		}
+		if privacy := update.Settings.LastSeenPrivacy; privacy != nil {
+			if !lastSeenPrivacyOptions[*privacy] {
+				errs.Add("last_seen_privacy", errors.New("last seen privacy must be everyone, contacts or none"))
+			}
+			set["settings.last_seen_privacy"] = *privacy
+		}
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+	if len(set) == 0 && len(unset) == 0 {
+		return current, nil
+	}
+
+	set["updated_at"] = time.Now()
+	change := bson.M{"$set": set}
+	if len(unset) > 0 {
+		change["$unset"] = unset
+	}
 
-	_, err = s.db.DB.Collection("users").UpdateOne(
+	var user models.User
+	err = s.db.DB.Collection("users").FindOneAndUpdate(
 		ctx,
 		bson.M{"_id": id},
-		bson.M{"$set": updates},
-	)
-	return err
+		change,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	user.PasswordHash = ""
+	return &user, nil
 }
 
-func (s *Service) Search(ctx context.Context, query string, limit int64) ([]*models.User, error) {
+// ContactWatchers returns the IDs of users who have userID in their
+// contacts and haven't blocked them
+func (s *Service) ContactWatchers(ctx context.Context, userID string) ([]string, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	ids, err := s.db.DB.Collection("contacts").Distinct(ctx, "user_id", bson.M{"contact_id": id, "blocked": false})
+	if err != nil {
+		return nil, err
+	}
+
+	watchers := make([]string, 0, len(ids))
+	for _, watcher := range ids {
+		if oid, ok := watcher.(primitive.ObjectID); ok {
+			watchers = append(watchers, oid.Hex())
+		}
+	}
+	return watchers, nil
+}
+
+func checkText(value, name string, maxLength int) error {
+	if utf8.RuneCountInString(value) > maxLength {
+		return fmt.Errorf("%s must be at most %d characters", name, maxLength)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%s must not contain control characters", name)
+		}
+	}
+	return nil
+}
+
+// checkPictureURL accepts an http(s) URL or a path on this server, such as
+// a media URL
+func checkPictureURL(picture string) error {
+	if picture == "" {
+		return nil
+	}
+	if len(picture) > maxPictureURLLength {
+		return errors.New("profile picture URL is too long")
+	}
+	if strings.HasPrefix(picture, "/") && !strings.HasPrefix(picture, "//") {
+		return nil
+	}
+	u, err := url.Parse(picture)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("profile picture must be an http(s) URL")
+	}
+	return nil
+}
+
+// Search finds users by name or email, as viewer sees them
+func (s *Service) Search(ctx context.Context, viewer, query string, limit int64) ([]*models.User, error) {
 	filter := bson.M{
 		"$or": []bson.M{
 			{"username": bson.M{"$regex": query, "$options": "i"}},
+			{"display_name": bson.M{"$regex": query, "$options": "i"}},
 			{"email": bson.M{"$regex": query, "$options": "i"}},
 		},
 	}
@@ -83,6 +285,9 @@ func (s *Service) Search(ctx context.Context, query string, limit int64) ([]*mod
 		users = append(users, &user)
 	}
 
+	if err := s.hidePresence(ctx, viewer, users); err != nil {
+		return nil, err
+	}
 	return users, nil
 }
 
@@ -120,6 +325,9 @@ func (s *Service) GetContacts(ctx context.Context, userID string) ([]*models.Use
 		users = append(users, &user)
 	}
 
+	if err := s.hidePresence(ctx, userID, users); err != nil {
+		return nil, err
+	}
 	return users, nil
 }
 
@@ -0,0 +1,124 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/validation"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxStatusTextLength  = 100
+	maxStatusEmojiLength = 8 // runes; flags and skin tones take several
+)
+
+// StatusUpdate sets a custom status. ExpiresAt is optional; without it the
+// status stays until cleared.
+type StatusUpdate struct {
+	Emoji        string     `json:"emoji"`
+	Text         string     `json:"text"`
+	DoNotDisturb bool       `json:"do_not_disturb"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+}
+
+// SetStatus replaces the user's custom status
+func (s *Service) SetStatus(ctx context.Context, userID string, update *StatusUpdate) (*models.CustomStatus, error) {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	now := time.Now()
+	status := &models.CustomStatus{
+		Emoji:        strings.TrimSpace(update.Emoji),
+		Text:         strings.TrimSpace(update.Text),
+		DoNotDisturb: update.DoNotDisturb,
+		ExpiresAt:    update.ExpiresAt,
+		SetAt:        now,
+	}
+
+	errs := validation.Errors{}
+	if n := utf8.RuneCountInString(status.Emoji); n > maxStatusEmojiLength || strings.ContainsAny(status.Emoji, " \t\n") {
+		errs.Add("emoji", errors.New("emoji must be a single emoji"))
+	}
+	errs.Add("text", checkText(status.Text, "status text", maxStatusTextLength))
+	if status.ExpiresAt != nil && !status.ExpiresAt.After(now) {
+		errs.Add("expires_at", errors.New("expiry must be in the future"))
+	}
+	if status.Emoji == "" && status.Text == "" && !status.DoNotDisturb {
+		errs.Add("text", errors.New("set an emoji, a text or do not disturb"))
+	}
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+
+	result, err := s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"custom_status": status, "updated_at": now}},
+	)
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, errors.New("user not found")
+	}
+	return status, nil
+}
+
+// ClearStatus removes the user's custom status, ending do not disturb
+func (s *Service) ClearStatus(ctx context.Context, userID string) error {
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return errors.New("invalid user ID")
+	}
+
+	_, err = s.db.DB.Collection("users").UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{
+			"$unset": bson.M{"custom_status": ""},
+			"$set":   bson.M{"updated_at": time.Now()},
+		},
+	)
+	return err
+}
+
+// ClearExpiredStatuses removes statuses past their expiry and returns the
+// users whose status was cleared
+func (s *Service) ClearExpiredStatuses(ctx context.Context) ([]string, error) {
+	users := s.db.DB.Collection("users")
+	now := time.Now()
+
+	var expired []models.User
+	cursor, err := users.Find(ctx, bson.M{"custom_status.expires_at": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &expired); err != nil {
+		return nil, err
+	}
+
+	cleared := make([]string, 0, len(expired))
+	for _, user := range expired {
+		// Match the expiry so a status set in the meantime survives
+		result, err := users.UpdateOne(
+			ctx,
+			bson.M{"_id": user.ID, "custom_status.expires_at": user.CustomStatus.ExpiresAt},
+			bson.M{"$unset": bson.M{"custom_status": ""}},
+		)
+		if err != nil {
+			return cleared, err
+		}
+		if result.ModifiedCount > 0 {
+			cleared = append(cleared, user.ID.Hex())
+		}
+	}
+	return cleared, nil
+}
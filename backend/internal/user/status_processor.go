@@ -0,0 +1,66 @@
+package user
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// StatusProcessor clears expired custom statuses every interval and
+// announces each change
+type StatusProcessor struct {
+	service   *Service
+	wsManager WSManager
+	interval  time.Duration
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewStatusProcessor(service *Service, wsManager WSManager, interval time.Duration) *StatusProcessor {
+	return &StatusProcessor{
+		service:   service,
+		wsManager: wsManager,
+		interval:  interval,
+		stop:      make(chan struct{}),
+	}
+}
+
+func (p *StatusProcessor) Start() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+func (p *StatusProcessor) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *StatusProcessor) run() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.clearExpired()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *StatusProcessor) clearExpired() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	cleared, err := p.service.ClearExpiredStatuses(ctx)
+	if err != nil {
+		log.Printf("Failed to clear expired statuses: %v", err)
+	}
+	for _, userID := range cleared {
+		p.wsManager.PresenceChanged(userID)
+	}
+}
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/presence"
+)
+
+// setActivity records an activity frame from the client. Repeated "active"
+// frames are only written out once per PresenceInterval.
+func (c *Client) setActivity(ctx context.Context, state string) {
+	now := time.Now()
+
+	c.mu.Lock()
+	changed := c.activity != state || c.away
+	if state == presence.ActivityActive {
+		changed = changed || now.Sub(c.lastActivity) >= c.Manager.cfg.PresenceInterval
+		c.lastActivity = now
+		c.away = false
+	}
+	c.activity = state
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if err := c.Manager.presenceService.SetActivity(ctx, c.ID, state); err != nil {
+		log.Printf("Failed to save activity for %s: %v", c.ID, err)
+		return
+	}
+	go c.Manager.refreshPresence(c.UserID)
+}
+
+// watchActivity puts users away once their active connections have gone
+// unused for PresenceAwayAfter
+func (m *Manager) watchActivity() {
+	ticker := time.NewTicker(m.cfg.PresenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkActivity()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Manager) checkActivity() {
+	now := time.Now()
+	users := map[string]bool{}
+
+	m.connections.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		client.mu.Lock()
+		if client.activity == presence.ActivityActive && !client.away && now.Sub(client.lastActivity) >= m.cfg.PresenceAwayAfter {
+			client.away = true
+			users[client.UserID] = true
+		}
+		client.mu.Unlock()
+		return true
+	})
+
+	for userID := range users {
+		m.refreshPresence(userID)
+	}
+}
+
+// refreshPresence recomputes a user's presence and, when it changed,
+// tells the connections watching them
+func (m *Manager) refreshPresence(userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, changed, err := m.presenceService.Refresh(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to refresh presence for %s: %v", userID, err)
+		return
+	}
+	if changed {
+		m.announcePresence(userID)
+	}
+}
+
+// PresenceChanged pushes a user's presence after something besides their
+// connections changed it, such as their custom status
+func (m *Manager) PresenceChanged(userID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, _, err := m.presenceService.Refresh(ctx, userID); err != nil {
+		log.Printf("Failed to refresh presence for %s: %v", userID, err)
+		return
+	}
+	m.announcePresence(userID)
+}
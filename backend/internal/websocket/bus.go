@@ -0,0 +1,156 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/eventbus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Events exchanged with other instances
+const (
+	eventSend         = "send"          // deliver to a user's connections
+	eventCloseSession = "close_session" // a session was revoked
+	eventCloseDevice  = "close_device"  // a device was signed out
+	eventPresence     = "presence"      // a user's presence changed
+	eventConnected    = "connected"     // a user opened a connection
+)
+
+type busEvent struct {
+	UserID           string          `json:"user_id,omitempty"`
+	Message          json.RawMessage `json:"message,omitempty"`
+	ExceptConnection string          `json:"except_connection,omitempty"`
+	SessionID        string          `json:"session_id,omitempty"`
+	DeviceID         string          `json:"device_id,omitempty"`
+}
+
+// HandleEvent applies an event another instance published to the
+// connections held here
+func (m *Manager) HandleEvent(event *eventbus.Event) {
+	var e busEvent
+	if err := json.Unmarshal(event.Data, &e); err != nil {
+		log.Printf("Invalid %s event from %s: %v", event.Type, event.Origin, err)
+		return
+	}
+
+	switch event.Type {
+	case eventSend:
+		m.broadcast <- &BroadcastMessage{
+			UserID:           e.UserID,
+			Message:          e.Message,
+			ExceptConnection: e.ExceptConnection,
+		}
+	case eventCloseSession:
+		m.closeSession(e.SessionID)
+	case eventCloseDevice:
+		m.closeDevice(e.UserID, e.DeviceID)
+	case eventPresence:
+		// The copy cached here predates the change
+		m.presenceService.Forget(e.UserID)
+		m.presenceChanged(e.UserID)
+	case eventConnected:
+		m.instanceCache.Delete(e.UserID)
+	default:
+		log.Printf("Unknown event type from %s: %s", event.Origin, event.Type)
+	}
+}
+
+// publish sends an event to the given instances, or to all with none
+func (m *Manager) publish(eventType string, targets []string, e busEvent) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = m.bus.Publish(ctx, &eventbus.Event{Type: eventType, Targets: targets, Data: data})
+	if err != nil {
+		log.Printf("Failed to publish %s event: %v", eventType, err)
+	}
+}
+
+// deliver sends an event to a user's connections here and on every other
+// instance holding one of them
+func (m *Manager) deliver(broadcast *BroadcastMessage) {
+	m.broadcast <- broadcast
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	instances, err := m.remoteInstances(ctx, broadcast.UserID)
+	if err != nil {
+		log.Printf("Failed to look up connections of %s: %v", broadcast.UserID, err)
+		return
+	}
+	if len(instances) == 0 {
+		return
+	}
+
+	message, err := json.Marshal(broadcast.Message)
+	if err != nil {
+		return
+	}
+	m.publish(eventSend, instances, busEvent{
+		UserID:           broadcast.UserID,
+		Message:          message,
+		ExceptConnection: broadcast.ExceptConnection,
+	})
+}
+
+// instanceCacheTTL bounds how long an event is still sent to an instance
+// the user has disconnected from, which drops it
+const instanceCacheTTL = 10 * time.Second
+
+// remoteInstances returns the other instances a user has live connections
+// on. Answers are cached briefly; a new connection clears them on every
+// instance, so none misses an event for it.
+func (m *Manager) remoteInstances(ctx context.Context, userID string) ([]string, error) {
+	if _, ok := m.bus.(*eventbus.LocalBus); ok {
+		return nil, nil
+	}
+	id, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.instanceCache.GetOrLoad(ctx, userID, instanceCacheTTL, func(ctx context.Context) ([]string, error) {
+		values, err := m.db.DB.Collection("active_connections").Distinct(ctx, "server_instance", bson.M{
+			"user_id":         id,
+			"server_instance": bson.M{"$ne": m.cfg.ServerID},
+			"expires_at":      bson.M{"$gt": time.Now()},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		instances := make([]string, 0, len(values))
+		for _, value := range values {
+			if instance, ok := value.(string); ok && instance != "" {
+				instances = append(instances, instance)
+			}
+		}
+		return instances, nil
+	})
+}
+
+// connected reports whether a user has a live connection on any instance
+func (m *Manager) connected(ctx context.Context, userID string) bool {
+	if connections, ok := m.userConnections.Load(userID); ok && len(connections.([]string)) > 0 {
+		return true
+	}
+	instances, err := m.remoteInstances(ctx, userID)
+	return err == nil && len(instances) > 0
+}
+
+// announcePresence pushes a presence change to the user's watchers on
+// every instance
+func (m *Manager) announcePresence(userID string) {
+	m.presenceChanged(userID)
+	m.publish(eventPresence, nil, busEvent{UserID: userID})
+}
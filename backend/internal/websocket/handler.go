@@ -1,8 +1,11 @@
 package websocket
 
 import (
+	"context"
 	"log"
+	"time"
 
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/device"
 	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
 )
@@ -17,13 +20,36 @@ func NewHandler(manager *Manager) *Handler {
 
 func (h *Handler) HandleWebSocket(c *websocket.Conn) {
 	userID := c.Locals("userID").(string)
+	sessionID, _ := c.Locals("sessionID").(string)
+	tokenExpiry, _ := c.Locals("tokenExpiry").(time.Time)
+	ip, _ := c.Locals("ip").(string)
+
+	// The token was checked at upgrade; the session may have been revoked
+	// since it was issued
+	if !h.manager.SessionActive(context.Background(), sessionID) {
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(CloseSessionRevoked, "session revoked"))
+		c.Close()
+		return
+	}
+
+	info := device.Info{
+		DeviceID:  c.Query("device_id"),
+		Type:      c.Query("device_type"),
+		Name:      c.Query("device_name"),
+		UserAgent: c.Headers("User-Agent"),
+		IP:        ip,
+	}.Normalize(sessionID)
 
 	client := &Client{
-		ID:      uuid.New().String(),
-		UserID:  userID,
-		Conn:    c,
-		Manager: h.manager,
-		Send:    make(chan []byte, 256),
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		SessionID:   sessionID,
+		TokenExpiry: tokenExpiry,
+		Device:      info,
+		Conn:        c,
+		Manager:     h.manager,
+		Send:        make(chan []byte, 256),
+		closing:     make(chan closeRequest, 1),
 	}
 
 	h.manager.register <- client
@@ -7,12 +7,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/device"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/message"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/models"
 	"github.com/ganeshkantimahanthi/messaging-platform/internal/presence"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/cache"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
 	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/eventbus"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/jwtkeys"
 	"github.com/gofiber/websocket/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -21,28 +24,49 @@ import (
 type Manager struct {
 	connections     sync.Map // connectionID -> *Client
 	userConnections sync.Map // userID -> []connectionID
+	subscriptions   *presenceSubscriptions
 	db              *database.Database
-	cache           *cache.Cache
 	messageService  *message.Service
 	presenceService *presence.Service
+	devices         *device.Service
+	bus             eventbus.Bus
 	cfg             *config.Config
+	keys            *jwtkeys.KeySet
+	sessionCache    cache.Cache[string, bool]     // session ID -> active
+	instanceCache   cache.Cache[string, []string] // user ID -> other instances with a connection
 	register        chan *Client
 	unregister      chan *Client
 	broadcast       chan *BroadcastMessage
+	done            chan struct{}
 }
 
 type Client struct {
 	ID            string
 	UserID        string
+	SessionID     string
+	TokenExpiry   time.Time
+	Device        device.Info
 	Conn          *websocket.Conn
 	Manager       *Manager
 	Send          chan []byte
 	LastHeartbeat time.Time
+
+	mu           sync.Mutex // guards SessionID, TokenExpiry and activity
+	activity     string
+	lastActivity time.Time
+	away         bool
+	closing      chan closeRequest
+	closeOnce    sync.Once
 }
 
 type BroadcastMessage struct {
 	UserID  string
 	Message interface{}
+	// ExceptConnection skips one of the user's connections, usually the
+	// one the event came from
+	ExceptConnection string
+	// OnlyConnection delivers to a single connection of the user
+	OnlyConnection string
 }
 
 type WSMessage struct {
@@ -50,20 +74,30 @@ type WSMessage struct {
 	Data json.RawMessage `json:"data"`
 }
 
-func NewManager(db *database.Database, cache *cache.Cache, msgService *message.Service, presService *presence.Service, cfg *config.Config) *Manager {
+func NewManager(db *database.Database, msgService *message.Service, presService *presence.Service, devices *device.Service, bus eventbus.Bus, keys *jwtkeys.KeySet, sessionCache cache.Cache[string, bool], instanceCache cache.Cache[string, []string], cfg *config.Config) *Manager {
 	return &Manager{
 		db:              db,
-		cache:           cache,
 		messageService:  msgService,
 		presenceService: presService,
+		devices:         devices,
+		bus:             bus,
 		cfg:             cfg,
+		keys:            keys,
+		sessionCache:    sessionCache,
+		instanceCache:   instanceCache,
 		register:        make(chan *Client),
 		unregister:      make(chan *Client),
 		broadcast:       make(chan *BroadcastMessage, 256),
+		done:            make(chan struct{}),
+		subscriptions:   newPresenceSubscriptions(),
 	}
 }
 
 func (m *Manager) Run() {
+	go m.watchSessions()
+	go m.watchActivity()
+	go m.watchStale()
+
 	for {
 		select {
 		case client := <-m.register:
@@ -87,20 +121,37 @@ func (m *Manager) registerClient(client *Client) {
 
 	// Save to database
 	ctx := context.Background()
+	now := time.Now()
+	client.mu.Lock()
+	client.activity = presence.ActivityActive
+	client.lastActivity = now
+	client.mu.Unlock()
 	m.db.DB.Collection("active_connections").InsertOne(ctx, &models.ActiveConnection{
 		UserID:         mustObjectID(client.UserID),
 		ConnectionID:   client.ID,
-		DeviceType:     "web",
-		ConnectedAt:    time.Now(),
-		LastHeartbeat:  time.Now(),
-		ExpiresAt:      time.Now().Add(m.cfg.WSConnectionTimeout),
+		DeviceID:       client.Device.DeviceID,
+		DeviceType:     client.Device.Type,
+		Activity:       presence.ActivityActive,
+		LastActivity:   now,
+		ConnectedAt:    now,
+		LastHeartbeat:  now,
+		ExpiresAt:      now.Add(m.cfg.WSConnectionTimeout),
 		ServerInstance: m.cfg.ServerID,
 	})
+	if _, ok := m.bus.(*eventbus.LocalBus); !ok {
+		go m.publish(eventConnected, nil, busEvent{UserID: client.UserID})
+	}
+
+	if client.Device.DeviceID != "" {
+		sessionID, _ := client.session()
+		if _, err := m.devices.Register(ctx, client.UserID, sessionID, client.Device); err != nil {
+			log.Printf("Failed to register device for user %s: %v", client.UserID, err)
+		}
+	}
 
-	// Set user online
-	m.presenceService.SetOnline(ctx, client.UserID, client.ID)
+	go m.refreshPresence(client.UserID)
 
-	log.Printf("Client registered: %s (User: %s)", client.ID, client.UserID)
+	log.Printf("Client registered: %s (User: %s, Device: %s)", client.ID, client.UserID, client.Device.DeviceID)
 
 	// Send queued messages
 	go m.sendQueuedMessages(client)
@@ -109,6 +160,7 @@ func (m *Manager) registerClient(client *Client) {
 func (m *Manager) unregisterClient(client *Client) {
 	// Remove connection
 	m.connections.Delete(client.ID)
+	m.subscriptions.remove(client)
 
 	// Update user connections
 	if connections, ok := m.userConnections.Load(client.UserID); ok {
@@ -122,9 +174,6 @@ func (m *Manager) unregisterClient(client *Client) {
 
 		if len(newList) == 0 {
 			m.userConnections.Delete(client.UserID)
-			// Set user offline
-			ctx := context.Background()
-			m.presenceService.SetOffline(ctx, client.UserID)
 		} else {
 			m.userConnections.Store(client.UserID, newList)
 		}
@@ -133,6 +182,12 @@ func (m *Manager) unregisterClient(client *Client) {
 	// Remove from database
 	ctx := context.Background()
 	m.db.DB.Collection("active_connections").DeleteOne(ctx, bson.M{"connection_id": client.ID})
+	if client.Device.DeviceID != "" {
+		m.devices.Touch(ctx, client.UserID, client.Device.DeviceID)
+	}
+
+	// The user may still be connected elsewhere
+	go m.refreshPresence(client.UserID)
 
 	close(client.Send)
 	log.Printf("Client unregistered: %s (User: %s)", client.ID, client.UserID)
@@ -146,6 +201,12 @@ func (m *Manager) broadcastToUser(broadcast *BroadcastMessage) {
 		}
 
 		for _, connID := range connections.([]string) {
+			if connID == broadcast.ExceptConnection {
+				continue
+			}
+			if broadcast.OnlyConnection != "" && connID != broadcast.OnlyConnection {
+				continue
+			}
 			if client, ok := m.connections.Load(connID); ok {
 				select {
 				case client.(*Client).Send <- data:
@@ -158,14 +219,65 @@ func (m *Manager) broadcastToUser(broadcast *BroadcastMessage) {
 	}
 }
 
+// SendToUser delivers an event to all of a user's connections, on any
+// instance
 func (m *Manager) SendToUser(userID string, message interface{}) error {
-	m.broadcast <- &BroadcastMessage{
+	m.deliver(&BroadcastMessage{
 		UserID:  userID,
-		Message: message,
+		Message: m.silenceIfDND(userID, message),
+	})
+	return nil
+}
+
+// silenceIfDND marks new messages for a user in do not disturb as silent,
+// so clients deliver them without notifying
+func (m *Manager) silenceIfDND(userID string, message interface{}) interface{} {
+	event, ok := message.(map[string]interface{})
+	if !ok || event["type"] != "new_message" {
+		return message
+	}
+	if !m.presenceService.DoNotDisturb(context.Background(), userID) {
+		return message
 	}
+
+	silenced := make(map[string]interface{}, len(event)+1)
+	for k, v := range event {
+		silenced[k] = v
+	}
+	silenced["silent"] = true
+	return silenced
+}
+
+// SendToUserExcept delivers an event to all of a user's connections but
+// one, such as the user's other devices
+func (m *Manager) SendToUserExcept(userID, connectionID string, message interface{}) error {
+	m.deliver(&BroadcastMessage{
+		UserID:           userID,
+		Message:          message,
+		ExceptConnection: connectionID,
+	})
 	return nil
 }
 
+// CloseDevice disconnects a signed out device on every instance
+func (m *Manager) CloseDevice(userID, deviceID string) {
+	if deviceID == "" {
+		return
+	}
+	m.closeDevice(userID, deviceID)
+	m.publish(eventCloseDevice, nil, busEvent{UserID: userID, DeviceID: deviceID})
+}
+
+func (m *Manager) closeDevice(userID, deviceID string) {
+	m.connections.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		if client.UserID == userID && client.Device.DeviceID == deviceID {
+			client.Close(CloseSessionRevoked, "device signed out")
+		}
+		return true
+	})
+}
+
 func (m *Manager) sendQueuedMessages(client *Client) {
 	ctx := context.Background()
 	messages, err := m.messageService.GetQueuedMessages(ctx, client.UserID, 100)
@@ -174,10 +286,12 @@ func (m *Manager) sendQueuedMessages(client *Client) {
 		return
 	}
 
+	silent := m.presenceService.DoNotDisturb(ctx, client.UserID)
 	for _, msg := range messages {
 		data, _ := json.Marshal(map[string]interface{}{
 			"type":    "queued_message",
 			"message": msg,
+			"silent":  silent,
 		})
 		select {
 		case client.Send <- data:
@@ -191,6 +305,7 @@ func (m *Manager) sendQueuedMessages(client *Client) {
 }
 
 func (m *Manager) Shutdown() {
+	close(m.done)
 	m.connections.Range(func(key, value interface{}) bool {
 		client := value.(*Client)
 		client.Conn.Close()
@@ -262,6 +377,11 @@ func (c *Client) WritePump() {
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case req := <-c.closing:
+			c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(req.code, req.reason))
+			return
 		}
 	}
 }
@@ -275,6 +395,11 @@ func (c *Client) handleMessage(data []byte) {
 
 	ctx := context.Background()
 
+	// Sending and typing show the user is at the device
+	if msg.Type == "send_message" || msg.Type == "typing" {
+		c.setActivity(ctx, presence.ActivityActive)
+	}
+
 	switch msg.Type {
 	case "send_message":
 		c.handleSendMessage(ctx, msg.Data)
@@ -282,6 +407,14 @@ func (c *Client) handleMessage(data []byte) {
 		c.handleTyping(msg.Data)
 	case "read_receipt":
 		c.handleReadReceipt(ctx, msg.Data)
+	case "played":
+		c.handlePlayed(ctx, msg.Data)
+	case "auth":
+		c.handleAuth(ctx, msg.Data)
+	case "subscribe_presence":
+		c.handleSubscribePresence(ctx, msg.Data)
+	case presence.ActivityActive, presence.ActivityIdle, presence.ActivityBackground:
+		c.setActivity(ctx, msg.Type)
 	default:
 		log.Printf("Unknown message type: %s", msg.Type)
 	}
@@ -293,6 +426,7 @@ func (c *Client) handleSendMessage(ctx context.Context, data json.RawMessage) {
 		ConversationID string `json:"conversation_id,omitempty"`
 		Content        string `json:"content"`
 		Type           string `json:"type"`
+		MediaID        string `json:"media_id,omitempty"`
 		TempID         string `json:"temp_id,omitempty"` // Client-side temporary ID
 	}
 
@@ -342,6 +476,16 @@ func (c *Client) handleSendMessage(ctx context.Context, data json.RawMessage) {
 		},
 	}
 
+	if req.MediaID != "" {
+		if err := c.Manager.messageService.AttachMedia(ctx, message, req.MediaID); err != nil {
+			// Send error ACK
+			if req.TempID != "" {
+				c.sendErrorAck(req.TempID, "Invalid media attachment")
+			}
+			return
+		}
+	}
+
 	if err := c.Manager.messageService.CreateMessage(ctx, message); err != nil {
 		// Send error ACK
 		if req.TempID != "" {
@@ -357,7 +501,7 @@ func (c *Client) handleSendMessage(ctx context.Context, data json.RawMessage) {
 	})
 
 	// Update delivery status to "delivered" if recipient is online
-	if connections, ok := c.Manager.userConnections.Load(req.RecipientID); ok && len(connections.([]string)) > 0 {
+	if c.Manager.connected(ctx, req.RecipientID) {
 		// Recipient is online, update to delivered
 		c.Manager.messageService.UpdateStatus(ctx, message.ID.Hex(), req.RecipientID, "delivered")
 
@@ -378,6 +522,13 @@ func (c *Client) handleSendMessage(ctx context.Context, data json.RawMessage) {
 		"status":    "sent",
 	})
 	c.Send <- ack
+
+	// Keep the sender's other devices in sync
+	c.Manager.SendToUserExcept(c.UserID, c.ID, map[string]interface{}{
+		"type":      "message_sent_elsewhere",
+		"message":   message,
+		"device_id": c.Device.DeviceID,
+	})
 }
 
 // sendErrorAck sends a lightweight error acknowledgment to the client
@@ -432,6 +583,30 @@ func (c *Client) handleReadReceipt(ctx context.Context, data json.RawMessage) {
 	}
 }
 
+// handlePlayed marks a voice note as played by this recipient
+func (c *Client) handlePlayed(ctx context.Context, data json.RawMessage) {
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+
+	if err := json.Unmarshal(data, &req); err != nil {
+		return
+	}
+
+	message, err := c.Manager.messageService.MarkPlayed(ctx, req.MessageID, c.UserID)
+	if err != nil {
+		return
+	}
+
+	// Notify sender about played status
+	c.Manager.SendToUser(message.SenderID.Hex(), map[string]interface{}{
+		"type":       "status_update",
+		"message_id": req.MessageID,
+		"status":     "played",
+		"user_id":    c.UserID,
+	})
+}
+
 func mustObjectID(id string) primitive.ObjectID {
 	objID, _ := primitive.ObjectIDFromHex(id)
 	return objID
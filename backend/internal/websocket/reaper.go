@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Reconcile cleans up after a previous run of this instance that crashed
+// before unregistering its connections. It must run before the instance
+// accepts connections, and SERVER_ID must be unique to this instance.
+func (m *Manager) Reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	changed, err := m.presenceService.Reconcile(ctx, m.cfg.ServerID)
+	if err != nil {
+		log.Printf("Failed to reconcile connections for %s: %v", m.cfg.ServerID, err)
+	}
+	for _, userID := range changed {
+		m.announcePresence(userID)
+	}
+}
+
+// watchStale periodically removes connections left behind by instances
+// that went away, so their users don't stay online
+func (m *Manager) watchStale() {
+	ticker := time.NewTicker(m.cfg.WSReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.reapStale()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Manager) reapStale() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	changed, err := m.presenceService.ReapStale(ctx, m.cfg.WSConnectionTimeout)
+	if err != nil {
+		log.Printf("Failed to reap stale connections: %v", err)
+	}
+	for _, userID := range changed {
+		m.announcePresence(userID)
+	}
+}
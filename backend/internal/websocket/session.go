@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/middleware"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Close codes sent when the server ends a connection for auth reasons.
+// 4000-4999 are reserved for applications by RFC 6455.
+const (
+	CloseTokenExpired   = 4001 // re-authenticate with a fresh token and reconnect
+	CloseSessionRevoked = 4003 // signed out; don't reconnect with this session
+)
+
+type closeRequest struct {
+	code   int
+	reason string
+}
+
+// Close asks the write pump to send a close frame with the given code and
+// disconnect. Only the first call has an effect.
+func (c *Client) Close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closing <- closeRequest{code: code, reason: reason}
+	})
+}
+
+func (c *Client) session() (string, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.SessionID, c.TokenExpiry
+}
+
+// CloseSession disconnects every connection of a revoked session, on
+// every instance
+func (m *Manager) CloseSession(sessionID string) {
+	if sessionID == "" {
+		return
+	}
+	m.closeSession(sessionID)
+	m.publish(eventCloseSession, nil, busEvent{SessionID: sessionID})
+}
+
+func (m *Manager) closeSession(sessionID string) {
+	m.sessionCache.Delete(sessionID)
+	m.connections.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		if sid, _ := client.session(); sid == sessionID {
+			client.Close(CloseSessionRevoked, "session revoked")
+		}
+		return true
+	})
+}
+
+// sessionCacheTTL bounds how long a session revoked without CloseSession,
+// such as on refresh token reuse, can still be used
+const sessionCacheTTL = 10 * time.Second
+
+// SessionActive reports whether a session may still be used. Tokens issued
+// before sessions existed carry no session and live until they expire.
+// Answers are cached briefly, and CloseSession clears them on every instance.
+func (m *Manager) SessionActive(ctx context.Context, sessionID string) bool {
+	if sessionID == "" {
+		return true
+	}
+	sid, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return false
+	}
+
+	active, err := m.sessionCache.GetOrLoad(ctx, sessionID, sessionCacheTTL, func(ctx context.Context) (bool, error) {
+		count, err := m.db.DB.Collection("sessions").CountDocuments(ctx, bson.M{
+			"_id":        sid,
+			"revoked_at": nil,
+			"expires_at": bson.M{"$gt": time.Now()},
+		})
+		return count > 0, err
+	})
+	if err != nil {
+		// Don't drop everyone over a database hiccup; the next check retries
+		return true
+	}
+	return active
+}
+
+func (m *Manager) watchSessions() {
+	ticker := time.NewTicker(m.cfg.WSAuthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkSessions()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Manager) checkSessions() {
+	now := time.Now()
+	bySession := map[primitive.ObjectID][]*Client{}
+
+	m.connections.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		sessionID, expiry := client.session()
+
+		if !expiry.IsZero() && now.After(expiry) {
+			client.Close(CloseTokenExpired, "token expired")
+			return true
+		}
+
+		if sid, err := primitive.ObjectIDFromHex(sessionID); err == nil {
+			bySession[sid] = append(bySession[sid], client)
+		}
+		return true
+	})
+
+	if len(bySession) == 0 {
+		return
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(bySession))
+	for id := range bySession {
+		ids = append(ids, id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	active, err := m.db.DB.Collection("sessions").Distinct(ctx, "_id", bson.M{
+		"_id":        bson.M{"$in": ids},
+		"revoked_at": nil,
+		"expires_at": bson.M{"$gt": now},
+	})
+	if err != nil {
+		log.Printf("Failed to check WebSocket sessions: %v", err)
+		return
+	}
+
+	stillActive := make(map[primitive.ObjectID]bool, len(active))
+	for _, id := range active {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			stillActive[oid] = true
+		}
+	}
+	for id, clients := range bySession {
+		if stillActive[id] {
+			continue
+		}
+		for _, client := range clients {
+			client.Close(CloseSessionRevoked, "session revoked")
+		}
+	}
+}
+
+// handleAuth swaps in a fresh access token without reconnecting. The token
+// must belong to the same user and to a live session. Clients should send
+// one before the expires_at they were given, or be closed with 4001.
+func (c *Client) handleAuth(ctx context.Context, data json.RawMessage) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.Unmarshal(data, &req); err != nil {
+		return
+	}
+
+	claims, err := middleware.ParseToken(req.Token, c.Manager.keys)
+	if err != nil || claims.UserID != c.UserID || !c.Manager.SessionActive(ctx, claims.SessionID) {
+		c.sendJSON(map[string]interface{}{
+			"type":  "auth_error",
+			"error": "invalid token",
+		})
+		return
+	}
+
+	c.mu.Lock()
+	c.SessionID = claims.SessionID
+	c.TokenExpiry = claims.ExpiresAt.Time
+	c.mu.Unlock()
+
+	c.sendJSON(map[string]interface{}{
+		"type":       "auth_ok",
+		"expires_at": claims.ExpiresAt.Time,
+	})
+}
+
+func (c *Client) sendJSON(message interface{}) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	select {
+	case c.Send <- data:
+	default:
+	}
+}
@@ -0,0 +1,204 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/internal/presence"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// presenceSubscriptions tracks which connections on this instance watch
+// which users' presence
+type presenceSubscriptions struct {
+	mu       sync.Mutex
+	watchers map[string]map[*Client]bool // watched user -> connections
+	byClient map[*Client]map[string]bool
+	pending  map[string]bool   // users with a debounced push scheduled
+	lastSent map[string]string // presence last pushed for each watched user
+}
+
+func newPresenceSubscriptions() *presenceSubscriptions {
+	return &presenceSubscriptions{
+		watchers: map[string]map[*Client]bool{},
+		byClient: map[*Client]map[string]bool{},
+		pending:  map[string]bool{},
+		lastSent: map[string]string{},
+	}
+}
+
+// replace sets the users a connection watches
+func (p *presenceSubscriptions) replace(client *Client, userIDs []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.removeLocked(client)
+	if len(userIDs) == 0 {
+		return
+	}
+
+	set := make(map[string]bool, len(userIDs))
+	for _, userID := range userIDs {
+		set[userID] = true
+		if p.watchers[userID] == nil {
+			p.watchers[userID] = map[*Client]bool{}
+		}
+		p.watchers[userID][client] = true
+	}
+	p.byClient[client] = set
+}
+
+// remove drops every subscription of a closed connection
+func (p *presenceSubscriptions) remove(client *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.removeLocked(client)
+}
+
+func (p *presenceSubscriptions) removeLocked(client *Client) {
+	for userID := range p.byClient[client] {
+		delete(p.watchers[userID], client)
+		if len(p.watchers[userID]) == 0 {
+			delete(p.watchers, userID)
+			delete(p.lastSent, userID)
+		}
+	}
+	delete(p.byClient, client)
+}
+
+func (p *presenceSubscriptions) clients(userID string) []*Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	clients := make([]*Client, 0, len(p.watchers[userID]))
+	for client := range p.watchers[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// handleSubscribePresence replaces the set of users this connection
+// watches and answers with their current presence. An empty list
+// unsubscribes from everyone.
+func (c *Client) handleSubscribePresence(ctx context.Context, data json.RawMessage) {
+	var req struct {
+		UserIDs []string `json:"user_ids"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool, len(req.UserIDs))
+	userIDs := make([]string, 0, len(req.UserIDs))
+	for _, userID := range req.UserIDs {
+		if _, err := primitive.ObjectIDFromHex(userID); err != nil || seen[userID] {
+			continue
+		}
+		seen[userID] = true
+		userIDs = append(userIDs, userID)
+	}
+	if max := c.Manager.cfg.PresenceMaxSubs; len(userIDs) > max {
+		c.sendJSON(map[string]interface{}{
+			"type":  "error",
+			"error": fmt.Sprintf("at most %d presence subscriptions are allowed", max),
+		})
+		return
+	}
+
+	c.Manager.subscriptions.replace(c, userIDs)
+
+	presence, err := c.Manager.presenceService.Snapshot(ctx, c.UserID, userIDs)
+	if err != nil {
+		log.Printf("Failed to load presence for %s: %v", c.UserID, err)
+		return
+	}
+	c.sendJSON(map[string]interface{}{
+		"type":     "presence_snapshot",
+		"presence": presence,
+	})
+}
+
+// presenceChanged schedules a push to a user's watchers. Changes within
+// PresenceDebounce of each other are sent as one, and presence that
+// flips back in that time isn't sent at all.
+func (m *Manager) presenceChanged(userID string) {
+	p := m.subscriptions
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.watchers[userID]) == 0 || p.pending[userID] {
+		return
+	}
+	p.pending[userID] = true
+	time.AfterFunc(m.cfg.PresenceDebounce, func() { m.pushPresence(userID) })
+}
+
+func (m *Manager) pushPresence(userID string) {
+	p := m.subscriptions
+	p.mu.Lock()
+	delete(p.pending, userID)
+	p.mu.Unlock()
+
+	clients := p.clients(userID)
+	if len(clients) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	info, err := m.presenceService.GetPresence(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to load presence for %s: %v", userID, err)
+		return
+	}
+
+	key := presenceKey(info)
+	p.mu.Lock()
+	unchanged := p.lastSent[userID] == key
+	p.lastSent[userID] = key
+	p.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	viewers := make([]string, 0, len(clients))
+	for _, client := range clients {
+		viewers = append(viewers, client.UserID)
+	}
+	visible, err := m.presenceService.VisibleTo(ctx, userID, viewers)
+	if err != nil {
+		log.Printf("Failed to check presence privacy for %s: %v", userID, err)
+		return
+	}
+
+	event := map[string]interface{}{
+		"type":      "presence_update",
+		"user_id":   userID,
+		"status":    info.Status,
+		"last_seen": info.LastSeen,
+	}
+	if info.CustomStatus != nil {
+		event["custom_status"] = info.CustomStatus
+	}
+	for _, client := range clients {
+		if visible[client.UserID] {
+			// Through the broadcast loop, which never writes to a
+			// connection that has been unregistered
+			m.broadcast <- &BroadcastMessage{UserID: client.UserID, Message: event, OnlyConnection: client.ID}
+		}
+	}
+}
+
+// presenceKey identifies what watchers see of a user's presence
+func presenceKey(info *presence.PresenceInfo) string {
+	key := info.Status
+	if status := info.CustomStatus; status != nil {
+		key += fmt.Sprintf("|%s|%s|%t|%s", status.Emoji, status.Text, status.DoNotDisturb, status.SetAt)
+	}
+	return key
+}
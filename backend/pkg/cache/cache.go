@@ -1,98 +1,76 @@
 package cache
 
 import (
-	"sync"
+	"context"
+	"fmt"
 	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"golang.org/x/sync/singleflight"
 )
 
-type Cache struct {
-	data     sync.Map
-	ttl      time.Duration
-	stopChan chan struct{}
+// Cache holds values for a while. Values may disappear before their TTL
+// when the cache is full.
+type Cache[K comparable, V any] interface {
+	Get(key K) (V, bool)
+	// Set stores a value for the cache's default TTL
+	Set(key K, value V)
+	SetWithTTL(key K, value V, ttl time.Duration)
+	Delete(key K)
+	Clear()
+	// GetOrLoad returns the cached value, or calls load and caches what it
+	// returns for ttl (the default TTL when zero). Concurrent callers for
+	// the same key share one load, which isn't cancelled when one of them
+	// gives up. Errors aren't cached, and neither is a value loaded while
+	// its key was written or deleted.
+	GetOrLoad(ctx context.Context, key K, ttl time.Duration, load func(ctx context.Context) (V, error)) (V, error)
+	Stats() Stats
+	// Stop releases background resources; calling it again does nothing
+	Stop()
 }
 
-type cacheItem struct {
-	Value      interface{}
-	Expiration time.Time
+// Stats counts cache activity since the cache was created
+type Stats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"` // removed to make room
+	Expired   uint64 `json:"expired"`
+	Entries   int    `json:"entries"`
 }
 
-func New(ttl, cleanupInterval time.Duration) *Cache {
-	c := &Cache{
-		ttl:      ttl,
-		stopChan: make(chan struct{}),
+// New returns the cache selected by cfg.CacheBackend
+func New[K comparable, V any](cfg *config.Config) (Cache[K, V], error) {
+	switch cfg.CacheBackend {
+	case "", "memory":
+		return NewMemory[K, V](cfg.CacheMaxEntries, cfg.CacheTTL, cfg.CacheCleanupInterval), nil
+	case "none":
+		return NewNop[K, V](), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", cfg.CacheBackend)
 	}
-
-	// Start cleanup goroutine
-	go c.startCleanup(cleanupInterval)
-
-	return c
 }
 
-func (c *Cache) Set(key string, value interface{}) {
-	c.data.Store(key, cacheItem{
-		Value:      value,
-		Expiration: time.Now().Add(c.ttl),
+// loadTimeout bounds a shared load, since no caller's context does
+const loadTimeout = 30 * time.Second
+
+// shareLoad runs load once for concurrent callers with the same key. The
+// load keeps ctx's values but not its cancellation, so one caller giving
+// up doesn't fail the others; each caller waits only as long as its ctx.
+func shareLoad[V any](ctx context.Context, group *singleflight.Group, key string, load func(ctx context.Context) (V, error)) (V, error) {
+	results := group.DoChan(key, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loadTimeout)
+		defer cancel()
+		return load(loadCtx)
 	})
-}
-
-func (c *Cache) SetWithTTL(key string, value interface{}, ttl time.Duration) {
-	c.data.Store(key, cacheItem{
-		Value:      value,
-		Expiration: time.Now().Add(ttl),
-	})
-}
-
-func (c *Cache) Get(key string) (interface{}, bool) {
-	item, ok := c.data.Load(key)
-	if !ok {
-		return nil, false
-	}
-
-	cacheItem := item.(cacheItem)
-	if time.Now().After(cacheItem.Expiration) {
-		c.data.Delete(key)
-		return nil, false
-	}
-
-	return cacheItem.Value, true
-}
 
-func (c *Cache) Delete(key string) {
-	c.data.Delete(key)
-}
-
-func (c *Cache) Clear() {
-	c.data.Range(func(key, value interface{}) bool {
-		c.data.Delete(key)
-		return true
-	})
-}
-
-func (c *Cache) startCleanup(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			c.cleanup()
-		case <-c.stopChan:
-			return
+	var zero V
+	select {
+	case result := <-results:
+		if result.Err != nil {
+			return zero, result.Err
 		}
+		return result.Val.(V), nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
 	}
 }
-
-func (c *Cache) cleanup() {
-	now := time.Now()
-	c.data.Range(func(key, value interface{}) bool {
-		item := value.(cacheItem)
-		if now.After(item.Expiration) {
-			c.data.Delete(key)
-		}
-		return true
-	})
-}
-
-func (c *Cache) Stop() {
-	close(c.stopChan)
-}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Memory is an in-process cache that keeps at most maxEntries values,
+// dropping the least recently used first
+type Memory[K comparable, V any] struct {
+	mu         sync.Mutex
+	items      map[K]*list.Element
+	order      *list.List // front is most recently used
+	maxEntries int
+	ttl        time.Duration
+	stats      Stats
+	loads      singleflight.Group
+	pending    map[K]*pendingLoad // the running shared load of each key
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// pendingLoad tracks a shared load. Writing or deleting its key while it
+// runs makes it stale: its value still goes to the callers waiting on it,
+// but isn't cached.
+type pendingLoad struct {
+	stale bool
+}
+
+type entry[K comparable, V any] struct {
+	key        K
+	value      V
+	expiration time.Time
+}
+
+// NewMemory creates a memory cache; maxEntries of zero or less means
+// unbounded
+func NewMemory[K comparable, V any](maxEntries int, ttl, cleanupInterval time.Duration) *Memory[K, V] {
+	c := &Memory[K, V]{
+		items:      make(map[K]*list.Element),
+		order:      list.New(),
+		pending:    make(map[K]*pendingLoad),
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		stop:       make(chan struct{}),
+	}
+
+	go c.startCleanup(cleanupInterval)
+
+	return c
+}
+
+func (c *Memory[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return zero, false
+	}
+
+	e := el.Value.(*entry[K, V])
+	if time.Now().After(e.expiration) {
+		c.remove(el)
+		c.stats.Expired++
+		c.stats.Misses++
+		return zero, false
+	}
+
+	c.order.MoveToFront(el)
+	c.stats.Hits++
+	return e.value, true
+}
+
+func (c *Memory[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.ttl)
+}
+
+func (c *Memory[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.pending[key]; ok {
+		p.stale = true
+	}
+	c.set(key, value, ttl)
+}
+
+// set must be called with c.mu held
+func (c *Memory[K, V]) set(key K, value V, ttl time.Duration) {
+	expiration := time.Now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[K, V])
+		e.value = value
+		e.expiration = expiration
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value, expiration: expiration})
+	for c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Memory[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	if p, ok := c.pending[key]; ok {
+		// Callers from now on start a fresh load
+		p.stale = true
+		delete(c.pending, key)
+		c.loads.Forget(fmt.Sprint(key))
+	}
+}
+
+func (c *Memory[K, V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[K]*list.Element)
+	c.order.Init()
+	for key, p := range c.pending {
+		p.stale = true
+		c.loads.Forget(fmt.Sprint(key))
+	}
+	c.pending = make(map[K]*pendingLoad)
+}
+
+func (c *Memory[K, V]) GetOrLoad(ctx context.Context, key K, ttl time.Duration, load func(ctx context.Context) (V, error)) (V, error) {
+	if value, ok := c.Get(key); ok {
+		return value, nil
+	}
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+
+	return shareLoad(ctx, &c.loads, fmt.Sprint(key), func(ctx context.Context) (V, error) {
+		p := &pendingLoad{}
+		c.mu.Lock()
+		c.pending[key] = p
+		c.mu.Unlock()
+
+		value, err := load(ctx)
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.pending[key] == p {
+			delete(c.pending, key)
+		}
+		if err == nil && !p.stale {
+			c.set(key, value, ttl)
+		}
+		return value, err
+	})
+}
+
+func (c *Memory[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	return stats
+}
+
+func (c *Memory[K, V]) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// remove must be called with c.mu held
+func (c *Memory[K, V]) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry[K, V]).key)
+}
+
+func (c *Memory[K, V]) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.cleanup()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Memory[K, V]) cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*entry[K, V]).expiration) {
+			c.remove(el)
+			c.stats.Expired++
+		}
+		el = prev
+	}
+}
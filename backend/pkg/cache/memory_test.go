@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestMemory(maxEntries int) *Memory[string, string] {
+	return NewMemory[string, string](maxEntries, time.Minute, time.Hour)
+}
+
+func TestMemoryEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newTestMemory(2)
+	defer c.Stop()
+
+	c.Set("a", "1")
+	c.Set("b", "2")
+	c.Get("a") // b is now the least recently used
+	c.Set("c", "3")
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b survived; it was the least recently used")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	if stats := c.Stats(); stats.Evictions != 1 || stats.Entries != 2 {
+		t.Errorf("stats = %+v, want 1 eviction and 2 entries", stats)
+	}
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	c := newTestMemory(0)
+	defer c.Stop()
+
+	c.SetWithTTL("short", "1", 10*time.Millisecond)
+	c.Set("long", "2")
+	time.Sleep(20 * time.Millisecond)
+
+	if _, ok := c.Get("short"); ok {
+		t.Error("expired value returned")
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Error("value with the default TTL expired")
+	}
+	if stats := c.Stats(); stats.Expired != 1 {
+		t.Errorf("stats = %+v, want 1 expired", stats)
+	}
+}
+
+func TestMemoryCleanupRemovesExpired(t *testing.T) {
+	c := NewMemory[string, string](0, time.Minute, 5*time.Millisecond)
+	defer c.Stop()
+
+	c.SetWithTTL("a", "1", time.Millisecond)
+	c.SetWithTTL("b", "2", time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for c.Stats().Entries > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expired entries left after a second: %+v", c.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := c.Stats(); stats.Expired != 2 {
+		t.Errorf("stats = %+v, want 2 expired", stats)
+	}
+}
+
+// blockingLoad returns a load that signals started, then waits for release
+// before returning value
+func blockingLoad(value string, started chan<- struct{}, release <-chan struct{}) func(context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		started <- struct{}{}
+		<-release
+		return value, ctx.Err()
+	}
+}
+
+func TestMemoryStaleLoadIsNotCached(t *testing.T) {
+	tests := map[string]func(c *Memory[string, string]){
+		"set":    func(c *Memory[string, string]) { c.Set("k", "written") },
+		"delete": func(c *Memory[string, string]) { c.Delete("k") },
+		"clear":  func(c *Memory[string, string]) { c.Clear() },
+	}
+	for name, write := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := newTestMemory(0)
+			defer c.Stop()
+
+			started, release := make(chan struct{}), make(chan struct{})
+			result := make(chan string)
+			go func() {
+				value, _ := c.GetOrLoad(context.Background(), "k", 0, blockingLoad("loaded", started, release))
+				result <- value
+			}()
+
+			<-started
+			write(c)
+			close(release)
+
+			if value := <-result; value != "loaded" {
+				t.Fatalf("caller got %q, want the loaded value", value)
+			}
+			value, ok := c.Get("k")
+			if name == "set" {
+				if value != "written" {
+					t.Fatalf("cached %q, want the value written during the load", value)
+				}
+			} else if ok {
+				t.Fatalf("cached %q loaded before the key was removed", value)
+			}
+		})
+	}
+}
+
+func TestMemoryDeleteForgetsRunningLoad(t *testing.T) {
+	tests := map[string]func(c *Memory[string, string]){
+		"delete": func(c *Memory[string, string]) { c.Delete("k") },
+		"clear":  func(c *Memory[string, string]) { c.Clear() },
+	}
+	for name, remove := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := newTestMemory(0)
+			defer c.Stop()
+
+			started, release := make(chan struct{}), make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				c.GetOrLoad(context.Background(), "k", 0, blockingLoad("old", started, release))
+				close(done)
+			}()
+			<-started
+			remove(c)
+
+			// A caller after the removal must not join the old load
+			value, err := c.GetOrLoad(context.Background(), "k", 0, func(context.Context) (string, error) {
+				return "new", nil
+			})
+			if err != nil || value != "new" {
+				t.Fatalf("GetOrLoad after %s = %q, %v; want a fresh load", name, value, err)
+			}
+
+			close(release)
+			<-done
+			if value, _ := c.Get("k"); value != "new" {
+				t.Fatalf("cached %q, want the fresh load's value", value)
+			}
+		})
+	}
+}
+
+func TestMemorySharedLoadOutlivesCaller(t *testing.T) {
+	c := newTestMemory(0)
+	defer c.Stop()
+
+	var loads atomic.Int32
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func(ctx context.Context) (string, error) {
+		loads.Add(1)
+		started <- struct{}{}
+		<-release
+		// The caller that started the load gave up long ago
+		return "loaded", ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(ctx, "k", 0, load)
+		first <- err
+	}()
+	<-started
+
+	second := make(chan string)
+	go func() {
+		value, err := c.GetOrLoad(context.Background(), "k", 0, load)
+		if err != nil {
+			t.Errorf("second caller: %v", err)
+		}
+		second <- value
+	}()
+
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Fatalf("caller that gave up got %v, want context.Canceled", err)
+	}
+
+	close(release)
+	if value := <-second; value != "loaded" {
+		t.Fatalf("second caller got %q, want the shared load's value", value)
+	}
+	if value, ok := c.Get("k"); !ok || value != "loaded" {
+		t.Fatalf("cached %q, %v; want the shared load's value", value, ok)
+	}
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("loaded %d times, want 1", n)
+	}
+}
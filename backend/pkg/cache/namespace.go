@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// Namespace is a typed view of part of a shared cache, so several
+// consumers can share one cache and its size limit without their keys
+// colliding. Clear and Stop do nothing; the shared cache belongs to whoever
+// created it.
+type Namespace[V any] struct {
+	shared Cache[string, any]
+	prefix string
+}
+
+func NewNamespace[V any](shared Cache[string, any], prefix string) *Namespace[V] {
+	return &Namespace[V]{shared: shared, prefix: prefix + ":"}
+}
+
+func (n *Namespace[V]) Get(key string) (V, bool) {
+	var zero V
+	value, ok := n.shared.Get(n.prefix + key)
+	if !ok {
+		return zero, false
+	}
+	typed, ok := value.(V)
+	return typed, ok
+}
+
+func (n *Namespace[V]) Set(key string, value V) {
+	n.shared.Set(n.prefix+key, value)
+}
+
+func (n *Namespace[V]) SetWithTTL(key string, value V, ttl time.Duration) {
+	n.shared.SetWithTTL(n.prefix+key, value, ttl)
+}
+
+func (n *Namespace[V]) Delete(key string) {
+	n.shared.Delete(n.prefix + key)
+}
+
+func (n *Namespace[V]) Clear() {}
+
+func (n *Namespace[V]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func(ctx context.Context) (V, error)) (V, error) {
+	var zero V
+	value, err := n.shared.GetOrLoad(ctx, n.prefix+key, ttl, func(ctx context.Context) (any, error) {
+		return load(ctx)
+	})
+	if err != nil {
+		return zero, err
+	}
+	typed, _ := value.(V)
+	return typed, nil
+}
+
+// Stats reports on the whole shared cache
+func (n *Namespace[V]) Stats() Stats {
+	return n.shared.Stats()
+}
+
+func (n *Namespace[V]) Stop() {}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Nop caches nothing, for deployments where every instance must read
+// fresh data. GetOrLoad still shares concurrent loads.
+type Nop[K comparable, V any] struct {
+	mu     sync.Mutex
+	misses uint64
+	loads  singleflight.Group
+}
+
+func NewNop[K comparable, V any]() *Nop[K, V] {
+	return &Nop[K, V]{}
+}
+
+func (c *Nop[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+
+	var zero V
+	return zero, false
+}
+
+func (c *Nop[K, V]) Set(key K, value V)                           {}
+func (c *Nop[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {}
+func (c *Nop[K, V]) Delete(key K)                                 {}
+func (c *Nop[K, V]) Clear()                                       {}
+func (c *Nop[K, V]) Stop()                                        {}
+
+func (c *Nop[K, V]) GetOrLoad(ctx context.Context, key K, ttl time.Duration, load func(ctx context.Context) (V, error)) (V, error) {
+	c.Get(key)
+
+	return shareLoad(ctx, &c.loads, fmt.Sprint(key), load)
+}
+
+func (c *Nop[K, V]) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Misses: c.misses}
+}
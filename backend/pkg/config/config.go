@@ -1,7 +1,10 @@
 package config
 
 import (
+	"errors"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -11,6 +14,7 @@ type Config struct {
 	// Server
 	Port        string
 	ServerID    string
+	ServerIDSet bool // false when ServerID defaulted to the hostname
 	Environment string
 
 	// MongoDB
@@ -18,8 +22,54 @@ type Config struct {
 	MongoDBDatabase string
 
 	// JWT
-	JWTSecret string
-	JWTExpiry time.Duration
+	JWTSecret          string
+	JWTExpiry          time.Duration
+	RefreshTokenExpiry time.Duration
+	JWTAlgorithm       string // HS256 signs with JWTSecret; RS256 and EdDSA with keys in JWTKeysDir
+	JWTKeysDir         string
+	JWTSigningKeyID    string // pins the signing key; empty means the newest key in JWTKeysDir
+	TOTPIssuer         string // name authenticator apps show for 2FA entries
+
+	// Login throttling
+	LoginMaxFailures     int           // failures before an account locks
+	LoginIPMaxFailures   int           // failures before an IP locks
+	LoginLockoutDuration time.Duration // also caps the backoff between attempts
+	LoginBackoffBase     time.Duration
+	LoginFailureWindow   time.Duration // how long failures are remembered
+
+	// Account rules
+	UsernameMinLength   int
+	UsernameMaxLength   int
+	UsernameCharset     string // regexp character class body, e.g. a-zA-Z0-9_.
+	ReservedUsernames   []string
+	UsernameCooldown    time.Duration // minimum time between username changes
+	UsernameReservation time.Duration // how long a released username stays with its old owner
+	PasswordMinLength   int
+	PasswordMinClasses  int // of lower case, upper case, digits and symbols
+
+	// Account data
+	DeletionGracePeriod time.Duration // between a deletion request and the purge
+	DataExportTTL       time.Duration // how long a finished export can be downloaded
+	AccountJobInterval  time.Duration // how often due deletions and expired exports are processed
+
+	// OIDC login
+	PublicURL     string // this server's external base URL, for OIDC redirect URIs
+	OIDCProviders []OIDCProvider
+
+	// Account emails
+	AppURL               string // frontend base URL used in emailed links
+	EmailVerificationTTL time.Duration
+	PasswordResetTTL     time.Duration
+	AuthMinResponseTime  time.Duration // floor for account endpoints so timing doesn't reveal which accounts exist
+
+	// Mail
+	MailBackend  string
+	MailFrom     string
+	MailDir      string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
 
 	// CORS
 	CORSOrigins string
@@ -28,37 +78,259 @@ type Config struct {
 	WSHeartbeatInterval time.Duration
 	WSConnectionTimeout time.Duration
 	WSMaxMessageSize    int64
+	WSAuthCheckInterval time.Duration // how often live connections are checked for expired tokens and revoked sessions
+	WSReapInterval      time.Duration // how often connections that stopped heartbeating are cleaned up
+
+	// Presence
+	PresenceAwayAfter time.Duration // inactivity before a user shows as away
+	PresenceInterval  time.Duration // how often connections are checked for inactivity
+	PresenceMaxSubs   int           // users one connection can watch
+	PresenceDebounce  time.Duration // quiet period before a presence change is pushed
+	StatusJobInterval time.Duration // how often expired custom statuses are cleared
+
+	// Event bus between instances
+	EventBusBackend string
 
 	// Cache
+	CacheBackend         string
+	CacheMaxEntries      int
 	CacheTTL             time.Duration
 	CacheCleanupInterval time.Duration
+
+	// Search
+	SearchBackend   string
+	SearchIndexPath string
+
+	// Storage
+	StorageBackend string
+	StoragePath    string
+	S3Endpoint     string
+	S3Region       string
+	S3Bucket       string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3UsePathStyle bool
+
+	// Media
+	MediaMaxSize      int64
+	MediaAllowedTypes []string
+	MediaWorkers      int
+	MediaQueueSize    int
+	MediaURLTTL       time.Duration
+	MediaMaxPixels    int64 // larger images aren't decoded for a thumbnail
+
+	// Link previews
+	LinkPreviewTimeout  time.Duration
+	LinkPreviewMaxBytes int64
+	LinkPreviewWorkers  int
 }
 
 func Load() (*Config, error) {
 	// Load .env file if it exists (ignore errors in production)
 	_ = godotenv.Load()
 
-	jwtExpiry, _ := time.ParseDuration(getEnv("JWT_EXPIRY", "24h"))
+	jwtExpiry, _ := time.ParseDuration(getEnv("JWT_EXPIRY", "15m"))
+	refreshTokenExpiry, _ := time.ParseDuration(getEnv("REFRESH_TOKEN_EXPIRY", "720h")) // 30 days
+	emailVerificationTTL, _ := time.ParseDuration(getEnv("EMAIL_VERIFICATION_TTL", "24h"))
+	passwordResetTTL, _ := time.ParseDuration(getEnv("PASSWORD_RESET_TTL", "1h"))
+	authMinResponseTime, _ := time.ParseDuration(getEnv("AUTH_MIN_RESPONSE_TIME", "500ms"))
+	loginMaxFailures, _ := strconv.Atoi(getEnv("LOGIN_MAX_FAILURES", "10"))
+	loginIPMaxFailures, _ := strconv.Atoi(getEnv("LOGIN_IP_MAX_FAILURES", "100"))
+	loginLockout, _ := time.ParseDuration(getEnv("LOGIN_LOCKOUT_DURATION", "15m"))
+	loginBackoffBase, _ := time.ParseDuration(getEnv("LOGIN_BACKOFF_BASE", "1s"))
+	loginFailureWindow, _ := time.ParseDuration(getEnv("LOGIN_FAILURE_WINDOW", "1h"))
+	usernameMinLength, _ := strconv.Atoi(getEnv("USERNAME_MIN_LENGTH", "3"))
+	usernameMaxLength, _ := strconv.Atoi(getEnv("USERNAME_MAX_LENGTH", "32"))
+	usernameCooldown, _ := time.ParseDuration(getEnv("USERNAME_CHANGE_COOLDOWN", "168h"))       // 7 days
+	usernameReservation, _ := time.ParseDuration(getEnv("USERNAME_RESERVATION_PERIOD", "720h")) // 30 days
+	passwordMinLength, _ := strconv.Atoi(getEnv("PASSWORD_MIN_LENGTH", "8"))
+	passwordMinClasses, _ := strconv.Atoi(getEnv("PASSWORD_MIN_CLASSES", "2"))
+	deletionGracePeriod, _ := time.ParseDuration(getEnv("ACCOUNT_DELETION_GRACE_PERIOD", "336h")) // 14 days
+	dataExportTTL, _ := time.ParseDuration(getEnv("DATA_EXPORT_TTL", "168h"))                     // 7 days
+	accountJobInterval, _ := time.ParseDuration(getEnv("ACCOUNT_JOB_INTERVAL", "1h"))
+	smtpPort, _ := strconv.Atoi(getEnv("SMTP_PORT", "587"))
 	wsHeartbeat, _ := time.ParseDuration(getEnv("WS_HEARTBEAT_INTERVAL", "30s"))
 	wsTimeout, _ := time.ParseDuration(getEnv("WS_CONNECTION_TIMEOUT", "5m"))
+	wsAuthCheck, _ := time.ParseDuration(getEnv("WS_AUTH_CHECK_INTERVAL", "30s"))
+	wsReapInterval, _ := time.ParseDuration(getEnv("WS_REAP_INTERVAL", "1m"))
+	presenceAwayAfter, _ := time.ParseDuration(getEnv("PRESENCE_AWAY_AFTER", "5m"))
+	presenceInterval, _ := time.ParseDuration(getEnv("PRESENCE_CHECK_INTERVAL", "30s"))
+	presenceMaxSubs, _ := strconv.Atoi(getEnv("PRESENCE_MAX_SUBSCRIPTIONS", "200"))
+	presenceDebounce, _ := time.ParseDuration(getEnv("PRESENCE_DEBOUNCE", "2s"))
+	statusJobInterval, _ := time.ParseDuration(getEnv("STATUS_CLEANUP_INTERVAL", "1m"))
+	cacheMaxEntries, _ := strconv.Atoi(getEnv("CACHE_MAX_ENTRIES", "100000"))
 	cacheTTL, _ := time.ParseDuration(getEnv("CACHE_TTL", "5m"))
 	cacheCleanup, _ := time.ParseDuration(getEnv("CACHE_CLEANUP_INTERVAL", "10m"))
+	mediaMaxSize, _ := strconv.ParseInt(getEnv("MEDIA_MAX_SIZE", "26214400"), 10, 64) // 25MB
+	mediaWorkers, _ := strconv.Atoi(getEnv("MEDIA_WORKERS", "2"))
+	mediaQueueSize, _ := strconv.Atoi(getEnv("MEDIA_QUEUE_SIZE", "64"))
+	mediaURLTTL, _ := time.ParseDuration(getEnv("MEDIA_URL_TTL", "15m"))
+	mediaMaxPixels, _ := strconv.ParseInt(getEnv("MEDIA_MAX_PIXELS", "50000000"), 10, 64) // 50 MP
+	linkPreviewTimeout, _ := time.ParseDuration(getEnv("LINK_PREVIEW_TIMEOUT", "5s"))
+	linkPreviewMaxBytes, _ := strconv.ParseInt(getEnv("LINK_PREVIEW_MAX_BYTES", "1048576"), 10, 64) // 1MB
+	linkPreviewWorkers, _ := strconv.Atoi(getEnv("LINK_PREVIEW_WORKERS", "2"))
 
-	return &Config{
+	cfg := &Config{
 		Port:                 getEnv("PORT", "8080"),
-		ServerID:             getEnv("SERVER_ID", "server-1"),
+		ServerID:             os.Getenv("SERVER_ID"),
+		ServerIDSet:          os.Getenv("SERVER_ID") != "",
 		Environment:          getEnv("ENVIRONMENT", "development"),
 		MongoDBURI:           getEnv("MONGODB_URI", "mongodb://localhost:27017"),
 		MongoDBDatabase:      getEnv("MONGODB_DATABASE", "messaging_platform"),
-		JWTSecret:            getEnv("JWT_SECRET", "change-this-secret"),
+		JWTSecret:            getEnv("JWT_SECRET", defaultJWTSecret),
 		JWTExpiry:            jwtExpiry,
+		RefreshTokenExpiry:   refreshTokenExpiry,
+		JWTAlgorithm:         getEnv("JWT_ALGORITHM", "HS256"),
+		JWTKeysDir:           getEnv("JWT_KEYS_DIR", "data/jwt-keys"),
+		JWTSigningKeyID:      getEnv("JWT_SIGNING_KEY_ID", ""),
+		TOTPIssuer:           getEnv("TOTP_ISSUER", "Messaging Platform"),
+		LoginMaxFailures:     loginMaxFailures,
+		LoginIPMaxFailures:   loginIPMaxFailures,
+		LoginLockoutDuration: loginLockout,
+		LoginBackoffBase:     loginBackoffBase,
+		LoginFailureWindow:   loginFailureWindow,
+		UsernameMinLength:    usernameMinLength,
+		UsernameMaxLength:    usernameMaxLength,
+		UsernameCharset:      getEnv("USERNAME_CHARSET", "a-zA-Z0-9_."),
+		ReservedUsernames:    getEnvList("RESERVED_USERNAMES", defaultReservedUsernames),
+		UsernameCooldown:     usernameCooldown,
+		UsernameReservation:  usernameReservation,
+		PasswordMinLength:    passwordMinLength,
+		PasswordMinClasses:   passwordMinClasses,
+		DeletionGracePeriod:  deletionGracePeriod,
+		DataExportTTL:        dataExportTTL,
+		AccountJobInterval:   accountJobInterval,
+		PublicURL:            strings.TrimSuffix(getEnv("PUBLIC_URL", "http://localhost:8080"), "/"),
+		OIDCProviders:        loadOIDCProviders(),
+		AppURL:               strings.TrimSuffix(getEnv("APP_URL", "http://localhost:5173"), "/"),
+		EmailVerificationTTL: emailVerificationTTL,
+		PasswordResetTTL:     passwordResetTTL,
+		AuthMinResponseTime:  authMinResponseTime,
+		MailBackend:          getEnv("MAIL_BACKEND", "log"),
+		MailFrom:             getEnv("MAIL_FROM", "Messaging Platform <no-reply@localhost>"),
+		MailDir:              getEnv("MAIL_DIR", "data/mail"),
+		SMTPHost:             getEnv("SMTP_HOST", ""),
+		SMTPPort:             smtpPort,
+		SMTPUsername:         getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:         getEnv("SMTP_PASSWORD", ""),
 		CORSOrigins:          getEnv("CORS_ORIGINS", "http://localhost:5173"),
 		WSHeartbeatInterval:  wsHeartbeat,
 		WSConnectionTimeout:  wsTimeout,
 		WSMaxMessageSize:     1048576, // 1MB
+		WSAuthCheckInterval:  wsAuthCheck,
+		WSReapInterval:       wsReapInterval,
+		PresenceAwayAfter:    presenceAwayAfter,
+		PresenceInterval:     presenceInterval,
+		PresenceMaxSubs:      presenceMaxSubs,
+		PresenceDebounce:     presenceDebounce,
+		StatusJobInterval:    statusJobInterval,
+		EventBusBackend:      getEnv("EVENT_BUS_BACKEND", "local"),
+		CacheBackend:         getEnv("CACHE_BACKEND", "memory"),
+		CacheMaxEntries:      cacheMaxEntries,
 		CacheTTL:             cacheTTL,
 		CacheCleanupInterval: cacheCleanup,
-	}, nil
+		SearchBackend:        getEnv("SEARCH_BACKEND", "mongo"),
+		SearchIndexPath:      getEnv("SEARCH_INDEX_PATH", "data/search"),
+		StorageBackend:       getEnv("STORAGE_BACKEND", "local"),
+		StoragePath:          getEnv("STORAGE_PATH", "data/media"),
+		S3Endpoint:           getEnv("S3_ENDPOINT", ""),
+		S3Region:             getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:             getEnv("S3_BUCKET", ""),
+		S3AccessKey:          getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:          getEnv("S3_SECRET_KEY", ""),
+		S3UsePathStyle:       getEnv("S3_USE_PATH_STYLE", "false") == "true",
+		MediaMaxSize:         mediaMaxSize,
+		MediaAllowedTypes:    getEnvList("MEDIA_ALLOWED_TYPES", defaultMediaTypes),
+		MediaWorkers:         mediaWorkers,
+		MediaQueueSize:       mediaQueueSize,
+		MediaURLTTL:          mediaURLTTL,
+		MediaMaxPixels:       mediaMaxPixels,
+		LinkPreviewTimeout:   linkPreviewTimeout,
+		LinkPreviewMaxBytes:  linkPreviewMaxBytes,
+		LinkPreviewWorkers:   linkPreviewWorkers,
+	}
+
+	// The secret also signs media URLs, so it must be set even when tokens
+	// are signed with asymmetric keys
+	if cfg.Environment == "production" && (cfg.JWTSecret == defaultJWTSecret || len(cfg.JWTSecret) < 32) {
+		return nil, errors.New("JWT_SECRET must be set to a random value of at least 32 characters in production")
+	}
+
+	// Each instance would index only the messages sent through it
+	if cfg.SearchBackend == "local" && cfg.EventBusBackend != "" && cfg.EventBusBackend != "local" {
+		return nil, errors.New("SEARCH_BACKEND=local only works with a single instance; use mongo with EVENT_BUS_BACKEND=" + cfg.EventBusBackend)
+	}
+
+	// Connections are recorded under the ID and cleaned up by it on startup,
+	// so two instances sharing one would remove each other's connections
+	if cfg.ServerID == "" {
+		if cfg.Environment == "production" {
+			return nil, errors.New("SERVER_ID must be set to a name unique to this instance in production")
+		}
+		cfg.ServerID = defaultServerID()
+	}
+
+	return cfg, nil
+}
+
+const defaultJWTSecret = "change-this-secret"
+
+// defaultServerID names an instance after its host. It stays the same
+// across restarts, so startup finds the previous run's connections.
+func defaultServerID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "server"
+	}
+	return host
+}
+
+// OIDCProvider is an OpenID Connect issuer users can sign in with
+type OIDCProvider struct {
+	Name         string // used in URLs: /api/auth/oidc/<name>
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// loadOIDCProviders reads OIDC_<NAME>_* settings for every name listed in
+// OIDC_PROVIDERS
+func loadOIDCProviders() []OIDCProvider {
+	var providers []OIDCProvider
+	for _, name := range getEnvList("OIDC_PROVIDERS", "") {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+
+		providers = append(providers, OIDCProvider{
+			Name:         name,
+			DisplayName:  getEnv(prefix+"DISPLAY_NAME", name),
+			Issuer:       strings.TrimSuffix(getEnv(prefix+"ISSUER", ""), "/"),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			Scopes:       strings.Fields(getEnv(prefix+"SCOPES", "openid email profile")),
+		})
+	}
+	return providers
+}
+
+const defaultReservedUsernames = "admin,administrator,root,system,support,help,security," +
+	"api,www,mail,moderator,staff,official,null,undefined,me,settings"
+
+const defaultMediaTypes = "image/jpeg,image/png,image/gif,image/webp," +
+	"video/mp4,video/webm,video/quicktime," +
+	"audio/mpeg,audio/ogg,audio/webm,audio/mp4,audio/wav," +
+	"application/pdf,application/zip,text/plain"
+
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
 }
 
 func getEnv(key, defaultValue string) string {
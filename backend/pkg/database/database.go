@@ -2,6 +2,9 @@ package database
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -39,14 +42,65 @@ func (d *Database) Disconnect(ctx context.Context) error {
 	return d.Client.Disconnect(ctx)
 }
 
+// DuplicateKeyIndex returns the name of the unique index a write collided
+// with, such as "email_1", or "" if err isn't a duplicate key error
+func DuplicateKeyIndex(err error) string {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return ""
+	}
+	for _, we := range writeErr.WriteErrors {
+		if we.Code != 11000 {
+			continue
+		}
+		// E11000 duplicate key error collection: db.users index: email_1 dup key: { ... }
+		if _, rest, ok := strings.Cut(we.Message, "index: "); ok {
+			index, _, _ := strings.Cut(rest, " ")
+			return index
+		}
+	}
+	return ""
+}
+
 func InitializeIndexes(ctx context.Context, db *Database) error {
 	// Users indexes
 	usersCollection := db.DB.Collection("users")
-	_, err := usersCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+
+	// Usernames are unique regardless of case; fill in the lower-cased copy
+	// for users created before it was stored
+	_, err := usersCollection.UpdateMany(
+		ctx,
+		bson.M{"username_lower": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.D{{Key: "username_lower", Value: bson.D{{Key: "$toLower", Value: "$username"}}}}}}},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Emails are stored lower-cased; convert those stored as typed, along
+	// with the addresses pending tokens were sent to
+	toLowerEmail := mongo.Pipeline{{{Key: "$set", Value: bson.D{{Key: "email", Value: bson.D{{Key: "$toLower", Value: "$email"}}}}}}}
+	_, err = usersCollection.UpdateMany(ctx, bson.M{"email": bson.M{"$regex": "[A-Z]"}}, toLowerEmail)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("users whose email addresses differ only in case must be changed before upgrading: %w", err)
+		}
+		return err
+	}
+	_, err = db.DB.Collection("account_tokens").UpdateMany(ctx, bson.M{"email": bson.M{"$regex": "[A-Z]"}}, toLowerEmail)
+	if err != nil {
+		return err
+	}
+
+	_, err = usersCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
 		{
 			Keys:    bson.D{{Key: "username", Value: 1}},
 			Options: options.Index().SetUnique(true),
 		},
+		{
+			Keys:    bson.D{{Key: "username_lower", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
 		{
 			Keys:    bson.D{{Key: "email", Value: 1}},
 			Options: options.Index().SetUnique(true).SetSparse(true),
@@ -59,6 +113,161 @@ func InitializeIndexes(ctx context.Context, db *Database) error {
 			Keys: bson.D{{Key: "presence.status", Value: 1}, {Key: "presence.last_seen", Value: -1}},
 		},
 	})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("users differing only in username case must be renamed before upgrading: %w", err)
+		}
+		return err
+	}
+
+	// Sessions indexes
+	sessionsCollection := db.DB.Collection("sessions")
+	_, err = sessionsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "refresh_token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "used_token_hashes", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "last_used_at", Value: -1}},
+		},
+		{
+			// Expired sessions are no longer needed, even for reuse detection
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Account tokens indexes
+	accountTokensCollection := db.DB.Collection("account_tokens")
+	_, err = accountTokensCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "token_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "purpose", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Accounts waiting to be purged
+	_, err = usersCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "delete_after", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Custom statuses waiting to expire
+	_, err = usersCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "custom_status.expires_at", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Data exports indexes
+	_, err = db.DB.Collection("data_exports").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "status", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "expires_at", Value: 1}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Released usernames are held until expires_at
+	_, err = db.DB.Collection("username_reservations").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.DB.Collection("username_history").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "changed_at", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Login throttles expire once their failures are old enough to forget
+	_, err = db.DB.Collection("login_throttles").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Auth failures indexes
+	authFailuresCollection := db.DB.Collection("auth_failures")
+	_, err = authFailuresCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "ip", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+		{
+			// Keep the audit trail for 90 days
+			Keys:    bson.D{{Key: "created_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(90 * 24 * 60 * 60),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Identities indexes
+	identitiesCollection := db.DB.Collection("identities")
+	_, err = identitiesCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			// An OIDC account can be linked to only one user
+			Keys:    bson.D{{Key: "provider", Value: 1}, {Key: "subject", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// OIDC logins indexes
+	oidcLoginsCollection := db.DB.Collection("oidc_logins")
+	_, err = oidcLoginsCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "state_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
 	if err != nil {
 		return err
 	}
@@ -92,6 +301,25 @@ func InitializeIndexes(ctx context.Context, db *Database) error {
 		{
 			Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "status", Value: 1}},
 		},
+		{
+			Keys:    bson.D{{Key: "content", Value: "text"}},
+			Options: options.Index().SetName("content_text"),
+		},
+		{
+			Keys:    bson.D{{Key: "media.id", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Media indexes
+	mediaCollection := db.DB.Collection("media")
+	_, err = mediaCollection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "owner_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
 	})
 	if err != nil {
 		return err
@@ -144,6 +372,32 @@ func InitializeIndexes(ctx context.Context, db *Database) error {
 		{
 			Keys: bson.D{{Key: "last_heartbeat", Value: 1}},
 		},
+		{
+			Keys: bson.D{{Key: "server_instance", Value: 1}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Devices are identified by the ID each client generates for itself
+	_, err = db.DB.Collection("devices").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "device_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "session_id", Value: 1}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Events between instances are read within moments of being written
+	_, err = db.DB.Collection("events").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(60 * 60),
 	})
 	if err != nil {
 		return err
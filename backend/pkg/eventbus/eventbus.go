@@ -0,0 +1,52 @@
+package eventbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is a message from one backend instance to others
+type Event struct {
+	ID     primitive.ObjectID `bson:"_id,omitempty"`
+	Type   string             `bson:"type"`
+	Origin string             `bson:"origin"` // instance that published it
+	// Targets lists the instances the event is for; empty means all
+	Targets   []string  `bson:"targets,omitempty"`
+	Data      []byte    `bson:"data"` // JSON payload
+	CreatedAt time.Time `bson:"created_at"`
+}
+
+// Handler receives events addressed to this instance
+type Handler func(event *Event)
+
+// Bus carries events between backend instances. An instance never
+// receives the events it published itself.
+type Bus interface {
+	Publish(ctx context.Context, event *Event) error
+	// Subscribe delivers events to handler, one at a time, until Close
+	Subscribe(handler Handler) error
+	Close() error
+}
+
+// New returns the bus selected by cfg.EventBusBackend
+func New(cfg *config.Config, db *database.Database) (Bus, error) {
+	switch cfg.EventBusBackend {
+	case "", "local":
+		return NewLocalBus(), nil
+	case "mongo":
+		// Other instances address events by the ID connections were
+		// recorded under, which a generated ID doesn't keep across restarts
+		if !cfg.ServerIDSet {
+			return nil, errors.New("the mongo event bus requires SERVER_ID to be set")
+		}
+		return NewMongoBus(db, cfg.ServerID), nil
+	default:
+		return nil, fmt.Errorf("unknown event bus backend: %s", cfg.EventBusBackend)
+	}
+}
@@ -0,0 +1,22 @@
+package eventbus
+
+import "context"
+
+// LocalBus is for a single instance: there is nobody to deliver to
+type LocalBus struct{}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+func (b *LocalBus) Publish(ctx context.Context, event *Event) error {
+	return nil
+}
+
+func (b *LocalBus) Subscribe(handler Handler) error {
+	return nil
+}
+
+func (b *LocalBus) Close() error {
+	return nil
+}
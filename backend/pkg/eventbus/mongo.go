@@ -0,0 +1,122 @@
+package eventbus
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/database"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoBus writes events to the events collection and follows it with a
+// change stream, which needs MongoDB to run as a replica set. Old events
+// are removed by a TTL index.
+type MongoBus struct {
+	events   *mongo.Collection
+	serverID string
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewMongoBus(db *database.Database, serverID string) *MongoBus {
+	return &MongoBus{
+		events:   db.DB.Collection("events"),
+		serverID: serverID,
+	}
+}
+
+func (b *MongoBus) Publish(ctx context.Context, event *Event) error {
+	event.Origin = b.serverID
+	event.CreatedAt = time.Now()
+	_, err := b.events.InsertOne(ctx, event)
+	return err
+}
+
+// Subscribe opens the change stream before returning, so a deployment
+// without a replica set fails at startup rather than silently
+func (b *MongoBus) Subscribe(handler Handler) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	stream, err := b.watch(ctx, nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	b.cancel = cancel
+	b.wg.Add(1)
+	go b.follow(ctx, stream, handler)
+	return nil
+}
+
+func (b *MongoBus) Close() error {
+	if b.cancel != nil {
+		b.cancel()
+		b.wg.Wait()
+	}
+	return nil
+}
+
+func (b *MongoBus) watch(ctx context.Context, resumeAfter bson.Raw) (*mongo.ChangeStream, error) {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		"operationType":       "insert",
+		"fullDocument.origin": bson.M{"$ne": b.serverID},
+		"$or": bson.A{
+			bson.M{"fullDocument.targets": bson.M{"$exists": false}},
+			bson.M{"fullDocument.targets": b.serverID},
+		},
+	}}}}
+
+	opts := options.ChangeStream()
+	if resumeAfter != nil {
+		opts.SetResumeAfter(resumeAfter)
+	}
+	return b.events.Watch(ctx, pipeline, opts)
+}
+
+// follow delivers events until ctx is cancelled, reopening the stream
+// where it left off when it fails
+func (b *MongoBus) follow(ctx context.Context, stream *mongo.ChangeStream, handler Handler) {
+	defer b.wg.Done()
+
+	var resumeToken bson.Raw
+	for {
+		for stream.Next(ctx) {
+			var change struct {
+				FullDocument Event `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("Failed to decode event: %v", err)
+				continue
+			}
+			handler(&change.FullDocument)
+			resumeToken = stream.ResumeToken()
+		}
+		err := stream.Err()
+		stream.Close(context.Background())
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Event stream failed, reopening: %v", err)
+
+		for {
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			stream, err = b.watch(ctx, resumeToken)
+			if err == nil {
+				break
+			}
+			// The token may have fallen out of the oplog; events in
+			// between are lost, which only costs live updates
+			log.Printf("Failed to reopen event stream: %v", err)
+			resumeToken = nil
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Generate creates a new pending key in dir and returns its key ID. It is
+// published for verification only until Promote makes it the signing key.
+func Generate(algorithm, dir string) (string, error) {
+	var signer crypto.Signer
+	var err error
+	switch algorithm {
+	case RS256:
+		signer, err = rsa.GenerateKey(rand.Reader, 3072)
+	case EdDSA:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", ErrUnsupportedAlgorithm
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	kid := time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+pendingSuffix), data, 0o600); err != nil {
+		return "", err
+	}
+
+	return kid, nil
+}
+
+// Promote turns a pending key into a signing key. Its ID starts with the
+// creation time, so it signs in place of any older key.
+func Promote(dir, kid string) error {
+	err := os.Rename(filepath.Join(dir, kid+pendingSuffix), filepath.Join(dir, kid+privateSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return errors.New("only pending keys can be promoted; generate one first")
+	}
+	return err
+}
+
+// Retire replaces a private key with its public half. The key no longer
+// signs but still verifies tokens it signed until they expire.
+func Retire(dir, kid string) error {
+	path := filepath.Join(dir, kid+privateSuffix)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	signer, err := parsePrivate(data)
+	if err != nil {
+		return err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	public := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, kid+publicSuffix), public, 0o644); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// Remove deletes a retired key once no unexpired token can carry it
+func Remove(dir, kid string) error {
+	path := filepath.Join(dir, kid+publicSuffix)
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errors.New("only retired keys can be removed; retire it first")
+		}
+		return err
+	}
+	return os.Remove(path)
+}
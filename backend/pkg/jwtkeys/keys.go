@@ -0,0 +1,243 @@
+// Package jwtkeys loads the keys used to sign and verify access tokens.
+//
+// With HS256 a single shared secret does both. With RS256 or EdDSA, a
+// directory holds one PEM file per key, named after its key ID: "<kid>.pem"
+// for a PKCS#8 private key, "<kid>.pending.pem" for a private key that is
+// published but not yet signing, and "<kid>.pub.pem" for a PKIX public key
+// whose private half has been retired. Tokens are signed with the newest
+// private key that isn't pending (key IDs sort by creation time) and
+// verified with any key in the directory, so tokens signed before a
+// rotation stay valid until they expire, and verifiers learn a new key
+// before any token is signed with it.
+package jwtkeys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	EdDSA = "EdDSA"
+
+	privateSuffix = ".pem"
+	pendingSuffix = ".pending.pem"
+	publicSuffix  = ".pub.pem"
+)
+
+var (
+	ErrUnknownKey           = errors.New("unknown signing key")
+	ErrNoSigningKey         = errors.New("no private key to sign with")
+	ErrUnsupportedAlgorithm = errors.New("unsupported JWT algorithm")
+)
+
+// KeySet signs tokens with one key and verifies them with any of its keys
+type KeySet struct {
+	algorithm string
+	method    jwt.SigningMethod
+	signingID string
+	signer    interface{}
+	verifiers map[string]interface{}
+	pending   map[string]bool
+}
+
+// NewHMAC returns a key set that signs and verifies with a shared secret
+func NewHMAC(secret string) *KeySet {
+	return &KeySet{
+		algorithm: HS256,
+		method:    jwt.SigningMethodHS256,
+		signer:    []byte(secret),
+		verifiers: map[string]interface{}{"": []byte(secret)},
+	}
+}
+
+// Load reads every key in dir for the given asymmetric algorithm. When
+// signingID is empty the newest private key that isn't pending signs.
+func Load(algorithm, dir, signingID string) (*KeySet, error) {
+	var method jwt.SigningMethod
+	switch algorithm {
+	case RS256:
+		method = jwt.SigningMethodRS256
+	case EdDSA:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{
+		algorithm: algorithm,
+		method:    method,
+		verifiers: map[string]interface{}{},
+		pending:   map[string]bool{},
+	}
+	private := map[string]crypto.Signer{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, privateSuffix) {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		if kid, ok := strings.CutSuffix(name, publicSuffix); ok {
+			public, err := parsePublic(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if err := checkAlgorithm(algorithm, public); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			ks.verifiers[kid] = public
+			continue
+		}
+
+		kid, pending := strings.CutSuffix(name, pendingSuffix)
+		if !pending {
+			kid = strings.TrimSuffix(name, privateSuffix)
+		}
+		signer, err := parsePrivate(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if err := checkAlgorithm(algorithm, signer.Public()); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		private[kid] = signer
+		ks.verifiers[kid] = signer.Public()
+		if pending {
+			ks.pending[kid] = true
+		}
+	}
+
+	if signingID == "" {
+		ids := make([]string, 0, len(private))
+		for kid := range private {
+			if !ks.pending[kid] {
+				ids = append(ids, kid)
+			}
+		}
+		sort.Strings(ids)
+		if len(ids) == 0 {
+			return nil, ErrNoSigningKey
+		}
+		signingID = ids[len(ids)-1]
+	}
+
+	signer, ok := private[signingID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNoSigningKey, signingID)
+	}
+	ks.signingID = signingID
+	ks.signer = signer
+
+	return ks, nil
+}
+
+// Sign issues a token with the current key, naming it in the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.method, claims)
+	if ks.signingID != "" {
+		token.Header["kid"] = ks.signingID
+	}
+	return token.SignedString(ks.signer)
+}
+
+// Parse verifies a token against the key named in its kid header. Only
+// the configured algorithm is accepted, so a public key can never be
+// mistaken for an HMAC secret.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, ks.keyfunc,
+		jwt.WithValidMethods([]string{ks.method.Alg()}),
+		jwt.WithExpirationRequired(),
+	)
+}
+
+func (ks *KeySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.verifiers[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// SigningKeyID returns the kid of the key new tokens are signed with
+func (ks *KeySet) SigningKeyID() string {
+	return ks.signingID
+}
+
+// Pending reports whether kid is published for verification but not yet
+// promoted to signing
+func (ks *KeySet) Pending(kid string) bool {
+	return ks.pending[kid]
+}
+
+// Algorithm returns the JWT algorithm the set signs with
+func (ks *KeySet) Algorithm() string {
+	return ks.algorithm
+}
+
+func parsePrivate(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM file")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		// Keys made by "openssl genrsa" use the older PKCS#1 format
+		if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(block.Bytes); rsaErr == nil {
+			return rsaKey, nil
+		}
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+func parsePublic(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM file")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func checkAlgorithm(algorithm string, public crypto.PublicKey) error {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		if algorithm == RS256 && key.N.BitLen() >= 2048 {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if algorithm == EdDSA {
+			return nil
+		}
+	}
+	return fmt.Errorf("key does not match %s", algorithm)
+}
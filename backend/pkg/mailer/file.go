@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// FileMailer saves each message as an .eml file in a directory, for tests
+// and inspecting what would have been sent
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg *Message) error {
+	if err := validHeader(msg.To, msg.Subject); err != nil {
+		return err
+	}
+	name := strconv.FormatInt(time.Now().UnixNano(), 10) + ".eml"
+	return os.WriteFile(filepath.Join(m.dir, name), format(m.from, msg), 0o644)
+}
@@ -0,0 +1,68 @@
+// Package mailer sends transactional email such as verification links and
+// password reset instructions.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// New returns the mailer selected by cfg.MailBackend
+func New(cfg *config.Config) (Mailer, error) {
+	switch cfg.MailBackend {
+	case "", "log":
+		return NewLogMailer(cfg.MailFrom), nil
+	case "file":
+		return NewFileMailer(cfg.MailDir, cfg.MailFrom)
+	case "smtp":
+		return NewSMTPMailer(SMTPConfig{
+			Host:     cfg.SMTPHost,
+			Port:     cfg.SMTPPort,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.MailFrom,
+		})
+	default:
+		return nil, fmt.Errorf("unknown mail backend: %s", cfg.MailBackend)
+	}
+}
+
+// format renders msg as an RFC 5322 message
+func format(from string, msg *Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// validHeader rejects values that could inject extra headers
+func validHeader(values ...string) error {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("invalid header value %q", v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+// SMTPMailer sends through an SMTP relay. The connection is upgraded with
+// STARTTLS when the server offers it; credentials are only sent over TLS
+// or to localhost.
+type SMTPMailer struct {
+	cfg      SMTPConfig
+	addr     string
+	envelope string // bare sender address for MAIL FROM
+	auth     smtp.Auth
+}
+
+func NewSMTPMailer(cfg SMTPConfig) (*SMTPMailer, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("SMTP host is required")
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, errors.New("invalid sender address")
+	}
+
+	m := &SMTPMailer{
+		cfg:      cfg,
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		envelope: from.Address,
+	}
+	if cfg.Username != "" {
+		m.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	if err := validHeader(msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	// net/smtp has no context support, so give up waiting rather than
+	// blocking the caller past its deadline
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.envelope, []string{msg.To}, format(m.cfg.From, msg))
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
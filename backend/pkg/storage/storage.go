@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ganeshkantimahanthi/messaging-platform/pkg/config"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore stores opaque binary objects under slash-separated keys
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens the object for reading starting at offset. A negative
+	// length reads to the end of the object.
+	Get(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// New returns the blob store selected by cfg.StorageBackend
+func New(cfg *config.Config) (BlobStore, error) {
+	switch cfg.StorageBackend {
+	case "", "local":
+		return NewLocalStore(cfg.StoragePath)
+	case "s3":
+		return NewS3Store(S3Config{
+			Endpoint:     cfg.S3Endpoint,
+			Region:       cfg.S3Region,
+			Bucket:       cfg.S3Bucket,
+			AccessKey:    cfg.S3AccessKey,
+			SecretKey:    cfg.S3SecretKey,
+			UsePathStyle: cfg.S3UsePathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
+	}
+}
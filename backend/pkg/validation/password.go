@@ -0,0 +1,82 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// bcrypt ignores everything past 72 bytes
+const maxPasswordBytes = 72
+
+// PasswordPolicy sets how strong a password must be. MinClasses counts
+// lower case, upper case, digits and other characters.
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int
+}
+
+// A few of the passwords every guessing list starts with
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "passw0rd": true,
+	"12345678": true, "123456789": true, "1234567890": true, "87654321": true,
+	"qwertyuiop": true, "qwerty123": true, "1q2w3e4r": true, "1qaz2wsx": true,
+	"iloveyou": true, "sunshine": true, "princess": true, "football": true,
+	"baseball": true, "welcome1": true, "letmein1": true, "trustno1": true,
+	"abc12345": true, "admin123": true, "superman": true, "whatever": true,
+	"11111111": true, "00000000": true, "asdfghjk": true, "zaq12wsx": true,
+}
+
+// Check reports what, if anything, is wrong with password. Personal values
+// such as the username and email must not appear in it.
+func (p PasswordPolicy) Check(password string, personal ...string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("password must be at most %d bytes", maxPasswordBytes)
+	}
+	if classes := characterClasses(password); classes < p.MinClasses {
+		return fmt.Errorf("password must mix at least %d of lower case, upper case, digits and symbols", p.MinClasses)
+	}
+
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return errors.New("password is too common")
+	}
+	for _, value := range personal {
+		value = strings.ToLower(value)
+		if local, _, ok := strings.Cut(value, "@"); ok {
+			value = local
+		}
+		if len(value) >= 3 && strings.Contains(lower, value) {
+			return errors.New("password must not contain your username or email")
+		}
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+
+	count := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			count++
+		}
+	}
+	return count
+}
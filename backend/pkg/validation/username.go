@@ -0,0 +1,61 @@
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// UsernameRules limits what usernames look like. Reserved names are
+// compared case-insensitively.
+type UsernameRules struct {
+	minLength int
+	maxLength int
+	allowed   *regexp.Regexp
+	charset   string
+	reserved  map[string]bool
+}
+
+// NewUsernameRules builds rules from a length range, a regexp character
+// class body such as "a-zA-Z0-9_." and the names nobody may register
+func NewUsernameRules(minLength, maxLength int, charset string, reserved []string) (*UsernameRules, error) {
+	if minLength < 1 || maxLength < minLength {
+		return nil, fmt.Errorf("invalid username length range %d-%d", minLength, maxLength)
+	}
+	allowed, err := regexp.Compile("^[" + charset + "]+$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid username charset %q: %w", charset, err)
+	}
+
+	rules := &UsernameRules{
+		minLength: minLength,
+		maxLength: maxLength,
+		allowed:   allowed,
+		charset:   charset,
+		reserved:  make(map[string]bool, len(reserved)),
+	}
+	for _, name := range reserved {
+		if name = strings.TrimSpace(name); name != "" {
+			rules.reserved[strings.ToLower(name)] = true
+		}
+	}
+	return rules, nil
+}
+
+// Check reports what, if anything, is wrong with username
+func (r *UsernameRules) Check(username string) error {
+	if username == "" {
+		return errors.New("username is required")
+	}
+	if n := len([]rune(username)); n < r.minLength || n > r.maxLength {
+		return fmt.Errorf("username must be %d to %d characters", r.minLength, r.maxLength)
+	}
+	if !r.allowed.MatchString(username) {
+		return fmt.Errorf("username may only contain %s", r.charset)
+	}
+	if r.reserved[strings.ToLower(username)] {
+		return errors.New("username is reserved")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Package validation checks user-supplied account fields and collects
+// per-field errors, so clients can point at the input that needs fixing.
+package validation
+
+import (
+	"errors"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// Errors maps a field name to what is wrong with it
+type Errors map[string]string
+
+// Add records err against field, keeping the first error per field. A nil
+// err is ignored, so checks can be added unconditionally.
+func (e Errors) Add(field string, err error) {
+	if err == nil {
+		return
+	}
+	if _, ok := e[field]; !ok {
+		e[field] = err.Error()
+	}
+}
+
+// Err returns e as an error, or nil if no field failed
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	messages := make([]string, len(fields))
+	for i, field := range fields {
+		messages[i] = e[field]
+	}
+	return strings.Join(messages, "; ")
+}
+
+// NormalizeEmail trims and lower-cases an address, so lookups don't depend
+// on how the user typed it
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Email checks that email is a bare address like "john@example.com"
+func Email(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return errors.New("email address is invalid")
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	if !strings.Contains(domain, ".") || strings.HasPrefix(domain, ".") || strings.HasSuffix(domain, ".") {
+		return errors.New("email address is invalid")
+	}
+	return nil
+}
+
+// NormalizePhone converts a phone number written with the usual separators
+// ("+1 (555) 010-0000", "0044 20 7946 0000") to E.164 ("+15550100000").
+// The country code is required.
+func NormalizePhone(phone string) (string, error) {
+	cleaned := strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(strings.TrimSpace(phone))
+	if strings.HasPrefix(cleaned, "00") {
+		cleaned = "+" + cleaned[2:]
+	}
+	if !strings.HasPrefix(cleaned, "+") {
+		return "", errors.New("phone number must include the country code, e.g. +15550100000")
+	}
+
+	digits := cleaned[1:]
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", errors.New("phone number is invalid")
+	}
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", errors.New("phone number is invalid")
+		}
+	}
+	return cleaned, nil
+}
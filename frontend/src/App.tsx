@@ -2,6 +2,9 @@ import { BrowserRouter, Routes, Route, Navigate } from 'react-router-dom';
 import { AuthProvider, useAuth } from '@/contexts/AuthContext';
 import Login from '@/pages/Login';
 import Chat from '@/pages/Chat';
+import ResetPassword from '@/pages/ResetPassword';
+import VerifyEmail from '@/pages/VerifyEmail';
+import AuthCallback from '@/pages/AuthCallback';
 import { ReactNode } from 'react';
 
 interface RouteGuardProps {
@@ -49,6 +52,24 @@ function App() {
               </PrivateRoute>
             }
           />
+          <Route
+            path="/reset-password"
+            element={
+              <PublicRoute>
+                <ResetPassword />
+              </PublicRoute>
+            }
+          />
+          <Route path="/verify-email" element={<VerifyEmail />} />
+          <Route path="/confirm-email" element={<VerifyEmail change />} />
+          <Route
+            path="/auth/callback"
+            element={
+              <PublicRoute>
+                <AuthCallback />
+              </PublicRoute>
+            }
+          />
           <Route path="/" element={<Navigate to="/chat" />} />
         </Routes>
       </AuthProvider>
@@ -6,6 +6,7 @@ export const LoginForm = ({
   isLogin, 
   onSubmit, 
   error, 
+  fieldErrors = {},
   loading 
 }: LoginFormProps) => {
   const [username, setUsername] = useState('');
@@ -24,6 +25,7 @@ export const LoginForm = ({
         type="text"
         value={username}
         onChange={(e) => setUsername(e.target.value)}
+        error={fieldErrors.username}
         required
         disabled={loading}
         placeholder="Enter your username"
@@ -35,6 +37,7 @@ export const LoginForm = ({
           type="email"
           value={email}
           onChange={(e) => setEmail(e.target.value)}
+          error={fieldErrors.email}
           required
           disabled={loading}
           placeholder="Enter your email"
@@ -46,12 +49,13 @@ export const LoginForm = ({
         type="password"
         value={password}
         onChange={(e) => setPassword(e.target.value)}
+        error={fieldErrors.password}
         required
         disabled={loading}
         placeholder="Enter your password"
       />
 
-      {error && <ErrorMessage message={error} />}
+      {error && Object.keys(fieldErrors).length === 0 && <ErrorMessage message={error} />}
 
       <Button 
         type="submit" 
@@ -10,7 +10,7 @@ export const ChatHeader = ({ contact }: ChatHeaderProps) => {
         status={contact.status}
       />
       <div>
-        <h3 className="font-semibold text-gray-800">{contact.username}</h3>
+        <h3 className="font-semibold text-gray-800">{contact.display_name || contact.username}</h3>
         <span className="text-sm text-gray-500 capitalize">
           {contact.status || 'offline'}
         </span>
@@ -19,10 +19,13 @@ export const ContactItem = ({
       />
       <div className="flex-1 min-w-0">
         <div className="font-medium text-gray-800 truncate">
-          {contact.username}
+          {contact.display_name || contact.username}
         </div>
-        <div className="text-sm text-gray-500 capitalize">
-          {contact.status || 'offline'}
+        <div className="text-sm text-gray-500 truncate">
+          {contact.custom_status
+            ? [contact.custom_status.emoji, contact.custom_status.text].filter(Boolean).join(' ') ||
+              (contact.custom_status.do_not_disturb ? 'Do not disturb' : '')
+            : <span className="capitalize">{contact.status || 'offline'}</span>}
         </div>
       </div>
     </div>
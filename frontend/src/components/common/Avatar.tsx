@@ -19,7 +19,7 @@ export const Avatar = ({
       {status && (
         <span 
           className={`absolute bottom-0 right-0 w-3 h-3 rounded-full border-2 border-white
-            ${status === 'online' ? 'bg-green-500' : 'bg-gray-400'}`}
+            ${status === 'online' ? 'bg-green-500' : status === 'away' ? 'bg-yellow-400' : 'bg-gray-400'}`}
         />
       )}
     </div>
@@ -15,7 +15,7 @@ export interface InputProps extends React.InputHTMLAttributes<HTMLInputElement>
 export interface AvatarProps {
   username: string;
   size?: 'sm' | 'md' | 'lg';
-  status?: 'online' | 'offline';
+  status?: 'online' | 'away' | 'offline';
 }
 
 export interface ErrorMessageProps {
@@ -32,6 +32,7 @@ export interface LoginFormProps {
   isLogin: boolean;
   onSubmit: (username: string, email: string, password: string) => Promise<void>;
   error?: string;
+  fieldErrors?: Record<string, string>;
   loading?: boolean;
 }
 
@@ -1,6 +1,7 @@
 import { createContext, useContext, useState, useEffect, ReactNode } from 'react';
 import axios, { AxiosError } from 'axios';
-import type { User, AuthContextType, LoginResult, AuthResponse } from '@/types';
+import api from '@/services/api';
+import type { User, AuthContextType, LoginResult, AuthResponse, TwoFactorChallenge } from '@/types';
 
 const AuthContext = createContext<AuthContextType | null>(null);
 
@@ -24,11 +25,31 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
     // eslint-disable-next-line react-hooks/exhaustive-deps
   }, [token]);
 
+  // Follow tokens rotated by the API client
+  useEffect(() => {
+    const onToken = (event: Event) => {
+      const next = (event as CustomEvent<string | null>).detail;
+      setToken(next);
+      if (!next) {
+        setUser(null);
+        localStorage.removeItem('user');
+      }
+    };
+    window.addEventListener('auth:token', onToken);
+    return () => window.removeEventListener('auth:token', onToken);
+  }, []);
+
+  const saveSession = (data: AuthResponse) => {
+    setToken(data.token);
+    setUser(data.user);
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refresh_token', data.refresh_token);
+    localStorage.setItem('user', JSON.stringify(data.user));
+  };
+
   const fetchUser = async () => {
     try {
-      const response = await axios.get<User>(`${API_URL}/users/me`, {
-        headers: { Authorization: `Bearer ${token}` }
-      });
+      const response = await api.get<User>('/users/me');
       setUser(response.data);
     } catch (error) {
       console.error('Failed to fetch user:', error);
@@ -40,15 +61,49 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
 
   const login = async (username: string, password: string): Promise<LoginResult> => {
     try {
-      const response = await axios.post<AuthResponse>(`${API_URL}/auth/login`, {
+      const response = await axios.post<AuthResponse | TwoFactorChallenge>(`${API_URL}/auth/login`, {
         username,
         password
       });
-      const { token: newToken, user: userData } = response.data;
-      setToken(newToken);
-      setUser(userData);
-      localStorage.setItem('token', newToken);
-      localStorage.setItem('user', JSON.stringify(userData));
+      if ('two_factor_required' in response.data) {
+        return { success: false, challengeToken: response.data.challenge_token };
+      }
+      saveSession(response.data);
+      return { success: true };
+    } catch (error) {
+      const axiosError = error as AxiosError<{ error: string }>;
+      return {
+        success: false,
+        error: axiosError.response?.data?.error || 'Login failed'
+      };
+    }
+  };
+
+  const verifyTwoFactor = async (challengeToken: string, code: string): Promise<LoginResult> => {
+    try {
+      const response = await axios.post<AuthResponse>(`${API_URL}/auth/login/2fa`, {
+        challenge_token: challengeToken,
+        code
+      });
+      saveSession(response.data);
+      return { success: true };
+    } catch (error) {
+      const axiosError = error as AxiosError<{ error: string }>;
+      return {
+        success: false,
+        error: axiosError.response?.data?.error || 'Verification failed'
+      };
+    }
+  };
+
+  // Finishes a login through an OIDC provider with the code from its callback
+  const completeProviderLogin = async (code: string): Promise<LoginResult> => {
+    try {
+      const response = await axios.post<AuthResponse | TwoFactorChallenge>(`${API_URL}/auth/oidc/exchange`, { code });
+      if ('two_factor_required' in response.data) {
+        return { success: false, challengeToken: response.data.challenge_token };
+      }
+      saveSession(response.data);
       return { success: true };
     } catch (error) {
       const axiosError = error as AxiosError<{ error: string }>;
@@ -66,30 +121,32 @@ export const AuthProvider = ({ children }: AuthProviderProps) => {
         email,
         password
       });
-      const { token: newToken, user: userData } = response.data;
-      setToken(newToken);
-      setUser(userData);
-      localStorage.setItem('token', newToken);
-      localStorage.setItem('user', JSON.stringify(userData));
+      saveSession(response.data);
       return { success: true };
     } catch (error) {
-      const axiosError = error as AxiosError<{ error: string }>;
+      const axiosError = error as AxiosError<{ error: string; fields?: Record<string, string> }>;
       return {
         success: false,
-        error: axiosError.response?.data?.error || 'Registration failed'
+        error: axiosError.response?.data?.error || 'Registration failed',
+        fieldErrors: axiosError.response?.data?.fields
       };
     }
   };
 
   const logout = () => {
+    const current = localStorage.getItem('token');
+    if (current) {
+      api.post('/auth/logout', null, { headers: { Authorization: `Bearer ${current}` } }).catch(() => {});
+    }
     setToken(null);
     setUser(null);
     localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
     localStorage.removeItem('user');
   };
 
   return (
-    <AuthContext.Provider value={{ user, token, login, register, logout, loading }}>
+    <AuthContext.Provider value={{ user, token, login, verifyTwoFactor, completeProviderLogin, register, logout, loading }}>
       {children}
     </AuthContext.Provider>
   );
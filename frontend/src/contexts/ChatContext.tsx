@@ -1,7 +1,7 @@
 import { createContext, useContext, useState, useEffect, ReactNode, useRef } from 'react';
 import { useWebSocket } from '@/hooks/useWebSocket';
 import { contactAPI, messageAPI } from '@/services/api';
-import type { Contact, Conversation, Message, WebSocketMessage } from '@/types';
+import type { Contact, Conversation, CustomStatus, Message, WebSocketMessage } from '@/types';
 import { AxiosError } from 'axios';
 import { v4 as uuidv4 } from 'uuid';
 
@@ -37,7 +37,7 @@ interface ChatProviderProps {
 }
 
 export const ChatProvider = ({ children }: ChatProviderProps) => {
-  const { sendChatMessage, onMessage } = useWebSocket();
+  const { sendChatMessage, onMessage, subscribePresence, isConnected } = useWebSocket();
   const [contacts, setContacts] = useState<Contact[]>([]);
   const [conversations, setConversations] = useState<Conversation[]>([]);
   const [selectedContact, setSelectedContact] = useState<Contact | null>(null);
@@ -69,6 +69,10 @@ export const ChatProvider = ({ children }: ChatProviderProps) => {
   useEffect(() => {
     // Handle incoming WebSocket messages
     onMessage('new_message', (data: WebSocketMessage) => {
+      // Messages arrive silently while do not disturb is on
+      if (data.message && !data.silent && document.hidden && 'Notification' in window && Notification.permission === 'granted') {
+        new Notification('New message', { body: data.message.content });
+      }
       if (selectedConversation && data.message && data.message.conversation_id === selectedConversation) {
         setMessages(prev => {
           // Prevent duplicates by checking if message already exists
@@ -82,6 +86,19 @@ export const ChatProvider = ({ children }: ChatProviderProps) => {
       loadConversations();
     });
 
+    // Messages this user sent from another device
+    onMessage('message_sent_elsewhere', (data: WebSocketMessage) => {
+      if (selectedConversation && data.message && data.message.conversation_id === selectedConversation) {
+        setMessages(prev => {
+          if (prev.some(m => m.id === data.message!.id)) {
+            return prev;
+          }
+          return [...prev, data.message!];
+        });
+      }
+      loadConversations();
+    });
+
     onMessage('message_ack', (data: WebSocketMessage) => {
       const { temp_id, server_id, timestamp, status, error } = data;
       
@@ -128,6 +145,36 @@ export const ChatProvider = ({ children }: ChatProviderProps) => {
       }
     });
 
+    onMessage('profile_updated', (data: WebSocketMessage) => {
+      const { user_id, profile } = data;
+
+      if (!user_id || !profile) return;
+
+      setContacts(prev => prev.map(c =>
+        c.id === user_id ? { ...c, ...profile } : c
+      ));
+    });
+
+    onMessage('presence_snapshot', (data: WebSocketMessage) => {
+      const presence = (data.presence || []) as { user_id: string; status: Contact['status']; last_seen: string; custom_status?: CustomStatus }[];
+      const byUser = new Map(presence.map(p => [p.user_id, p]));
+
+      setContacts(prev => prev.map(c => {
+        const p = byUser.get(c.id);
+        return p ? { ...c, status: p.status, last_seen: p.last_seen, custom_status: p.custom_status } : c;
+      }));
+    });
+
+    onMessage('presence_update', (data: WebSocketMessage) => {
+      const { user_id, status, last_seen, custom_status } = data;
+
+      if (!user_id || !status) return;
+
+      setContacts(prev => prev.map(c =>
+        c.id === user_id ? { ...c, status: status as Contact['status'], last_seen, custom_status } : c
+      ));
+    });
+
     onMessage('status_update', (data: WebSocketMessage) => {
       const { message_id, status } = data;
       
@@ -142,6 +189,16 @@ export const ChatProvider = ({ children }: ChatProviderProps) => {
     // eslint-disable-next-line react-hooks/exhaustive-deps
   }, [selectedConversation, onMessage]);
 
+  // Watch the presence of everyone in the contact list, again after each
+  // reconnect since subscriptions end with the connection
+  // (the server allows PRESENCE_MAX_SUBSCRIPTIONS, 200 by default)
+  const contactIds = contacts.slice(0, 200).map(c => c.id).join(',');
+  useEffect(() => {
+    if (isConnected) {
+      subscribePresence(contactIds ? contactIds.split(',') : []);
+    }
+  }, [isConnected, contactIds, subscribePresence]);
+
   const loadInitialData = async () => {
     try {
       const [contactsRes, conversationsRes] = await Promise.all([
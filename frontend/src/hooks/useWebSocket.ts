@@ -1,31 +1,65 @@
 import { useEffect, useRef, useState, useCallback } from 'react';
 import { useAuth } from '@/contexts/AuthContext';
+import { refreshAccessToken } from '@/services/api';
 import type { WebSocketMessage, WebSocketMessageType } from '@/types';
 
 const WS_URL = import.meta.env.VITE_WS_URL || 'ws://localhost:8080/ws';
 
+// Close codes the server uses to end a connection for auth reasons
+const CLOSE_TOKEN_EXPIRED = 4001;
+const CLOSE_SESSION_REVOKED = 4003;
+
+// Without input for this long the tab reports itself idle
+const IDLE_AFTER_MS = 60_000;
+// Input re-announces activity at most this often
+const ACTIVE_THROTTLE_MS = 30_000;
+
 type MessageHandler = (data: WebSocketMessage) => void;
 
+// Identifies this browser across connections and logins so it shows up as
+// one entry in the device list
+const deviceId = (): string => {
+  let id = localStorage.getItem('device_id');
+  if (!id) {
+    id = crypto.randomUUID();
+    localStorage.setItem('device_id', id);
+  }
+  return id;
+};
+
 interface UseWebSocketReturn {
   isConnected: boolean;
   sendChatMessage: (recipientId: string, content: string, conversationId?: string | null, tempId?: string) => { success: boolean };
   sendTypingIndicator: (recipientId: string, isTyping: boolean) => boolean;
   sendReadReceipt: (messageId: string) => boolean;
+  subscribePresence: (userIds: string[]) => boolean;
   onMessage: (type: WebSocketMessageType, handler: MessageHandler) => void;
   offMessage: (type: WebSocketMessageType) => void;
 }
 
 export const useWebSocket = (): UseWebSocketReturn => {
-  const { token, user } = useAuth();
+  const { token, user, logout } = useAuth();
   const [isConnected, setIsConnected] = useState<boolean>(false);
   const ws = useRef<WebSocket | null>(null);
   const reconnectTimeout = useRef<NodeJS.Timeout | null>(null);
   const messageHandlers = useRef<Record<string, MessageHandler>>({});
+  const tokenRef = useRef<string | null>(token);
+  const closedByUs = useRef<boolean>(false);
+  const hasToken = token !== null;
+
+  // Hand rotated tokens to the open socket instead of reconnecting
+  useEffect(() => {
+    tokenRef.current = token;
+    if (token && ws.current && ws.current.readyState === WebSocket.OPEN) {
+      ws.current.send(JSON.stringify({ type: 'auth', data: { token } }));
+    }
+  }, [token]);
 
   const connect = useCallback(() => {
-    if (!token || !user) return;
+    if (!tokenRef.current || !user) return;
 
-    const wsUrl = `${WS_URL}?token=${token}`;
+    closedByUs.current = false;
+    const wsUrl = `${WS_URL}?token=${tokenRef.current}&device_id=${deviceId()}&device_type=web`;
     ws.current = new WebSocket(wsUrl);
 
     ws.current.onopen = () => {
@@ -51,19 +85,31 @@ export const useWebSocket = (): UseWebSocketReturn => {
       console.error('WebSocket error:', error);
     };
 
-    ws.current.onclose = () => {
+    ws.current.onclose = (event: CloseEvent) => {
       console.log('WebSocket disconnected');
       setIsConnected(false);
+      if (closedByUs.current) return;
+
+      if (event.code === CLOSE_SESSION_REVOKED) {
+        logout();
+        return;
+      }
 
-      // Attempt to reconnect after 3 seconds
-      reconnectTimeout.current = setTimeout(() => {
+      // Attempt to reconnect after 3 seconds, with a fresh token if ours expired
+      reconnectTimeout.current = setTimeout(async () => {
+        if (event.code === CLOSE_TOKEN_EXPIRED) {
+          tokenRef.current = await refreshAccessToken();
+          if (!tokenRef.current) return;
+        }
         console.log('Attempting to reconnect...');
         connect();
       }, 3000);
     };
-  }, [token, user]);
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [hasToken, user]);
 
   const disconnect = useCallback(() => {
+    closedByUs.current = true;
     if (reconnectTimeout.current) {
       clearTimeout(reconnectTimeout.current);
     }
@@ -114,16 +160,58 @@ export const useWebSocket = (): UseWebSocketReturn => {
     });
   }, [sendMessage]);
 
+  // Replaces the users whose presence this connection watches
+  const subscribePresence = useCallback((userIds: string[]): boolean => {
+    return sendMessage('subscribe_presence', { user_ids: userIds });
+  }, [sendMessage]);
+
   useEffect(() => {
     connect();
     return () => disconnect();
   }, [connect, disconnect]);
 
+  // Report active, idle and background so presence reflects whether the
+  // user is actually here
+  useEffect(() => {
+    if (!isConnected) return;
+
+    let state = '';
+    let lastActive = 0;
+    let idleTimer: ReturnType<typeof setTimeout> | undefined;
+
+    const report = (next: string) => {
+      if (next === state && (next !== 'active' || Date.now() - lastActive < ACTIVE_THROTTLE_MS)) return;
+      if (sendMessage(next, {})) {
+        state = next;
+        if (next === 'active') lastActive = Date.now();
+      }
+    };
+    const onInput = () => {
+      if (document.hidden) return;
+      report('active');
+      clearTimeout(idleTimer);
+      idleTimer = setTimeout(() => report('idle'), IDLE_AFTER_MS);
+    };
+    const onVisibility = () => (document.hidden ? report('background') : onInput());
+
+    const inputEvents = ['mousemove', 'keydown', 'pointerdown', 'scroll', 'focus'];
+    inputEvents.forEach(e => window.addEventListener(e, onInput, { passive: true }));
+    document.addEventListener('visibilitychange', onVisibility);
+    onVisibility();
+
+    return () => {
+      clearTimeout(idleTimer);
+      inputEvents.forEach(e => window.removeEventListener(e, onInput));
+      document.removeEventListener('visibilitychange', onVisibility);
+    };
+  }, [isConnected, sendMessage]);
+
   return {
     isConnected,
     sendChatMessage,
     sendTypingIndicator,
     sendReadReceipt,
+    subscribePresence,
     onMessage,
     offMessage
   };
@@ -0,0 +1,32 @@
+import { useEffect, useRef } from 'react';
+import { useNavigate, useSearchParams } from 'react-router-dom';
+import { useAuth } from '@/contexts/AuthContext';
+
+// Landing page for logins through an OIDC provider
+function AuthCallback() {
+  const [searchParams] = useSearchParams();
+  const navigate = useNavigate();
+  const { completeProviderLogin } = useAuth();
+  const requested = useRef(false);
+
+  useEffect(() => {
+    // The code is single-use, so don't send it twice under StrictMode
+    if (requested.current) return;
+    requested.current = true;
+
+    const code = searchParams.get('code') || '';
+    completeProviderLogin(code).then((result) => {
+      if (result.challengeToken) {
+        navigate('/login', { replace: true, state: { challengeToken: result.challengeToken } });
+      } else if (!result.success) {
+        navigate(`/login?error=${encodeURIComponent(result.error || 'Login failed')}`, { replace: true });
+      }
+      // On success PublicRoute redirects to the chat
+    });
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, []);
+
+  return <div className="loading">Signing in...</div>;
+}
+
+export default AuthCallback;
@@ -1,27 +1,103 @@
-import { useState } from 'react';
+import { useState, useEffect, FormEvent } from 'react';
+import { Link, useLocation, useSearchParams } from 'react-router-dom';
 import { useAuth } from '@/contexts/AuthContext';
+import { accountAPI } from '@/services/api';
+import type { LoginProvider } from '@/types';
 import { LoginForm, AuthToggle } from '@/components/auth';
+import { Button, Input, ErrorMessage } from '@/components/common';
 
 function Login() {
   const [isLogin, setIsLogin] = useState<boolean>(true);
-  const [error, setError] = useState<string>('');
+  const [searchParams] = useSearchParams();
+  const location = useLocation();
+  const [error, setError] = useState<string>(searchParams.get('error') || '');
+  const [fieldErrors, setFieldErrors] = useState<Record<string, string>>({});
   const [loading, setLoading] = useState<boolean>(false);
-  const { login, register } = useAuth();
+  // A provider login that needs 2FA arrives here with its challenge
+  const [challengeToken, setChallengeToken] = useState<string>(
+    (location.state as { challengeToken?: string } | null)?.challengeToken || ''
+  );
+  const [providers, setProviders] = useState<LoginProvider[]>([]);
+  const [code, setCode] = useState<string>('');
+  const { login, verifyTwoFactor, register } = useAuth();
+
+  useEffect(() => {
+    accountAPI
+      .getProviders()
+      .then((response) => setProviders(response.data))
+      .catch(() => setProviders([]));
+  }, []);
 
   const handleSubmit = async (username: string, email: string, password: string) => {
     setError('');
+    setFieldErrors({});
     setLoading(true);
 
     const result = isLogin
       ? await login(username, password)
       : await register(username, email, password);
 
+    if (result.challengeToken) {
+      setChallengeToken(result.challengeToken);
+    } else if (!result.success) {
+      setError(result.error || 'An error occurred');
+      setFieldErrors(result.fieldErrors || {});
+    }
+    setLoading(false);
+  };
+
+  const handleVerify = async (e: FormEvent<HTMLFormElement>) => {
+    e.preventDefault();
+    setError('');
+    setLoading(true);
+
+    const result = await verifyTwoFactor(challengeToken, code);
     if (!result.success) {
       setError(result.error || 'An error occurred');
     }
     setLoading(false);
   };
 
+  if (challengeToken) {
+    return (
+      <div className="min-h-screen flex items-center justify-center bg-gradient-to-br from-primary to-secondary">
+        <div className="bg-white p-8 rounded-xl shadow-2xl w-full max-w-md">
+          <h1 className="text-3xl font-bold text-center mb-6 text-gray-800">Two-Factor Authentication</h1>
+          <form onSubmit={handleVerify} className="space-y-4">
+            <Input
+              label="Authentication code"
+              type="text"
+              autoComplete="one-time-code"
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+              required
+              disabled={loading}
+              placeholder="6-digit code or recovery code"
+            />
+
+            {error && <ErrorMessage message={error} />}
+
+            <Button type="submit" className="w-full" isLoading={loading} disabled={loading}>
+              Verify
+            </Button>
+          </form>
+          <p className="text-center mt-4 text-gray-600">
+            <span
+              onClick={() => {
+                setChallengeToken('');
+                setCode('');
+                setError('');
+              }}
+              className="text-primary font-semibold cursor-pointer hover:underline"
+            >
+              Back to login
+            </span>
+          </p>
+        </div>
+      </div>
+    );
+  }
+
   return (
     <div className="min-h-screen flex items-center justify-center bg-gradient-to-br from-primary to-secondary">
       <div className="bg-white p-8 rounded-xl shadow-2xl w-full max-w-md">
@@ -32,13 +108,35 @@ function Login() {
           isLogin={isLogin}
           onSubmit={handleSubmit}
           error={error}
+          fieldErrors={fieldErrors}
           loading={loading}
         />
+        {isLogin && providers.length > 0 && (
+          <div className="mt-4 space-y-2">
+            {providers.map((provider) => (
+              <a
+                key={provider.name}
+                href={accountAPI.providerLoginURL(provider.name)}
+                className="block w-full text-center px-4 py-2 rounded-lg bg-gray-200 text-gray-800 hover:bg-gray-300"
+              >
+                Continue with {provider.display_name}
+              </a>
+            ))}
+          </div>
+        )}
+        {isLogin && (
+          <p className="text-center mt-4 text-sm">
+            <Link to="/reset-password" className="text-primary hover:underline">
+              Forgot password?
+            </Link>
+          </p>
+        )}
         <AuthToggle
           isLogin={isLogin}
           onToggle={() => {
             setIsLogin(!isLogin);
             setError('');
+            setFieldErrors({});
           }}
         />
       </div>
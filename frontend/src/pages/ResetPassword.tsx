@@ -0,0 +1,84 @@
+import { useState, FormEvent } from 'react';
+import { Link, useSearchParams } from 'react-router-dom';
+import { AxiosError } from 'axios';
+import { accountAPI } from '@/services/api';
+import { Button, Input, ErrorMessage } from '@/components/common';
+
+function ResetPassword() {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token');
+  const [email, setEmail] = useState('');
+  const [password, setPassword] = useState('');
+  const [error, setError] = useState<string>('');
+  const [done, setDone] = useState<string>('');
+  const [loading, setLoading] = useState<boolean>(false);
+
+  const handleSubmit = async (e: FormEvent<HTMLFormElement>) => {
+    e.preventDefault();
+    setError('');
+    setLoading(true);
+
+    try {
+      if (token) {
+        await accountAPI.resetPassword(token, password);
+        setDone('Your password has been reset. Sign in with your new password.');
+      } else {
+        await accountAPI.forgotPassword(email);
+        setDone('If an account uses this email, we sent it a link to reset the password.');
+      }
+    } catch (error) {
+      const axiosError = error as AxiosError<{ error: string }>;
+      setError(axiosError.response?.data?.error || 'An error occurred');
+    }
+    setLoading(false);
+  };
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gradient-to-br from-primary to-secondary">
+      <div className="bg-white p-8 rounded-xl shadow-2xl w-full max-w-md">
+        <h1 className="text-3xl font-bold text-center mb-6 text-gray-800">Reset Password</h1>
+        {done ? (
+          <p className="text-center text-gray-700">{done}</p>
+        ) : (
+          <form onSubmit={handleSubmit} className="space-y-4">
+            {token ? (
+              <Input
+                label="New password"
+                type="password"
+                value={password}
+                onChange={(e) => setPassword(e.target.value)}
+                required
+                minLength={8}
+                disabled={loading}
+                placeholder="At least 8 characters"
+              />
+            ) : (
+              <Input
+                label="Email"
+                type="email"
+                value={email}
+                onChange={(e) => setEmail(e.target.value)}
+                required
+                disabled={loading}
+                placeholder="Enter your account email"
+              />
+            )}
+
+            {error && <ErrorMessage message={error} />}
+
+            <Button type="submit" className="w-full" isLoading={loading} disabled={loading}>
+              {token ? 'Set password' : 'Send reset link'}
+            </Button>
+          </form>
+        )}
+        <p className="text-center mt-4 text-gray-600">
+          <Link to="/login" className="text-primary font-semibold hover:underline">
+            Back to login
+          </Link>
+        </p>
+      </div>
+    </div>
+  );
+}
+
+export default ResetPassword;
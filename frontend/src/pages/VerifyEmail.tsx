@@ -0,0 +1,56 @@
+import { useEffect, useRef, useState } from 'react';
+import { Link, useSearchParams } from 'react-router-dom';
+import { AxiosError } from 'axios';
+import { accountAPI } from '@/services/api';
+
+interface VerifyEmailProps {
+  // Confirms a change of address rather than verifying the current one
+  change?: boolean;
+}
+
+function VerifyEmail({ change = false }: VerifyEmailProps) {
+  const [searchParams] = useSearchParams();
+  const token = searchParams.get('token');
+  const [status, setStatus] = useState<'verifying' | 'verified' | 'failed'>('verifying');
+  const [error, setError] = useState<string>('');
+  const requested = useRef(false);
+
+  useEffect(() => {
+    // Tokens are single-use, so don't send it twice under StrictMode
+    if (requested.current) return;
+    requested.current = true;
+
+    if (!token) {
+      setStatus('failed');
+      setError('The verification link is missing its token.');
+      return;
+    }
+
+    (change ? accountAPI.confirmEmailChange(token) : accountAPI.verifyEmail(token))
+      .then(() => setStatus('verified'))
+      .catch((error: AxiosError<{ error: string }>) => {
+        setStatus('failed');
+        setError(error.response?.data?.error || 'Verification failed');
+      });
+  }, [token, change]);
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gradient-to-br from-primary to-secondary">
+      <div className="bg-white p-8 rounded-xl shadow-2xl w-full max-w-md text-center">
+        <h1 className="text-3xl font-bold mb-6 text-gray-800">Email Verification</h1>
+        {status === 'verifying' && <p className="text-gray-600">Verifying your email...</p>}
+        {status === 'verified' && (
+          <p className="text-gray-700">{change ? 'Your email address has been changed.' : 'Your email address is verified.'}</p>
+        )}
+        {status === 'failed' && <p className="text-red-600">{error}</p>}
+        <p className="mt-4">
+          <Link to="/" className="text-primary font-semibold hover:underline">
+            Continue
+          </Link>
+        </p>
+      </div>
+    </div>
+  );
+}
+
+export default VerifyEmail;
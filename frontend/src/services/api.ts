@@ -1,5 +1,5 @@
-import axios, { AxiosInstance } from 'axios';
-import type { User, Contact, Conversation, Message } from '@/types';
+import axios, { AxiosError, AxiosInstance, InternalAxiosRequestConfig } from 'axios';
+import type { User, Contact, Conversation, Message, AuthResponse, LoginProvider, ProfileUpdate, CustomStatus, UsernameChange, DataExport, Device } from '@/types';
 
 const API_URL = import.meta.env.VITE_API_URL || 'http://localhost:8080/api';
 
@@ -16,13 +16,93 @@ api.interceptors.request.use((config) => {
   return config;
 });
 
+// Exchange the refresh token for a new access token. Concurrent callers
+// share one request, since a refresh token can only be used once.
+let refreshing: Promise<string | null> | null = null;
+
+export const refreshAccessToken = (): Promise<string | null> => {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = localStorage.getItem('refresh_token');
+      if (!refreshToken) return null;
+      try {
+        const response = await axios.post<AuthResponse>(`${API_URL}/auth/refresh`, {
+          refresh_token: refreshToken,
+        });
+        localStorage.setItem('token', response.data.token);
+        localStorage.setItem('refresh_token', response.data.refresh_token);
+        window.dispatchEvent(new CustomEvent('auth:token', { detail: response.data.token }));
+        return response.data.token;
+      } catch {
+        localStorage.removeItem('token');
+        localStorage.removeItem('refresh_token');
+        window.dispatchEvent(new CustomEvent('auth:token', { detail: null }));
+        return null;
+      } finally {
+        refreshing = null;
+      }
+    })();
+  }
+  return refreshing;
+};
+
+// Retry a request once with a fresh token when the access token expired
+api.interceptors.response.use(undefined, async (error: AxiosError) => {
+  const config = error.config as (InternalAxiosRequestConfig & { _retried?: boolean }) | undefined;
+  if (error.response?.status !== 401 || !config || config._retried) {
+    throw error;
+  }
+  config._retried = true;
+  const token = await refreshAccessToken();
+  if (!token) throw error;
+  config.headers.Authorization = `Bearer ${token}`;
+  return api(config);
+});
+
+export const accountAPI = {
+  getProviders: () => api.get<LoginProvider[]>('/auth/oidc/providers'),
+  // Full-page navigation: the provider redirects back to the API
+  providerLoginURL: (name: string) => `${API_URL}/auth/oidc/${encodeURIComponent(name)}`,
+  verifyEmail: (token: string) => api.post<void>('/auth/verify-email', { token }),
+  resendVerification: () => api.post<void>('/auth/verify-email/resend'),
+  changeEmail: (password: string, email: string) => api.put<void>('/auth/email', { password, email }),
+  confirmEmailChange: (token: string) => api.post<void>('/auth/confirm-email', { token }),
+  forgotPassword: (email: string) => api.post<void>('/auth/forgot-password', { email }),
+  resetPassword: (token: string, password: string) => api.post<void>('/auth/reset-password', { token, password }),
+  changePassword: (currentPassword: string, newPassword: string) =>
+    api.put<void>('/auth/password', { current_password: currentPassword, new_password: newPassword }),
+  getTwoFactor: () => api.get<{ enabled: boolean; recovery_codes_remaining: number }>('/auth/2fa'),
+  setupTwoFactor: () => api.post<{ secret: string; provisioning_uri: string }>('/auth/2fa/setup'),
+  enableTwoFactor: (code: string) => api.post<{ recovery_codes: string[] }>('/auth/2fa/enable', { code }),
+  disableTwoFactor: (password: string, code: string) => api.post<void>('/auth/2fa/disable', { password, code }),
+  changeUsername: async (username: string) => {
+    const response = await api.put<{ user: User; token: string; expires_at: string }>('/auth/username', { username });
+    // The old access token still names the previous username
+    localStorage.setItem('token', response.data.token);
+    return response;
+  },
+  getUsernameHistory: () => api.get<UsernameChange[]>('/auth/username/history'),
+  requestExport: () => api.post<DataExport>('/account/export'),
+  getExports: () => api.get<DataExport[]>('/account/exports'),
+  downloadExport: (id: string) => api.get<Blob>(`/account/exports/${id}/download`, { responseType: 'blob' }),
+  scheduleDeletion: (password: string) => api.post<{ delete_after: string }>('/account/deletion', { password }),
+  cancelDeletion: () => api.delete<void>('/account/deletion'),
+};
+
 export const userAPI = {
   getMe: () => api.get<User>('/users/me'),
-  updateMe: (data: Partial<User>) => api.put<User>('/users/me', data),
+  updateMe: (data: ProfileUpdate) => api.put<User>('/users/me', data),
+  setStatus: (status: Omit<CustomStatus, 'set_at'>) => api.put<CustomStatus>('/users/me/status', status),
+  clearStatus: () => api.delete<void>('/users/me/status'),
   search: (query: string) => api.get<User[]>(`/users/search?q=${query}`),
   getById: (id: string) => api.get<User>(`/users/${id}`),
 };
 
+export const deviceAPI = {
+  getDevices: () => api.get<Device[]>('/devices'),
+  signOut: (id: string) => api.delete<void>(`/devices/${id}`),
+};
+
 export const contactAPI = {
   getContacts: () => api.get<Contact[]>('/contacts'),
   addContact: (contactId: string) => api.post<void>('/contacts', { contact_id: contactId }),
@@ -2,7 +2,14 @@
 export interface User {
   id: string;
   username: string;
+  display_name?: string;
+  profile_picture?: string;
+  status_message?: string;
+  custom_status?: CustomStatus;
+  username_changed_at?: string;
   email: string;
+  email_verified?: boolean;
+  delete_after?: string;
   created_at?: string;
 }
 
@@ -10,9 +17,21 @@ export interface User {
 export interface Contact {
   id: string;
   username: string;
+  display_name?: string;
+  profile_picture?: string;
+  status_message?: string;
   email?: string;
-  status?: 'online' | 'offline';
+  status?: 'online' | 'away' | 'offline';
   last_seen?: string;
+  custom_status?: CustomStatus;
+}
+
+export interface CustomStatus {
+  emoji?: string;
+  text?: string;
+  do_not_disturb?: boolean;
+  expires_at?: string;
+  set_at?: string;
 }
 
 // Message types
@@ -46,6 +65,10 @@ export type WebSocketMessageType =
   | 'typing'
   | 'read_receipt'
   | 'user_status'
+  | 'profile_updated'
+  | 'message_sent_elsewhere'
+  | 'presence_update'
+  | 'presence_snapshot'
   | 'error';
 
 export interface WebSocketMessage {
@@ -58,6 +81,46 @@ export interface WebSocketMessage {
   [key: string]: any;
 }
 
+export interface UsernameChange {
+  id: string;
+  old_username: string;
+  new_username: string;
+  changed_at: string;
+}
+
+export interface Device {
+  id: string;
+  device_id: string;
+  type: 'web' | 'desktop' | 'ios' | 'android';
+  name?: string;
+  user_agent?: string;
+  ip?: string;
+  created_at: string;
+  last_seen_at: string;
+  online: boolean;
+  current?: boolean;
+}
+
+export interface DataExport {
+  id: string;
+  status: 'pending' | 'processing' | 'ready' | 'failed';
+  size?: number;
+  error?: string;
+  created_at: string;
+  completed_at?: string;
+  expires_at?: string;
+}
+
+export interface ProfileUpdate {
+  display_name?: string;
+  status_message?: string;
+  profile_picture?: string;
+  settings?: {
+    read_receipts?: boolean;
+    last_seen_privacy?: 'everyone' | 'contacts' | 'none';
+  };
+}
+
 // API Response types
 export interface APIResponse<T = any> {
   data?: T;
@@ -67,12 +130,29 @@ export interface APIResponse<T = any> {
 
 export interface AuthResponse {
   token: string;
+  refresh_token: string;
+  expires_at: string;
+  session_id: string;
   user: User;
 }
 
+// Returned by login instead of tokens when the account has 2FA enabled
+export interface TwoFactorChallenge {
+  two_factor_required: true;
+  challenge_token: string;
+  expires_at: string;
+}
+
+export interface LoginProvider {
+  name: string;
+  display_name: string;
+}
+
 export interface LoginResult {
   success: boolean;
   error?: string;
+  fieldErrors?: Record<string, string>;
+  challengeToken?: string;
 }
 
 // Form types
@@ -90,6 +170,8 @@ export interface AuthContextType {
   user: User | null;
   token: string | null;
   login: (username: string, password: string) => Promise<LoginResult>;
+  verifyTwoFactor: (challengeToken: string, code: string) => Promise<LoginResult>;
+  completeProviderLogin: (code: string) => Promise<LoginResult>;
   register: (username: string, email: string, password: string) => Promise<LoginResult>;
   logout: () => void;
   loading: boolean;